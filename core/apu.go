@@ -1,34 +1,144 @@
 package core
 
 import (
-    "log"
     "sync"
     "math"
     // "math/rand/v2"
 )
 
-func fake(){
-    log.Printf("fake")
+// the length timer silences a channel after it has been clocked enough times by the
+// frame sequencer at 256hz
+type lengthCounter struct {
+    LengthEnable bool
+    // counts down, the channel is disabled when it reaches 0
+    Length uint16
+    // 64 for the pulse and noise channels, 256 for the wave channel
+    maxLength uint16
 }
 
-type Pulse struct {
-    Enabled bool
-    PanLeft bool
-    PanRight bool
+func (length *lengthCounter) load(value uint16) {
+    length.Length = length.maxLength - value
+}
 
-    LengthEnable bool
+// returns false if the channel should be disabled
+func (length *lengthCounter) clock() bool {
+    if length.LengthEnable && length.Length > 0 {
+        length.Length -= 1
+        if length.Length == 0 {
+            return false
+        }
+    }
 
-    Duty uint8
-    DutyIndex uint8
-    Length uint8
+    return true
+}
+
+// handle a write to NRx4. lengthStep is true if the next frame sequencer step clocks
+// the length timer. returns false if the channel should be disabled
+func (length *lengthCounter) control(enable bool, trigger bool, lengthStep bool) bool {
+    wasEnabled := length.LengthEnable
+    length.LengthEnable = enable
 
+    active := true
+
+    // enabling the length timer in the first half of a length period clocks it once
+    if !wasEnabled && enable && !lengthStep && length.Length > 0 {
+        length.Length -= 1
+        if length.Length == 0 && !trigger {
+            active = false
+        }
+    }
+
+    if trigger && length.Length == 0 {
+        length.Length = length.maxLength
+        if enable && !lengthStep {
+            length.Length -= 1
+        }
+    }
+
+    return active
+}
+
+// the volume envelope is clocked by the frame sequencer at 64hz
+type envelope struct {
     // 4-bit volume
     Volume uint8
     InitialVolume uint8
     EnvelopeDirection int8 // -1 for decrease, 1 for increase
     EnvelopeSweep uint8 // 3-bit sweep
-    envelopeSweepCounter uint8
+    envelopeTimer uint8
+}
+
+func (envelope *envelope) set(volume uint8, envelopeDirection uint8, envelopeSweep uint8) {
+    envelope.InitialVolume = volume
+    if envelopeDirection == 0 {
+        envelope.EnvelopeDirection = -1
+    } else {
+        envelope.EnvelopeDirection = 1
+    }
+
+    envelope.EnvelopeSweep = envelopeSweep
+}
+
+func (envelope *envelope) trigger() {
+    envelope.Volume = envelope.InitialVolume
+    envelope.envelopeTimer = envelope.EnvelopeSweep
+    if envelope.envelopeTimer == 0 {
+        envelope.envelopeTimer = 8
+    }
+}
 
+func (envelope *envelope) clock() {
+    if envelope.EnvelopeSweep == 0 {
+        return
+    }
+
+    if envelope.envelopeTimer > 0 {
+        envelope.envelopeTimer -= 1
+    }
+
+    if envelope.envelopeTimer == 0 {
+        envelope.envelopeTimer = envelope.EnvelopeSweep
+        if envelope.EnvelopeDirection == -1 {
+            if envelope.Volume > 0 {
+                envelope.Volume -= 1
+            }
+        } else {
+            if envelope.Volume < 15 {
+                envelope.Volume += 1
+            }
+        }
+    }
+}
+
+// the NRx2 register
+func (envelope *envelope) read() uint8 {
+    var out uint8 = 0
+    out |= (envelope.InitialVolume & 0b1111) << 4 // top 4 bits are volume
+    if envelope.EnvelopeDirection == 1 {
+        out |= 0b1000 // envelope direction bit
+    }
+    out |= envelope.EnvelopeSweep & 0b111 // bottom 3 bits are envelope sweep
+
+    return out
+}
+
+// the dac is on if any of the upper 5 bits of NRx2 are set
+func (envelope *envelope) dacEnabled() bool {
+    return envelope.InitialVolume != 0 || envelope.EnvelopeDirection == 1
+}
+
+type Pulse struct {
+    Enabled bool
+    PanLeft bool
+    PanRight bool
+
+    lengthCounter
+    envelope
+
+    Duty uint8
+    DutyIndex uint8
+
+    // counts up to 2048, at which point the duty step advances
     Period uint16
 
     PeriodHigh uint16
@@ -39,23 +149,44 @@ type Pulse struct {
     Direction uint8
     Step uint8
 
+    // the sweep works on a copy of the period
+    sweepShadow uint16
+    sweepTimer uint8
+    sweepEnabled bool
+    // a sweep calculation in the subtraction direction happened since the last trigger
+    sweepNegated bool
+
     cycles uint64
 }
 
 func (pulse *Pulse) Trigger() {
     pulse.Period = (pulse.PeriodHigh << 8) | pulse.PeriodLow
-    pulse.Volume = pulse.InitialVolume
-    pulse.Length = 0
-    pulse.Enabled = true
+    pulse.envelope.trigger()
+    pulse.Enabled = pulse.dacEnabled()
+
+    if pulse.hasPeriodSweep {
+        pulse.sweepShadow = (pulse.PeriodHigh << 8) | pulse.PeriodLow
+        pulse.sweepTimer = pulse.Pace
+        if pulse.sweepTimer == 0 {
+            pulse.sweepTimer = 8
+        }
+        pulse.sweepEnabled = pulse.Pace != 0 || pulse.Step != 0
+        pulse.sweepNegated = false
 
-    // FIXME:
-    //   expire length timer
-    //   envelope timer is reset
-    //   volume is reset to channel volume
-    //   a bunch of sweep stuff happens
+        // the overflow check happens immediately if there is a shift
+        if pulse.Step != 0 {
+            pulse.calculateSweep()
+        }
+    }
 }
 
 func (pulse *Pulse) SetSweep(pace uint8, direction uint8, step uint8) {
+    // switching from subtraction to addition after a calculation used subtraction
+    // disables the channel
+    if pulse.Direction == 1 && direction == 0 && pulse.sweepNegated {
+        pulse.Enabled = false
+    }
+
     pulse.Pace = pace
     pulse.Direction = direction
     pulse.Step = step
@@ -71,7 +202,7 @@ func (pulse *Pulse) SetDuty(duty uint8) {
 }
 
 func (pulse *Pulse) SetLength(length uint8) {
-    pulse.Length = length & 0b111111
+    pulse.load(uint16(length & 0b111111))
 }
 
 func (pulse *Pulse) SetPeriodHigh(value uint8) {
@@ -83,30 +214,21 @@ func (pulse *Pulse) SetPeriodLow(value uint8) {
 }
 
 func (pulse *Pulse) SetVolume(volume uint8, envelopeDirection uint8, envelopeSweep uint8) {
-    pulse.InitialVolume = volume
-    pulse.Volume = volume
-    if envelopeDirection == 0 {
-        pulse.EnvelopeDirection = -1
-    } else {
-        pulse.EnvelopeDirection = 1
+    pulse.envelope.set(volume, envelopeDirection, envelopeSweep)
+    if !pulse.dacEnabled() {
+        pulse.Enabled = false
     }
+}
 
-    pulse.EnvelopeSweep = envelopeSweep
-    pulse.envelopeSweepCounter = 0
+var dutyTable = [4][8]byte{
+    {0, 0, 0, 0, 0, 0, 0, 1},
+    {0, 0, 0, 0, 0, 0, 1, 1},
+    {0, 0, 0, 0, 1, 1, 1, 1},
+    {0, 0, 1, 1, 1, 1, 1, 1},
 }
 
 func (pulse *Pulse) generateSample() float32 {
-    var table []byte
-    switch pulse.Duty {
-        case 0:
-            table = []byte{0, 0, 0, 0, 0, 0, 0, 1}
-        case 1:
-            table = []byte{0, 0, 0, 0, 0, 0, 1, 1}
-        case 2:
-            table = []byte{0, 0, 0, 0, 1, 1, 1, 1}
-        case 3:
-            table = []byte{0, 0, 1, 1, 1, 1, 1, 1}
-    }
+    table := &dutyTable[pulse.Duty & 0b11]
 
     volume := float32(pulse.Volume) / 15.0
 
@@ -134,47 +256,60 @@ func (pulse *Pulse) GenerateRightSample() float32 {
     return 0
 }
 
-func (pulse *Pulse) doSweep(clock uint64) {
-    if pulse.hasPeriodSweep && pulse.Pace > 0 {
-        if clock % (CPUSpeed/128 * uint64(pulse.Pace)) == 0 {
-            var oldPeriod int16 = int16((pulse.PeriodHigh << 8) | pulse.PeriodLow)
-            switch pulse.Direction {
-                case 0:
-                    oldPeriod = oldPeriod + oldPeriod / (1 << pulse.Step)
-                case 1:
-                    oldPeriod = oldPeriod - oldPeriod / (1 << pulse.Step)
-            }
+// compute the next period from the shadow register and disable the channel if it overflows
+func (pulse *Pulse) calculateSweep() uint16 {
+    delta := pulse.sweepShadow >> pulse.Step
+    var period uint16
+    if pulse.Direction == 1 {
+        period = pulse.sweepShadow - delta
+        pulse.sweepNegated = true
+    } else {
+        period = pulse.sweepShadow + delta
+    }
 
-            if oldPeriod > 0x7ff || oldPeriod < 0 {
-                pulse.Enabled = false
-            } else {
-                pulse.PeriodHigh = uint16((oldPeriod >> 8) & 0x7)
-                pulse.PeriodLow = uint16(oldPeriod & 0xff)
-                pulse.Period = (pulse.PeriodHigh << 8) | pulse.PeriodLow
-            }
-        }
+    if period > 0x7ff {
+        pulse.Enabled = false
     }
+
+    return period
 }
 
-func (pulse *Pulse) doVolume(clock uint64) {
-    // tick at 64hz, which is every 65536 cycles
-    if clock % (CPUSpeed/64) == 0 && pulse.EnvelopeSweep > 0 {
-        pulse.envelopeSweepCounter += 1
-        if pulse.envelopeSweepCounter >= pulse.EnvelopeSweep {
-            pulse.envelopeSweepCounter = 0
-            if pulse.EnvelopeDirection == -1 {
-                if pulse.Volume > 0 {
-                    pulse.Volume -= 1
-                }
-            } else {
-                if pulse.Volume < 15 {
-                    pulse.Volume += 1
-                }
+// clocked by the frame sequencer at 128hz
+func (pulse *Pulse) clockSweep() {
+    if !pulse.hasPeriodSweep {
+        return
+    }
+
+    if pulse.sweepTimer > 0 {
+        pulse.sweepTimer -= 1
+    }
+
+    if pulse.sweepTimer == 0 {
+        pulse.sweepTimer = pulse.Pace
+        if pulse.sweepTimer == 0 {
+            pulse.sweepTimer = 8
+        }
+
+        if pulse.sweepEnabled && pulse.Pace > 0 {
+            period := pulse.calculateSweep()
+            if period <= 0x7ff && pulse.Step != 0 {
+                pulse.sweepShadow = period
+                pulse.PeriodHigh = (period >> 8) & 0x7
+                pulse.PeriodLow = period & 0xff
+
+                // the new value is checked for overflow again but not stored
+                pulse.calculateSweep()
             }
         }
     }
 }
 
+func (pulse *Pulse) clockLength() {
+    if !pulse.lengthCounter.clock() {
+        pulse.Enabled = false
+    }
+}
+
 func (pulse *Pulse) doDutyCycle() {
     pulse.cycles += 1
     for pulse.cycles >= 4 {
@@ -191,69 +326,45 @@ func (pulse *Pulse) doDutyCycle() {
 }
 
 // run 1 cycle
-func (pulse *Pulse) Run(clock uint64) {
-    pulse.doVolume(clock)
-    pulse.doSweep(clock)
+func (pulse *Pulse) Run() {
     pulse.doDutyCycle()
-
-    if clock % (CPUSpeed/256) == 0 {
-        pulse.DoLength()
-    }
-}
-
-func (pulse *Pulse) DoLength() {
-    if pulse.LengthEnable {
-        if pulse.Length < 64 {
-            pulse.Length += 1
-            if pulse.Length == 64 {
-                pulse.Enabled = false
-            }
-        }
-    }
 }
 
 type Wave struct {
     Enabled bool
     PanLeft bool
     PanRight bool
+    // NR30 bit 7
+    DACEnabled bool
 
     PeriodLow uint16
     PeriodHigh uint16
 
-    LengthEnable bool
-    Length uint8
-    LengthValue uint8
+    lengthCounter
 
     Volume uint8 // 0-3, 0 is silent, 1 100%, 2 50%, 3 25%
     samples []uint8
     sampleIndex uint8
 
     frequency uint16
+    // counts down to the next sample
+    frequencyTimer uint16
 }
 
-func (wave *Wave) DoLength() {
-    if wave.LengthEnable {
-        // log.Printf("noise length %v", noise.Length)
-        if wave.Length < 64 {
-            wave.Length += 1
-        }
-
-        if wave.Length >= 64 {
-            // log.Printf("noise length disable")
-            wave.Enabled = false
-        }
+func (wave *Wave) clockLength() {
+    if !wave.lengthCounter.clock() {
+        wave.Enabled = false
     }
 }
 
 func (wave *Wave) Trigger() {
-    wave.Enabled = true
-    wave.Length = 0
+    wave.Enabled = wave.DACEnabled
     wave.sampleIndex = 0
+    wave.frequencyTimer = (2048 - wave.frequency) * 2
 }
 
 func (wave *Wave) SetLength(length uint8) {
-    wave.Length = 0
-    wave.LengthValue = length
+    wave.load(uint16(length))
 }
 
 func (wave *Wave) SetPanning(left bool, right bool) {
@@ -305,21 +416,22 @@ func (wave *Wave) GenerateLeftSample() float32 {
 }
 
 func (wave *Wave) GenerateRightSample() float32 {
-    if wave.Enabled && wave.PanLeft {
+    if wave.Enabled && wave.PanRight {
         return wave.getSample()
     }
 
     return 0
 }
 
-func (wave *Wave) Run(clock uint64) {
+func (wave *Wave) Run() {
     if wave.Enabled {
-        if wave.frequency > 0 && clock % uint64((2048 - wave.frequency) * 2) == 0 {
-            wave.sampleIndex = (wave.sampleIndex + 1) % uint8(len(wave.samples))
+        if wave.frequencyTimer > 0 {
+            wave.frequencyTimer -= 1
         }
 
-        if clock % (CPUSpeed/256) == 0 {
-            wave.DoLength()
+        if wave.frequencyTimer == 0 {
+            wave.frequencyTimer = (2048 - wave.frequency) * 2
+            wave.sampleIndex = (wave.sampleIndex + 1) % uint8(len(wave.samples))
         }
     }
 }
@@ -329,15 +441,8 @@ type Noise struct {
     PanLeft bool
     PanRight bool
 
-    Volume uint8
-    InitialVolume uint8
-    envelopeSweepCounter uint8
-    EnvelopeSweep uint8
-    EnvelopeDirection int8
-
-    LengthOriginal uint8
-    Length uint8
-    LengthEnable bool
+    envelope
+    lengthCounter
 
     // 0 or 1, shifted out from lfsr
     LastBit uint8
@@ -346,6 +451,9 @@ type Noise struct {
     LFSR uint16 // 3-bit LFSR
     LFSRLength uint8 // 15 or 7, depending on LFSR type
     ClockDivider uint8 // 3-bit clock divider
+
+    // counts down to the next lfsr shift
+    frequencyTimer uint32
 }
 
 func (noise *Noise) SetPanning(left bool, right bool) {
@@ -365,17 +473,11 @@ func (noise *Noise) SetFrequency(clock_shift uint8, lfsr uint8, clock_divider ui
 }
 
 func (noise *Noise) SetVolume(volume uint8, envelopeDirection uint8, envelopeSweep uint8) {
-    noise.Volume = volume
-    noise.InitialVolume = volume
-    if envelopeDirection == 0 {
-        noise.EnvelopeDirection = -1
-    } else {
-        noise.EnvelopeDirection = 1
+    noise.envelope.set(volume, envelopeDirection, envelopeSweep)
+    if !noise.dacEnabled() {
+        noise.Enabled = false
     }
 
-    noise.EnvelopeSweep = envelopeSweep
-    noise.envelopeSweepCounter = 0
-
     // log.Printf("noise volume %v envelope direction %v sweep %v", noise.Volume, noise.EnvelopeDirection, noise.EnvelopeSweep)
 }
 
@@ -384,78 +486,45 @@ func (noise *Noise) ResetLFSR() {
 }
 
 func (noise *Noise) Trigger() {
-    noise.Enabled = true
-    /*
-    if noise.Length >= 64 {
-        noise.Length = noise.LengthOriginal
-    }
-    */
-
-    noise.Length = noise.LengthOriginal
+    noise.Enabled = noise.dacEnabled()
 
     // log.Printf("noise trigger, length=%v", noise.Length)
 
-    noise.envelopeSweepCounter = 0
-    noise.Volume = noise.InitialVolume
+    noise.envelope.trigger()
     noise.ResetLFSR()
-}
-
-func (noise *Noise) doVolume(clock uint64) {
-    // tick at 64hz, which is every 65536 cycles
-    if clock % (CPUSpeed/64) == 0 && noise.EnvelopeSweep > 0 {
-        noise.envelopeSweepCounter += 1
-        if noise.envelopeSweepCounter >= noise.EnvelopeSweep {
-            noise.envelopeSweepCounter = 0
-            if noise.EnvelopeDirection == -1 {
-                if noise.Volume > 0 {
-                    noise.Volume -= 1
-                }
-            } else {
-                if noise.Volume < 15 {
-                    noise.Volume += 1
-                }
-            }
-        }
-    }
+    noise.frequencyTimer = noise.period()
 }
 
 func (noise *Noise) ReadVolume() uint8 {
-    var out uint8 = 0
-    out |= (noise.Volume & 0b1111) << 4 // top 4 bits are volume
-    var envelope uint8 = 0
-    if noise.EnvelopeDirection == -1 {
-        envelope = 0
-    } else {
-        envelope = 1
-    }
-    out |= (envelope & 0b1) << 3 // envelope direction bit
-    out |= noise.EnvelopeSweep & 0b111 // bottom 3 bits are envelope sweep
-
-    return out
+    return noise.envelope.read()
 }
 
-func (noise *Noise) Run(clock uint64) {
+func (noise *Noise) Run() {
     if noise.Enabled {
-        noise.doVolume(clock)
-
-        noise.doLFSR(clock)
+        noise.doLFSR()
         // log.Printf("lfsr: 0x%x", noise.LFSR)
-
-        if clock % (CPUSpeed/256) == 0 {
-            noise.DoLength()
-        }
     }
 }
 
-func (noise *Noise) doLFSR(clock uint64) {
-    rate := uint64(262144 / (1 << noise.ClockShift))
+// number of cycles between lfsr shifts
+func (noise *Noise) period() uint32 {
+    // divider 0 is treated as 0.5
+    var divisor uint32 = 8
     if noise.ClockDivider > 0 {
-        rate /= uint64(noise.ClockDivider)
-    } else {
-        rate *= 2
+        divisor = uint32(noise.ClockDivider) * 16
+    }
+
+    return divisor << noise.ClockShift
+}
+
+func (noise *Noise) doLFSR() {
+    if noise.frequencyTimer > 0 {
+        noise.frequencyTimer -= 1
     }
 
-    if clock % (CPUSpeed/rate) == 0 {
+    if noise.frequencyTimer == 0 {
+        noise.frequencyTimer = noise.period()
+
         noise.LastBit = uint8(noise.LFSR & 1)
         noise.LFSR >>= 1
         newBit := (noise.LFSR & 1) ^ ((noise.LFSR & 0b10) >> 1)
@@ -466,17 +535,9 @@ func (noise *Noise) doLFSR(clock uint64) {
     }
 }
 
-func (noise *Noise) DoLength() {
-    if noise.LengthEnable {
-        // log.Printf("noise length %v", noise.Length)
-        if noise.Length < 64 {
-            noise.Length += 1
-        }
-
-        if noise.Length >= 64 {
-            // log.Printf("noise length disable")
-            noise.Enabled = false
-        }
+func (noise *Noise) clockLength() {
+    if !noise.lengthCounter.clock() {
+        noise.Enabled = false
     }
 }
 
@@ -521,12 +582,56 @@ type APU struct {
     // 0-7, 0 is not entirely silent, just very quit. 7 is loudest
     LeftVolume uint8
     RightVolume uint8
+    // the VIN bits of NR50, not used for output but read back
+    vin uint8
 
     SampleCounter float32
     SampleRate uint32
 
-    DivCounter uint16
-    DivTicks uint16
+    // scales the number of cycles between output samples, adjusted to keep the
+    // audio stream from running dry or filling up
+    rateAdjust float32
+
+    leftBlip blipBuffer
+    rightBlip blipBuffer
+    leftFilter highPassFilter
+    rightFilter highPassFilter
+
+    muted [4]bool
+    solo [4]bool
+    // computed from muted and solo
+    audible [4]bool
+
+    // master clocks until the next sample at the nominal rate. the audio stream is
+    // rate controlled but files have to be written at the rate they are labelled with
+    nominalCounter float32
+
+    // the mixed output at the nominal rate for the audio writer
+    nominalLeftBlip blipBuffer
+    nominalRightBlip blipBuffer
+    nominalLeftFilter highPassFilter
+    nominalRightFilter highPassFilter
+
+    // per channel output at the nominal rate, only synthesized while the scope or a
+    // channel writer is active
+    channelLeftBlip [4]blipBuffer
+    channelRightBlip [4]blipBuffer
+    channelWriters [4]*WavWriter
+    // gets a copy of the mixed output
+    audioWriter *WavWriter
+
+    // the last value written to each sound register
+    registers [0x30]uint8
+    recorder *VGMRecorder
+
+    Logger *Logger
+
+    scopeEnabled bool
+    scope [4][scopeSize]float32
+    scopeIndex int
+
+    // the next step of the frame sequencer, 0-7
+    frameStep uint8
 
     AudioStream *AudioStream
 }
@@ -534,20 +639,31 @@ type APU struct {
 func MakeAPU(sampleRate uint32) *APU {
     return &APU{
         SampleCounter: float32(CPUSpeed) / float32(sampleRate),
+        nominalCounter: float32(CPUSpeed) / float32(sampleRate),
         SampleRate: sampleRate,
+        rateAdjust: 1,
+        audible: [4]bool{true, true, true, true},
+        leftFilter: makeHighPassFilter(sampleRate),
+        rightFilter: makeHighPassFilter(sampleRate),
+        nominalLeftFilter: makeHighPassFilter(sampleRate),
+        nominalRightFilter: makeHighPassFilter(sampleRate),
         Pulse1: Pulse{
             hasPeriodSweep: true,
+            lengthCounter: lengthCounter{maxLength: 64},
         },
         Pulse2: Pulse{
             hasPeriodSweep: false,
+            lengthCounter: lengthCounter{maxLength: 64},
         },
         LeftVolume: 0x7,
         RightVolume: 0x7,
         Noise: Noise{
             LFSRLength: 15,
+            lengthCounter: lengthCounter{maxLength: 64},
         },
         Wave: Wave{
             samples: make([]uint8, 32),
+            lengthCounter: lengthCounter{maxLength: 256},
         },
         AudioStream: &AudioStream{
             Samples: make([]float32, sampleRate * 2), // 1 second of audio, 2 channels
@@ -555,6 +671,9 @@ func MakeAPU(sampleRate uint32) *APU {
     }
 }
 
+// number of recent samples kept per channel for the oscilloscope
+const scopeSize = 2048
+
 type AudioStream struct {
     // APU *APU
     Samples []float32
@@ -562,9 +681,25 @@ type AudioStream struct {
     start int
     end int
 
+    // number of reads that wanted more samples than were available
+    underruns uint64
+    // number of samples dropped because the stream was full
+    overruns uint64
+
+    // the last samples read, repeated when the stream runs dry
+    lastLeft float32
+    lastRight float32
+
     lock sync.Mutex
 }
 
+type AudioStats struct {
+    // stereo samples waiting to be played
+    Buffered int
+    Underruns uint64
+    Overruns uint64
+}
+
 func (stream *AudioStream) AddSample(left float32, right float32) {
     stream.lock.Lock()
 
@@ -576,44 +711,181 @@ func (stream *AudioStream) AddSample(left float32, right float32) {
         stream.count += 2
     } else {
         // log.Printf("dropping a sample")
+        stream.overruns += 1
     }
 
     stream.lock.Unlock()
 }
 
+// number of stereo samples waiting to be played
+func (stream *AudioStream) Buffered() int {
+    stream.lock.Lock()
+    defer stream.lock.Unlock()
+    return stream.count / 2
+}
+
+func (stream *AudioStream) Stats() AudioStats {
+    stream.lock.Lock()
+    defer stream.lock.Unlock()
+
+    return AudioStats{
+        Buffered: stream.count / 2,
+        Underruns: stream.underruns,
+        Overruns: stream.overruns,
+    }
+}
+
+func writeFloat(data []byte, value float32) {
+    v := math.Float32bits(value)
+    data[0] = byte(v)
+    data[1] = byte(v >> 8)
+    data[2] = byte(v >> 16)
+    data[3] = byte(v >> 24)
+}
+
+// take up to len(samples) interleaved left/right samples out of the stream, returns the
+// number of samples copied
+func (stream *AudioStream) ReadSamples(samples []float32) int {
+    stream.lock.Lock()
+    defer stream.lock.Unlock()
+
+    count := min(stream.count, len(samples) / 2 * 2)
+    for i := range count {
+        samples[i] = stream.Samples[stream.start]
+        stream.start = (stream.start + 1) % len(stream.Samples)
+    }
+
+    stream.count -= count
+    return count
+}
+
 func (stream *AudioStream) Read(data []byte) (int, error) {
     stream.lock.Lock()
     defer stream.lock.Unlock()
 
-    samples := min(stream.count, len(data) / 4)
+    // only hand out whole stereo samples
+    samples := min(stream.count, len(data) / 8 * 2)
     // log.Printf("audio stream read %v samples out of %v", samples, len(data) / 4)
     for i := range samples {
-        v := math.Float32bits(stream.Samples[stream.start])
-        data[i*4+0] = byte(v)
-        data[i*4+1] = byte(v >> 8)
-        data[i*4+2] = byte(v >> 16)
-        data[i*4+3] = byte(v >> 24)
+        writeFloat(data[i*4:], stream.Samples[stream.start])
+        if i % 2 == 0 {
+            stream.lastLeft = stream.Samples[stream.start]
+        } else {
+            stream.lastRight = stream.Samples[stream.start]
+        }
 
         stream.start = (stream.start + 1) % len(stream.Samples)
     }
 
     stream.count -= samples
 
+    if samples < len(data) / 4 {
+        // not enough samples, hold the last value rather than dropping to 0 which pops
+        stream.underruns += 1
+        for i := samples; i < len(data) / 4; i++ {
+            if i % 2 == 0 {
+                writeFloat(data[i*4:], stream.lastLeft)
+            } else {
+                writeFloat(data[i*4:], stream.lastRight)
+            }
+        }
+    }
+
     return len(data), nil
 }
 
+// the most the output rate is changed by to keep the stream at its target, 0.5% is not audible
+const maxRateAdjust = 0.005
+
+// dynamic rate control: slightly speed up or slow down the output sample rate so the
+// audio stream stays close to holding 'target' stereo samples
+func (apu *APU) UpdateRateControl(target int) {
+    if target <= 0 {
+        return
+    }
+
+    difference := float32(apu.AudioStream.Buffered() - target) / float32(target)
+    difference = max(-1, min(1, difference))
+
+    // a longer sample period produces fewer samples
+    apu.rateAdjust = 1 + maxRateAdjust * difference
+}
+
+func (apu *APU) GetRateAdjust() float32 {
+    return apu.rateAdjust
+}
+
 func (apu *APU) GetAudioStream() *AudioStream {
     return apu.AudioStream
 }
 
+// registers are read back with the write-only bits set to 1
+
 func (apu *APU) ReadNoiseVolume() uint8 {
     return apu.Noise.ReadVolume()
 }
 
+func (apu *APU) ReadNoiseLength() uint8 {
+    return 0xff
+}
+
+func (apu *APU) ReadNoiseFrequency() uint8 {
+    var out uint8 = 0
+    out |= (apu.Noise.ClockShift & 0b1111) << 4
+    if apu.Noise.LFSRLength == 7 {
+        out |= 0b1000
+    }
+    out |= apu.Noise.ClockDivider & 0b111
+    return out
+}
+
+func (apu *APU) ReadNoiseControl() uint8 {
+    var out uint8 = 0b1011_1111
+    if apu.Noise.LengthEnable {
+        out |= 0b0100_0000
+    }
+    return out
+}
+
+func (apu *APU) ReadWaveDAC() uint8 {
+    var out uint8 = 0b0111_1111
+    if apu.Wave.DACEnabled {
+        out |= 0b1000_0000
+    }
+    return out
+}
+
+func (apu *APU) ReadWaveLength() uint8 {
+    return 0xff
+}
+
+func (apu *APU) ReadWaveVolume() uint8 {
+    return 0b1001_1111 | (apu.Wave.Volume & 0b11) << 5
+}
+
+func (apu *APU) ReadWavePeriodLow() uint8 {
+    return 0xff
+}
+
+func (apu *APU) ReadWavePeriodHigh() uint8 {
+    var out uint8 = 0b1011_1111
+    if apu.Wave.LengthEnable {
+        out |= 0b0100_0000
+    }
+    return out
+}
+
+func (apu *APU) ReadWavePattern(index int) uint8 {
+    // while the channel is playing, reads see the byte currently being played
+    if apu.Wave.Enabled {
+        index = int(apu.Wave.sampleIndex / 2)
+    }
+
+    return (apu.Wave.samples[index*2] << 4) | apu.Wave.samples[index*2+1]
+}
+
 func (apu *APU) SetNoiseLength(value uint8) {
-    length := value & 0b111_111
-    apu.Noise.Length = length
-    apu.Noise.LengthOriginal = length
+    apu.Noise.load(uint16(value & 0b111_111))
 }
 
 func (apu *APU) SetNoiseVolume(value uint8) {
@@ -627,15 +899,12 @@ func (apu *APU) SetNoiseControl(value uint8) {
     trigger := value & 0b1000_0000 != 0
     lengthEnable := value & 0b100_0000 != 0
 
-    if trigger {
-        apu.Noise.Trigger()
+    if !apu.Noise.control(lengthEnable, trigger, apu.lengthStepNext()) {
+        apu.Noise.Enabled = false
     }
 
-    if lengthEnable {
-        apu.Noise.LengthEnable = true
-        apu.Noise.Length = 0
-    } else {
-        apu.Noise.LengthEnable = false
+    if trigger {
+        apu.Noise.Trigger()
     }
 }
 
@@ -661,7 +930,10 @@ func (apu *APU) SetWavePeriodHigh(value uint8) {
     trigger := value & 0b1_0000_000 != 0
 
     apu.Wave.SetPeriodHigh(period)
-    apu.Wave.LengthEnable = lengthEnable
+
+    if !apu.Wave.control(lengthEnable, trigger, apu.lengthStepNext()) {
+        apu.Wave.Enabled = false
+    }
 
     // log.Printf("wave length enable %v", apu.Wave.LengthEnable)
 
@@ -684,11 +956,192 @@ func (apu *APU) SetWavePattern(value uint8, index int) {
 
 func (apu *APU) SetWaveDAC(value uint8) {
     enabled := value & 0b1_0000_000 != 0
-    apu.Wave.Enabled = enabled
+    apu.Wave.DACEnabled = enabled
+    // turning the dac off disables the channel, turning it on does not enable it
+    if !enabled {
+        apu.Wave.Enabled = false
+    }
+}
+
+// start logging register writes to a recorder, or stop if recorder is nil. the
+// current register state is written to the recorder first
+func (apu *APU) SetRecorder(recorder *VGMRecorder) {
+    if apu.recorder != nil {
+        apu.recorder.sync(apu.counter)
+    }
+
+    apu.recorder = recorder
+
+    if recorder != nil {
+        recorder.begin(apu.counter, apu.registers)
+    }
+}
+
+// handle a cpu write to the sound registers, 0xff10-0xff3f
+func (apu *APU) WriteRegister(address uint16, value uint8) {
+    if apu.recorder != nil {
+        apu.recorder.Write(apu.counter, address, value)
+    }
+    apu.setRegister(address, value)
+}
+
+func (apu *APU) setRegister(address uint16, value uint8) {
+    // while the apu is off only NR52 and wave ram can be written, and on the dmg the
+    // length timers
+    if !apu.MasterEnabled && address != IOSoundOnOff && (address < IOWaveFormStart || address > IOWaveFormEnd) {
+        apu.setLengthPoweredOff(address, value)
+        return
+    }
+
+    apu.registers[address - IOSoundChannel1Sweep] = value
+
+    switch {
+        case address >= IOWaveFormStart && address <= IOWaveFormEnd:
+            index := int(address - IOWaveFormStart)
+            apu.SetWavePattern(value, index)
+        case address == IOSoundChannel1Sweep:
+            apu.SetPulse1Sweep(value)
+        case address == IOSoundChannel1Volume:
+            apu.SetPulse1Volume(value)
+        case address == IOSoundChannel1PeriodHigh:
+            apu.SetPulse1PeriodHigh(value)
+        case address == IOSoundChannel1PeriodLow:
+            apu.SetPulse1PeriodLow(value)
+        case address == IOSoundChannel1Duty:
+            apu.SetPulse1Duty(value)
+        case address == IOSoundChannel2Duty:
+            apu.SetPulse2Duty(value)
+        case address == IOSoundChannel2Volume:
+            apu.SetPulse2Volume(value)
+        case address == IOSoundChannel2PeriodLow:
+            apu.SetPulse2PeriodLow(value)
+        case address == IOSoundChannel2PeriodHigh:
+            apu.SetPulse2PeriodHigh(value)
+        case address == IOSoundChannel3Length:
+            apu.SetWaveLength(value)
+        case address == IOSoundChannel3DAC:
+            apu.SetWaveDAC(value)
+        case address == IOSoundChannel3Volume:
+            apu.SetWaveVolume(value)
+        case address == IOSoundChannel3PeriodLow:
+            apu.SetWavePeriodLow(value)
+        case address == IOSoundChannel3PeriodHigh:
+            apu.SetWavePeriodHigh(value)
+        case address == IOSoundChannel4Volume:
+            apu.SetNoiseVolume(value)
+        case address == IOSoundChannel4Control:
+            apu.SetNoiseControl(value)
+        case address == IOSoundChannel4Length:
+            apu.SetNoiseLength(value)
+        case address == IOSoundChannel4Frequency:
+            apu.SetNoiseFrequency(value)
+        case address == IOMasterVolume:
+            apu.SetMasterVolume(value)
+        case address == IOSoundPanning:
+            apu.SetPanning(value)
+        case address == IOSoundOnOff:
+            apu.SetMasterEnabled(value & 0b1000_0000 > 0)
+    }
+}
+
+// for debuggers: read a sound register like the cpu would, except that wave ram is
+// read directly instead of seeing the byte being played
+func (apu *APU) Peek(address uint16) uint8 {
+    if address >= IOWaveFormStart && address <= IOWaveFormEnd {
+        index := int(address - IOWaveFormStart)
+        return (apu.Wave.samples[index*2] << 4) | apu.Wave.samples[index*2+1]
+    }
+
+    return apu.ReadRegister(address)
+}
+
+// for debuggers: write a sound register without recording it or triggering a channel.
+// writes to NRx4 only change the period and the length enable flag
+func (apu *APU) Poke(address uint16, value uint8) {
+    if address < IOSoundChannel1Sweep || address > IOWaveFormEnd {
+        return
+    }
+
+    lengthEnable := value & 0b100_0000 != 0
+
+    switch address {
+        case IOSoundChannel1PeriodHigh:
+            apu.registers[address - IOSoundChannel1Sweep] = value
+            apu.Pulse1.SetPeriodHigh(value & 0b111)
+            apu.Pulse1.LengthEnable = lengthEnable
+        case IOSoundChannel2PeriodHigh:
+            apu.registers[address - IOSoundChannel1Sweep] = value
+            apu.Pulse2.SetPeriodHigh(value & 0b111)
+            apu.Pulse2.LengthEnable = lengthEnable
+        case IOSoundChannel3PeriodHigh:
+            apu.registers[address - IOSoundChannel1Sweep] = value
+            apu.Wave.SetPeriodHigh(value & 0b111)
+            apu.Wave.LengthEnable = lengthEnable
+        case IOSoundChannel4Control:
+            apu.registers[address - IOSoundChannel1Sweep] = value
+            apu.Noise.LengthEnable = lengthEnable
+        default:
+            apu.setRegister(address, value)
+    }
+}
+
+// handle a cpu read of the sound registers, 0xff10-0xff3f
+func (apu *APU) ReadRegister(address uint16) uint8 {
+    switch {
+        case address == IOSoundChannel1Sweep:
+            return apu.ReadPulse1Sweep()
+        case address == IOSoundChannel1Duty:
+            return apu.ReadPulse1Duty()
+        case address == IOSoundChannel1Volume:
+            return apu.ReadPulse1Volume()
+        case address == IOSoundChannel1PeriodLow:
+            return apu.ReadPulse1PeriodLow()
+        case address == IOSoundChannel1PeriodHigh:
+            return apu.ReadPulse1PeriodHigh()
+        case address == IOSoundChannel2Duty:
+            return apu.ReadPulse2Duty()
+        case address == IOSoundChannel2Volume:
+            return apu.ReadPulse2Volume()
+        case address == IOSoundChannel2PeriodLow:
+            return apu.ReadPulse2PeriodLow()
+        case address == IOSoundChannel2PeriodHigh:
+            return apu.ReadPulse2PeriodHigh()
+        case address == IOMasterVolume:
+            return apu.GetMasterVolume()
+        case address == IOSoundChannel3DAC:
+            return apu.ReadWaveDAC()
+        case address == IOSoundChannel3Length:
+            return apu.ReadWaveLength()
+        case address == IOSoundChannel3Volume:
+            return apu.ReadWaveVolume()
+        case address == IOSoundChannel3PeriodLow:
+            return apu.ReadWavePeriodLow()
+        case address == IOSoundChannel3PeriodHigh:
+            return apu.ReadWavePeriodHigh()
+        case address >= IOWaveFormStart && address <= IOWaveFormEnd:
+            return apu.ReadWavePattern(int(address - IOWaveFormStart))
+        case address == IOSoundPanning:
+            return apu.ReadSoundPanning()
+        case address == IOSoundOnOff:
+            return apu.ReadMasterControl()
+        case address == IOSoundChannel4Length:
+            return apu.ReadNoiseLength()
+        case address == IOSoundChannel4Volume:
+            return apu.ReadNoiseVolume()
+        case address == IOSoundChannel4Frequency:
+            return apu.ReadNoiseFrequency()
+        case address == IOSoundChannel4Control:
+            return apu.ReadNoiseControl()
+        case address == 0xff15 || address == 0xff1f || (address >= 0xff27 && address <= 0xff2f):
+            // unused sound registers
+            return 0xff
+    }
+
+    return 0xff
 }
 
 func (apu *APU) GetMasterVolume() uint8 {
-    var out uint8 = 0
+    var out uint8 = apu.vin
     out |= (apu.LeftVolume & 0b111) << 4 // left volume in bits 7-4
     out |= (apu.RightVolume & 0b111) // right volume in bits 3-0
 
@@ -696,11 +1149,13 @@ func (apu *APU) GetMasterVolume() uint8 {
 }
 
 func (apu *APU) SetMasterVolume(volume uint8) {
-    // FIXME: use VIN left (bit 7) and VIN right (bit 3) to set volume
+    // the vin bits (7 and 3) mix in audio from the cartridge, which no cartridge here
+    // provides, so they are only kept so that NR50 reads back what was written
 
     left := (volume & 0b111_0000) >> 4
     right := (volume & 0b111)
 
+    apu.vin = volume & 0b1000_1000
     apu.LeftVolume = left
     apu.RightVolume = right
 }
@@ -716,17 +1171,62 @@ func (apu *APU) SetPulse1Volume(value uint8) {
 func (apu *APU) ReadPulse1Sweep() uint8 {
     var out uint8 = 0
 
+    out |= 0b1000_0000 // bit 7 is unused
     out |= (apu.Pulse1.Pace & 0b111) << 4 // top 3 bits are pace
-    if apu.Pulse1.Direction == 0 {
-        out |= 0b1000 // direction bit 3 is 1 for increase
-    } else {
-        out |= 0b0000 // direction bit 3 is 0 for decrease
+    if apu.Pulse1.Direction == 1 {
+        out |= 0b1000 // direction bit 3 is 1 for decrease
     }
     out |= (apu.Pulse1.Step & 0b111) // bottom 3 bits are step
 
     return out
 }
 
+// NRx1, only the duty can be read
+func (pulse *Pulse) readDuty() uint8 {
+    return 0b0011_1111 | (pulse.Duty & 0b11) << 6
+}
+
+// NRx4, only the length enable can be read
+func (pulse *Pulse) readControl() uint8 {
+    var out uint8 = 0b1011_1111
+    if pulse.LengthEnable {
+        out |= 0b0100_0000
+    }
+    return out
+}
+
+func (apu *APU) ReadPulse1Duty() uint8 {
+    return apu.Pulse1.readDuty()
+}
+
+func (apu *APU) ReadPulse1Volume() uint8 {
+    return apu.Pulse1.envelope.read()
+}
+
+func (apu *APU) ReadPulse1PeriodLow() uint8 {
+    return 0xff
+}
+
+func (apu *APU) ReadPulse1PeriodHigh() uint8 {
+    return apu.Pulse1.readControl()
+}
+
+func (apu *APU) ReadPulse2Duty() uint8 {
+    return apu.Pulse2.readDuty()
+}
+
+func (apu *APU) ReadPulse2Volume() uint8 {
+    return apu.Pulse2.envelope.read()
+}
+
+func (apu *APU) ReadPulse2PeriodLow() uint8 {
+    return 0xff
+}
+
+func (apu *APU) ReadPulse2PeriodHigh() uint8 {
+    return apu.Pulse2.readControl()
+}
+
 func (apu *APU) SetPulse1Sweep(value uint8) {
     pace := (value & 0b111_0000) >> 4
     direction := (value & 0b1_000) >> 3
@@ -748,11 +1248,13 @@ func (apu *APU) SetPulse1PeriodHigh(value uint8) {
     trigger := value & 0b1_0000000 != 0
     lengthEnable := value & 0b1_000000 != 0
 
+    if !apu.Pulse1.control(lengthEnable, trigger, apu.lengthStepNext()) {
+        apu.Pulse1.Enabled = false
+    }
+
     if trigger {
         apu.Pulse1.Trigger()
     }
-
-    apu.Pulse1.LengthEnable = lengthEnable
     // log.Printf("length enable pulse 1: %v", apu.Pulse1.LengthEnable)
 }
 
@@ -782,11 +1284,13 @@ func (apu *APU) SetPulse2PeriodHigh(value uint8) {
     trigger := value & 0b1_0000000 != 0
     lengthEnable := value & 0b1_000000 != 0
 
+    if !apu.Pulse2.control(lengthEnable, trigger, apu.lengthStepNext()) {
+        apu.Pulse2.Enabled = false
+    }
+
     if trigger {
         apu.Pulse2.Trigger()
     }
-
-    apu.Pulse2.LengthEnable = lengthEnable
     // log.Printf("length enable pulse 1: %v", apu.Pulse1.LengthEnable)
 }
 
@@ -795,9 +1299,85 @@ func (apu *APU) SetPulse2PeriodLow(value uint8) {
 }
 
 func (apu *APU) SetMasterEnabled(enabled bool) {
+    if enabled && !apu.MasterEnabled {
+        // the frame sequencer starts over from step 0 when the apu is powered on
+        apu.frameStep = 0
+    }
+
+    if !enabled && apu.MasterEnabled {
+        apu.powerOff()
+    }
+
     apu.MasterEnabled = enabled
 }
 
+// turning the apu off clears NR10-NR51 and stops every channel. wave ram and, on the
+// dmg, the length timers are kept
+func (apu *APU) powerOff() {
+    for address := uint16(IOSoundChannel1Sweep); address < IOSoundOnOff; address++ {
+        switch address {
+            case IOSoundChannel1Duty:
+                apu.registers[address - IOSoundChannel1Sweep] = 0
+                apu.Pulse1.SetDuty(0)
+            case IOSoundChannel2Duty:
+                apu.registers[address - IOSoundChannel1Sweep] = 0
+                apu.Pulse2.SetDuty(0)
+            case IOSoundChannel3Length, IOSoundChannel4Length:
+                apu.registers[address - IOSoundChannel1Sweep] = 0
+            default:
+                apu.setRegister(address, 0)
+        }
+    }
+
+    apu.Pulse1.Enabled = false
+    apu.Pulse2.Enabled = false
+    apu.Wave.Enabled = false
+    apu.Noise.Enabled = false
+}
+
+// the dmg lets the length timers be loaded while the apu is off, other writes are dropped
+func (apu *APU) setLengthPoweredOff(address uint16, value uint8) {
+    switch address {
+        case IOSoundChannel1Duty: apu.Pulse1.SetLength(value & 0b111_111)
+        case IOSoundChannel2Duty: apu.Pulse2.SetLength(value & 0b111_111)
+        case IOSoundChannel3Length: apu.SetWaveLength(value)
+        case IOSoundChannel4Length: apu.SetNoiseLength(value)
+    }
+}
+
+// true if the next frame sequencer step clocks the length timers
+func (apu *APU) lengthStepNext() bool {
+    return apu.frameStep % 2 == 0
+}
+
+// the frame sequencer is clocked at 512hz by a falling edge of DIV bit 4 (bit 5 in double speed).
+// length timers are clocked on even steps, the sweep on steps 2 and 6, and envelopes on step 7
+func (apu *APU) ClockFrameSequencer() {
+    if !apu.MasterEnabled {
+        return
+    }
+
+    step := apu.frameStep
+    apu.frameStep = (apu.frameStep + 1) % 8
+
+    if step % 2 == 0 {
+        apu.Pulse1.clockLength()
+        apu.Pulse2.clockLength()
+        apu.Wave.clockLength()
+        apu.Noise.clockLength()
+    }
+
+    if step == 2 || step == 6 {
+        apu.Pulse1.clockSweep()
+    }
+
+    if step == 7 {
+        apu.Pulse1.envelope.clock()
+        apu.Pulse2.envelope.clock()
+        apu.Noise.envelope.clock()
+    }
+}
+
 func (apu *APU) SetPanning(value uint8) {
     ch4_left  := value & 0b1000_0000 != 0
     ch3_left  := value & 0b0100_0000 != 0
@@ -849,7 +1429,8 @@ func (apu *APU) ReadSoundPanning() uint8 {
 }
 
 func (apu *APU) ReadMasterControl() uint8 {
-    var out uint8
+    // bits 4-6 are unused. bits 0-3 report whether each channel is active
+    var out uint8 = 0b0111_0000
     if apu.MasterEnabled {
         out |= 0x80
     }
@@ -873,48 +1454,216 @@ func (apu *APU) ReadMasterControl() uint8 {
     return out
 }
 
-func (apu *APU) GenerateLeftSample() float32 {
-    // return rand.Float32() * 2 - 1 // Generate a random float between -1 and 1
+type Channel int
+
+const (
+    ChannelPulse1 Channel = iota
+    ChannelPulse2
+    ChannelWave
+    ChannelNoise
+)
+
+var AllChannels = []Channel{ChannelPulse1, ChannelPulse2, ChannelWave, ChannelNoise}
+
+func (channel Channel) String() string {
+    switch channel {
+        case ChannelPulse1: return "pulse1"
+        case ChannelPulse2: return "pulse2"
+        case ChannelWave: return "wave"
+        case ChannelNoise: return "noise"
+    }
+
+    return "unknown"
+}
+
+func (apu *APU) SetMuted(channel Channel, muted bool) {
+    apu.muted[channel] = muted
+    apu.updateAudible()
+}
+
+func (apu *APU) IsMuted(channel Channel) bool {
+    return apu.muted[channel]
+}
 
-    sample := apu.Pulse1.GenerateLeftSample() + apu.Pulse2.GenerateLeftSample() + apu.Noise.GenerateLeftSample() + apu.Wave.GenerateLeftSample()
-    // sample := apu.Pulse1.GenerateLeftSample()
-    // log.Printf("wave left sample: %v", sample)
-    // sample := apu.Noise.GenerateLeftSample()
-    scaled := float32(apu.LeftVolume+1) / 8
-    return sample * scaled
+// if any channel is soloed then only soloed channels are heard
+func (apu *APU) SetSolo(channel Channel, solo bool) {
+    apu.solo[channel] = solo
+    apu.updateAudible()
+}
+
+func (apu *APU) IsSolo(channel Channel) bool {
+    return apu.solo[channel]
+}
+
+func (apu *APU) updateAudible() {
+    anySolo := false
+    for _, solo := range apu.solo {
+        anySolo = anySolo || solo
+    }
+
+    for _, channel := range AllChannels {
+        if anySolo {
+            apu.audible[channel] = apu.solo[channel]
+        } else {
+            apu.audible[channel] = !apu.muted[channel]
+        }
+    }
+}
+
+func (apu *APU) IsAudible(channel Channel) bool {
+    return apu.audible[channel]
+}
+
+// the output of one channel, before muting and the master volume
+func (apu *APU) GenerateChannelSample(channel Channel) (float32, float32) {
+    switch channel {
+        case ChannelPulse1: return apu.Pulse1.GenerateLeftSample(), apu.Pulse1.GenerateRightSample()
+        case ChannelPulse2: return apu.Pulse2.GenerateLeftSample(), apu.Pulse2.GenerateRightSample()
+        case ChannelWave: return apu.Wave.GenerateLeftSample(), apu.Wave.GenerateRightSample()
+        case ChannelNoise: return apu.Noise.GenerateLeftSample(), apu.Noise.GenerateRightSample()
+    }
+
+    return 0, 0
+}
+
+// mix all audible channels
+func (apu *APU) GenerateSample() (float32, float32) {
+    var left, right float32
+    for _, channel := range AllChannels {
+        if apu.audible[channel] {
+            channelLeft, channelRight := apu.GenerateChannelSample(channel)
+            left += channelLeft
+            right += channelRight
+        }
+    }
+
+    return left * float32(apu.LeftVolume+1) / 8, right * float32(apu.RightVolume+1) / 8
+}
+
+func (apu *APU) GenerateLeftSample() float32 {
+    left, _ := apu.GenerateSample()
+    return left
 }
 
 func (apu *APU) GenerateRightSample() float32 {
-    sample := apu.Pulse1.GenerateRightSample() + apu.Pulse2.GenerateRightSample() + apu.Noise.GenerateRightSample() + apu.Wave.GenerateRightSample()
-    // sample := apu.Pulse1.GenerateRightSample()
-    // sample := apu.Wave.GenerateRightSample()
-    scaled := float32(apu.RightVolume+1) / 8
-    return sample * scaled
+    _, right := apu.GenerateSample()
+    return right
+}
+
+// keep the recent output of each channel so it can be drawn
+func (apu *APU) SetScopeEnabled(enabled bool) {
+    apu.scopeEnabled = enabled
+}
+
+func (apu *APU) IsScopeEnabled() bool {
+    return apu.scopeEnabled
+}
+
+// fill 'out' with the most recent samples of a channel, oldest first. the left and
+// right outputs are averaged
+func (apu *APU) ChannelHistory(channel Channel, out []float32) {
+    history := apu.scope[channel][:]
+    for i := range out {
+        index := apu.scopeIndex - len(out) + i
+        for index < 0 {
+            index += len(history)
+        }
+        out[i] = history[index % len(history)]
+    }
+}
+
+// write the output of a single channel to a wav file, or stop writing it if wav is nil.
+// the caller closes the writer when done
+func (apu *APU) SetChannelWriter(channel Channel, wav *WavWriter) {
+    apu.channelWriters[channel] = wav
+}
+
+// write the mixed output to a wav file at the nominal sample rate, or stop if wav is nil.
+// the caller closes the writer when done
+func (apu *APU) SetAudioWriter(wav *WavWriter) {
+    apu.audioWriter = wav
+}
+
+// true if any per-channel output is being collected
+func (apu *APU) tapChannels() bool {
+    if apu.scopeEnabled {
+        return true
+    }
+
+    for _, writer := range apu.channelWriters {
+        if writer != nil {
+            return true
+        }
+    }
+
+    return false
+}
+
+// emit a sample for each channel to the scope and the channel writers
+func (apu *APU) emitChannelSamples() {
+    for _, channel := range AllChannels {
+        left := apu.channelLeftBlip[channel].next()
+        right := apu.channelRightBlip[channel].next()
+
+        if apu.scopeEnabled {
+            apu.scope[channel][apu.scopeIndex] = (left + right) / 2
+        }
+
+        writer := apu.channelWriters[channel]
+        if writer != nil {
+            err := writer.AddSample(left, right)
+            if err != nil {
+                apu.Logger.Error(LogAPU, "unable to write channel audio", "channel", channel, "error", err)
+                apu.channelWriters[channel] = nil
+            }
+        }
+    }
+
+    if apu.scopeEnabled {
+        apu.scopeIndex = (apu.scopeIndex + 1) % scopeSize
+    }
 }
 
 func (apu *APU) Run(cycles uint64) {
     if !apu.MasterEnabled {
+        // keep time so register writes can be timestamped
+        apu.counter += cycles
         return
     }
 
+    nominalPeriod := float32(CPUSpeed) / float32(apu.SampleRate)
+    samplePeriod := nominalPeriod * apu.rateAdjust
+    tap := apu.tapChannels()
+
     for cycles > 0 {
         cycles -= 1
         apu.counter += 1
-        apu.Pulse1.Run(apu.counter)
-        apu.Pulse2.Run(apu.counter)
-        apu.Noise.Run(apu.counter)
-        apu.Wave.Run(apu.counter)
-
-        apu.DivCounter += 1
-        if apu.DivCounter >= (CPUSpeed/512) {
-            apu.DivCounter -= CPUSpeed/512
-            apu.DivTicks += 1
-
-            if apu.DivTicks % 2 == 0 {
+        apu.Pulse1.Run()
+        apu.Pulse2.Run()
+        apu.Noise.Run()
+        apu.Wave.Run()
+
+        // feed every change in the output to the band-limited synthesizer at its
+        // position within the current output sample
+        // the channels only change their output on even cycles
+        if apu.counter % 2 == 0 {
+            offset := 1 - apu.SampleCounter / samplePeriod
+            left, right := apu.GenerateSample()
+            apu.leftBlip.update(offset, left)
+            apu.rightBlip.update(offset, right)
+
+            nominalOffset := 1 - apu.nominalCounter / nominalPeriod
+            if apu.audioWriter != nil {
+                apu.nominalLeftBlip.update(nominalOffset, left)
+                apu.nominalRightBlip.update(nominalOffset, right)
             }
 
-            if apu.DivTicks % 4 == 0 {
-                // FIXME: channel1 frequency sweep
+            if tap {
+                for _, channel := range AllChannels {
+                    channelLeft, channelRight := apu.GenerateChannelSample(channel)
+                    apu.channelLeftBlip[channel].update(nominalOffset, channelLeft)
+                    apu.channelRightBlip[channel].update(nominalOffset, channelRight)
+                }
             }
         }
 
@@ -924,9 +1673,30 @@ func (apu *APU) Run(cycles uint64) {
             // emit sample
             // log.Printf("Emitting sample at %d Hz", apu.SampleRate)
 
-            apu.SampleCounter += float32(CPUSpeed) / float32(apu.SampleRate)
+            apu.SampleCounter += samplePeriod
 
-            apu.AudioStream.AddSample(apu.GenerateLeftSample(), apu.GenerateRightSample())
+            left := apu.leftFilter.apply(apu.leftBlip.next())
+            right := apu.rightFilter.apply(apu.rightBlip.next())
+            apu.AudioStream.AddSample(left, right)
+        }
+
+        apu.nominalCounter -= 1
+        if apu.nominalCounter <= 0 {
+            apu.nominalCounter += nominalPeriod
+
+            if apu.audioWriter != nil {
+                left := apu.nominalLeftFilter.apply(apu.nominalLeftBlip.next())
+                right := apu.nominalRightFilter.apply(apu.nominalRightBlip.next())
+                err := apu.audioWriter.AddSample(left, right)
+                if err != nil {
+                    apu.Logger.Error(LogAPU, "unable to write audio", "error", err)
+                    apu.audioWriter = nil
+                }
+            }
+
+            if tap {
+                apu.emitChannelSamples()
+            }
         }
     }
 }
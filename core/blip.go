@@ -0,0 +1,114 @@
+package core
+
+import (
+    "math"
+)
+
+// band-limited step synthesis. the apu channels produce square edges at 4mhz, so
+// sampling them directly at the host rate aliases. instead each change in amplitude
+// is added to the output as a band-limited step at its exact sub-sample position.
+// the buffer stores the derivative of the signal, which is integrated as samples
+// are read out.
+
+// number of output samples each step is spread over
+const blipWidth = 16
+// number of sub-sample positions the step kernel is computed at
+const blipPhases = 64
+
+var blipKernel = makeBlipKernel()
+
+// a windowed sinc impulse for each sub-sample phase, each phase sums to 1
+func makeBlipKernel() [blipPhases][blipWidth]float32 {
+    var kernel [blipPhases][blipWidth]float32
+
+    // cutoff as a fraction of the output sample rate, a bit below nyquist
+    const cutoff = 0.45
+
+    for phase := range blipPhases {
+        offset := float64(phase) / blipPhases
+        var total float64
+        var values [blipWidth]float64
+        for i := range blipWidth {
+            x := float64(i) - blipWidth / 2 + 1 - offset
+            sinc := 1.0
+            if x != 0 {
+                sinc = math.Sin(2 * math.Pi * cutoff * x) / (2 * math.Pi * cutoff * x)
+            }
+
+            // blackman window over the width of the kernel
+            position := (x + blipWidth / 2) / blipWidth
+            window := 0.42 - 0.5 * math.Cos(2 * math.Pi * position) + 0.08 * math.Cos(4 * math.Pi * position)
+            if position < 0 || position > 1 {
+                window = 0
+            }
+
+            values[i] = sinc * window
+            total += values[i]
+        }
+
+        for i := range blipWidth {
+            kernel[phase][i] = float32(values[i] / total)
+        }
+    }
+
+    return kernel
+}
+
+type blipBuffer struct {
+    // deltas for the next blipWidth output samples
+    deltas [blipWidth]float32
+    integrator float32
+    // the amplitude as of the last update
+    amplitude float32
+}
+
+// set the amplitude of the signal at a position between 0 and 1 within the next output sample
+func (blip *blipBuffer) update(offset float32, amplitude float32) {
+    delta := amplitude - blip.amplitude
+    if delta == 0 {
+        return
+    }
+
+    blip.amplitude = amplitude
+
+    phase := int(offset * blipPhases)
+    if phase >= blipPhases {
+        phase = blipPhases - 1
+    }
+    if phase < 0 {
+        phase = 0
+    }
+
+    kernel := &blipKernel[phase]
+    for i := range blipWidth {
+        blip.deltas[i] += delta * kernel[i]
+    }
+}
+
+// produce the next output sample
+func (blip *blipBuffer) next() float32 {
+    blip.integrator += blip.deltas[0]
+    copy(blip.deltas[:], blip.deltas[1:])
+    blip.deltas[blipWidth - 1] = 0
+    return blip.integrator
+}
+
+// the dmg output goes through a capacitor that removes any dc offset
+type highPassFilter struct {
+    capacitor float32
+    // how much charge the capacitor keeps each output sample
+    charge float32
+}
+
+func makeHighPassFilter(sampleRate uint32) highPassFilter {
+    return highPassFilter{
+        // the capacitor keeps 0.999958 of its charge every t-cycle
+        charge: float32(math.Pow(0.999958, float64(CPUSpeed) / float64(sampleRate))),
+    }
+}
+
+func (filter *highPassFilter) apply(in float32) float32 {
+    out := in - filter.capacitor
+    filter.capacitor = in - out * filter.charge
+    return out
+}
@@ -0,0 +1,296 @@
+package core
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "time"
+    "bufio"
+    "image"
+    "image/gif"
+    "image/png"
+    "image/draw"
+    "image/color"
+    "image/color/palette"
+    "strings"
+    "unicode"
+)
+
+// saving what the emulator shows and plays: png screenshots, animated gifs, and raw
+// y4m video with a wav of the audio to be encoded later
+
+// master clocks in one frame of the lcd, about 59.7 frames a second
+const FrameClocks = 70224
+
+// a file name for a capture made now, stamped with the rom title
+func CaptureName(title string, extension string) string {
+    name := strings.Map(func(r rune) rune {
+        if unicode.IsLetter(r) || unicode.IsDigit(r) {
+            return r
+        }
+        return '-'
+    }, strings.TrimSpace(title))
+
+    if name == "" {
+        name = "gameboy"
+    }
+
+    return fmt.Sprintf("%v-%v.%v", name, time.Now().Format("20060102-150405.000"), extension)
+}
+
+// save a frame as a png file
+func SaveScreenshot(path string, frame image.Image) error {
+    file, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+
+    err = png.Encode(file, frame)
+    if err != nil {
+        file.Close()
+        return err
+    }
+
+    return file.Close()
+}
+
+// collects frames for an animated gif. every other frame is kept since gif delays are
+// in hundredths of a second and most viewers don't show delays below 2
+type GIFRecorder struct {
+    gif gif.GIF
+    // frames offered so far
+    frames uint64
+}
+
+func MakeGIFRecorder() *GIFRecorder {
+    return &GIFRecorder{}
+}
+
+// the time of a frame in hundredths of a second
+func gifTime(frame uint64) int {
+    return int(frame * FrameClocks * 100 / CPUSpeed)
+}
+
+// convert a frame to a paletted image. a dmg frame only has the 4 colors of the palette
+// so they are used as is, anything with too many colors is dithered
+func palettedFrame(frame *image.RGBA) *image.Paletted {
+    bounds := frame.Bounds()
+    indexes := make(map[color.RGBA]uint8)
+    var colors color.Palette
+
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            pixel := frame.RGBAAt(x, y)
+            if _, ok := indexes[pixel]; !ok {
+                if len(colors) == 256 {
+                    out := image.NewPaletted(bounds, palette.Plan9)
+                    draw.FloydSteinberg.Draw(out, bounds, frame, bounds.Min)
+                    return out
+                }
+                indexes[pixel] = uint8(len(colors))
+                colors = append(colors, pixel)
+            }
+        }
+    }
+
+    out := image.NewPaletted(bounds, colors)
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            out.SetColorIndex(x, y, indexes[frame.RGBAAt(x, y)])
+        }
+    }
+
+    return out
+}
+
+// offer the next frame of the lcd
+func (recorder *GIFRecorder) AddFrame(frame *image.RGBA) {
+    number := recorder.frames
+    recorder.frames += 1
+    if number % 2 != 0 {
+        return
+    }
+
+    recorder.gif.Image = append(recorder.gif.Image, palettedFrame(frame))
+    recorder.gif.Delay = append(recorder.gif.Delay, gifTime(number + 2) - gifTime(number))
+}
+
+// number of frames in the gif
+func (recorder *GIFRecorder) Frames() int {
+    return len(recorder.gif.Image)
+}
+
+func (recorder *GIFRecorder) Save(writer io.Writer) error {
+    if len(recorder.gif.Image) == 0 {
+        return fmt.Errorf("no frames were recorded")
+    }
+
+    return gif.EncodeAll(writer, &recorder.gif)
+}
+
+// writes frames as uncompressed yuv 4:4:4 in the yuv4mpeg2 format, which ffmpeg and
+// most other encoders read
+type Y4MWriter struct {
+    writer *bufio.Writer
+    width int
+    height int
+    plane []uint8
+}
+
+// the title is stored in the header as a comment
+func MakeY4MWriter(writer io.Writer, width int, height int, title string) (*Y4MWriter, error) {
+    y4m := &Y4MWriter{
+        writer: bufio.NewWriter(writer),
+        width: width,
+        height: height,
+        plane: make([]uint8, width * height * 3),
+    }
+
+    // header fields are separated by spaces so the title can't have any
+    comment := strings.ReplaceAll(strings.TrimSpace(title), " ", "_")
+    _, err := fmt.Fprintf(y4m.writer, "YUV4MPEG2 W%v H%v F%v:%v Ip A1:1 C444 XTITLE=%v\n", width, height, CPUSpeed, FrameClocks, comment)
+    if err != nil {
+        return nil, err
+    }
+
+    return y4m, nil
+}
+
+func (y4m *Y4MWriter) AddFrame(frame *image.RGBA) error {
+    bounds := frame.Bounds()
+    if bounds.Dx() != y4m.width || bounds.Dy() != y4m.height {
+        return fmt.Errorf("frame is %vx%v but the video is %vx%v", bounds.Dx(), bounds.Dy(), y4m.width, y4m.height)
+    }
+
+    size := y4m.width * y4m.height
+    for y := range y4m.height {
+        for x := range y4m.width {
+            pixel := frame.RGBAAt(bounds.Min.X + x, bounds.Min.Y + y)
+            luma, cb, cr := color.RGBToYCbCr(pixel.R, pixel.G, pixel.B)
+            index := y * y4m.width + x
+            y4m.plane[index] = luma
+            y4m.plane[size + index] = cb
+            y4m.plane[size * 2 + index] = cr
+        }
+    }
+
+    _, err := y4m.writer.WriteString("FRAME\n")
+    if err != nil {
+        return err
+    }
+
+    _, err = y4m.writer.Write(y4m.plane)
+    return err
+}
+
+func (y4m *Y4MWriter) Flush() error {
+    return y4m.writer.Flush()
+}
+
+// a y4m video of the frames and a wav of the apu output, kept the same length
+type VideoDump struct {
+    videoFile *os.File
+    audioFile *os.File
+    video *Y4MWriter
+    audio *WavWriter
+    sampleRate uint32
+    frames uint64
+}
+
+// create prefix.y4m and prefix.wav
+func MakeVideoDump(prefix string, title string, width int, height int, sampleRate uint32) (*VideoDump, error) {
+    videoFile, err := os.Create(prefix + ".y4m")
+    if err != nil {
+        return nil, err
+    }
+
+    audioFile, err := os.Create(prefix + ".wav")
+    if err != nil {
+        videoFile.Close()
+        return nil, err
+    }
+
+    video, err := MakeY4MWriter(videoFile, width, height, title)
+    if err == nil {
+        var audio *WavWriter
+        audio, err = MakeWavWriter(audioFile, sampleRate)
+        if err == nil {
+            return &VideoDump{
+                videoFile: videoFile,
+                audioFile: audioFile,
+                video: video,
+                audio: audio,
+                sampleRate: sampleRate,
+            }, nil
+        }
+    }
+
+    videoFile.Close()
+    audioFile.Close()
+    return nil, err
+}
+
+// start writing the output of this apu
+func (dump *VideoDump) Attach(apu *APU) {
+    apu.SetAudioWriter(dump.audio)
+}
+
+// add the next frame of the lcd. the audio is written at the nominal sample rate, so
+// both follow the emulated time, except that the apu makes no samples while it is off
+// and the lcd makes no frames while it is off. the audio is padded with silence and
+// frames are repeated to keep the two in step
+func (dump *VideoDump) AddFrame(frame *image.RGBA) error {
+    // the number of samples that go with some number of frames
+    samplesAt := func(frames uint64) uint64 {
+        return frames * FrameClocks * uint64(dump.sampleRate) / CPUSpeed
+    }
+    // samples arrive in bursts, so allow up to a frame of drift either way
+    frameSamples := samplesAt(1)
+
+    // the lcd was off, so show this frame until the video catches up
+    for dump.audio.Samples() > samplesAt(dump.frames + 1) + frameSamples {
+        err := dump.video.AddFrame(frame)
+        if err != nil {
+            return err
+        }
+        dump.frames += 1
+    }
+
+    err := dump.video.AddFrame(frame)
+    if err != nil {
+        return err
+    }
+
+    dump.frames += 1
+
+    // the apu was off, so fill the gap with silence
+    expected := samplesAt(dump.frames)
+    if dump.audio.Samples() + frameSamples < expected {
+        for dump.audio.Samples() < expected {
+            err := dump.audio.AddSample(0, 0)
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    return nil
+}
+
+// the apu should be detached before closing
+func (dump *VideoDump) Close() error {
+    errs := []error{
+        dump.video.Flush(),
+        dump.audio.Close(),
+        dump.videoFile.Close(),
+        dump.audioFile.Close(),
+    }
+
+    for _, err := range errs {
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
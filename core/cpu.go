@@ -1,92 +1,22 @@
 package core
 
 import (
-    "log"
     "fmt"
 )
 
 // speed in hertz
 const CPUSpeed = 4194304
 
-type Joypad struct {
-    Up bool
-    Down bool
-    Left bool
-    Right bool
-    A bool
-    B bool
-    Start bool
-    Select bool
-
-    // if true then return buttons, otherwise dpad
-    ReadButtons bool
-    ReadDpad bool
-}
-
-func (joypad *Joypad) Reset() {
-    joypad.Up = false
-    joypad.Down = false
-    joypad.Left = false
-    joypad.Right = false
-    joypad.A = false
-    joypad.B = false
-    joypad.Start = false
-    joypad.Select = false
-}
-
-func (joypad *Joypad) GetDpad() uint8 {
-    var buttons uint8 = 0b1111
-    if joypad.Up {
-        buttons &= 0b1011
-    }
-    if joypad.Down {
-        buttons &= 0b0111
-    }
-    if joypad.Left {
-        buttons &= 0b1101
-    }
-    if joypad.Right {
-        buttons &= 0b1110
-    }
-    return buttons
+// true if any of the P10-P13 input lines of the selected rows is low
+func (cpu *CPU) joypadLineLow() bool {
+    return cpu.Joypad.GetValue() & 0b1111 != 0b1111
 }
 
-func (joypad *Joypad) GetButtons() uint8 {
-    // start=3, select=2, b=1, a=0
-    var buttons uint8 = 0b1111
-    if joypad.A {
-        buttons &= 0b1110
-    }
-    if joypad.B {
-        buttons &= 0b1101
-    }
-    if joypad.Start {
-        buttons &= 0b0111
-    }
-    if joypad.Select {
-        buttons &= 0b1011
-    }
-    return buttons
-}
-
-func (joypad *Joypad) GetValue() uint8 {
-    if joypad.ReadButtons {
-        return joypad.GetButtons()
-    }
-
-    if joypad.ReadDpad {
-        return joypad.GetDpad()
+// raise the joypad interrupt if an input line went from high to low
+func (cpu *CPU) checkJoypad() {
+    if cpu.Joypad.takeInterrupt() {
+        cpu.EnableJoypad()
     }
-
-    return 0xf
-}
-
-func (joypad *Joypad) SetButtons(buttons bool) {
-    joypad.ReadButtons = buttons
-}
-
-func (joypad *Joypad) SetDpad(dpad bool) {
-    joypad.ReadDpad = dpad
 }
 
 type CPU struct {
@@ -105,20 +35,40 @@ type CPU struct {
     Joypad Joypad
 
     InterruptMasterFlag bool // IME
+    // set by ei, IME is enabled after the following instruction
+    enableInterruptsDelay bool
     // 0: vblank, 1: lcd, 2: timer, 3: serial, 4: joypad
     InterruptFlag uint8 // IF
     InterruptEnable uint8 // IE
 
     Timer uint8
+    // incremented every t-cycle, the upper 8 bits are visible as DIV
     TimerDivider uint16
     TimerModulo uint8
     TimerEnable bool
     TimerClockSelect uint8
-    TimerRate int64
-
+    // TIMA overflowed in the last cycle and will be reloaded from TMA
+    timerOverflow bool
+
+    // last value written to the DMA register
+    dmaRegister uint8
+    dmaSource uint16
+    // number of bytes copied to OAM so far
+    dmaIndex uint16
+    dmaActive bool
+    // the transfer starts one cycle after the register is written
+    dmaDelay uint8
+
+    // the cpu, lcd and timer are stopped until a joypad line goes low
     Stopped bool
     Halted bool
 
+    // running in cgb mode
+    CGB bool
+    // set by writing bit 0 of KEY1, the next stop switches speed
+    SpeedSwitchArmed bool
+    DoubleSpeed bool
+
     Ram []uint8
 
     HighRam []uint8
@@ -126,9 +76,27 @@ type CPU struct {
     PPU *PPU
     APU *APU
     MBC MBC
+    // set when running as a super game boy
+    SGB *SGB
+
+    // SB and SC
+    SerialData uint8
+    SerialControl uint8
+    // machine cycles until the current serial transfer finishes, 0 if none is running
+    serialCycles uint64
+    // the device plugged into the link port, or nil
+    Serial SerialDevice
+
+    // if set, called with the number of machine cycles that elapsed before each
+    // memory access so the rest of the system runs in step with the cpu
+    Tick func(cycles uint64)
+    // machine cycles already passed to Tick for the current instruction
+    ticked uint64
 
     Debug bool
     Error bool
+    // nil to use DefaultLogger, set with SetLogger so every part uses the same one
+    Logger *Logger
 }
 
 func MakeCPU(mbc MBC, audioSampleRate uint32) *CPU {
@@ -141,6 +109,23 @@ func MakeCPU(mbc MBC, audioSampleRate uint32) *CPU {
     }
 }
 
+// log messages from the cpu, ppu, apu and mbc to this logger
+func (cpu *CPU) SetLogger(logger *Logger) {
+    cpu.Logger = logger
+    cpu.PPU.Logger = logger
+    cpu.APU.Logger = logger
+    cpu.MBC.SetLogger(logger)
+    if device, ok := cpu.Serial.(loggingDevice); ok {
+        device.SetLogger(logger)
+    }
+}
+
+// run as a super game boy, which lets the game color the screen and draw a border
+func (cpu *CPU) EnableSGB() {
+    cpu.SGB = MakeSGB()
+    cpu.PPU.SGB = cpu.SGB
+}
+
 // set values that should exist on startup for a DMG model
 // https://gbdev.io/pandocs/Power_Up_Sequence.html
 func (cpu *CPU) InitializeDMG() {
@@ -162,6 +147,8 @@ func (cpu *CPU) InitializeDMG() {
     cpu.StoreMemory(IOTimerModulo, 0x00)
     cpu.StoreMemory(IOTimerControl, 0xf8)
     cpu.StoreMemory(IOInterrupt, 0xe1)
+    // power the apu on first, it ignores writes to the other sound registers while off
+    cpu.StoreMemory(IOSoundOnOff, 0xf1)
     cpu.StoreMemory(IOSoundChannel1Sweep, 0x80)
     cpu.StoreMemory(IOSoundChannel1Duty, 0xbf)
 
@@ -187,7 +174,6 @@ func (cpu *CPU) InitializeDMG() {
     cpu.StoreMemory(IOSoundChannel4Control, 0xbf)
     cpu.StoreMemory(IOMasterVolume, 0x77)
     cpu.StoreMemory(IOSoundPanning, 0xf3)
-    cpu.StoreMemory(IOSoundOnOff, 0xf1)
     cpu.StoreMemory(IOLCDControl, 0x91)
     cpu.StoreMemory(IOLCDStatus, 0x85)
     cpu.StoreMemory(IOViewPortY, 0x00)
@@ -554,6 +540,9 @@ type Instruction struct {
     R16_2 R16
     Immediate8 uint8
     Immediate16 uint16
+
+    // number of bytes fetched for the opcode and its immediates
+    Length uint8
 }
 
 // pass in non-zero set value to set the bit to 1, 0 to set to 0
@@ -662,6 +651,7 @@ const IOObjPalette0 = 0xff48
 const IOObjPalette1 = 0xff49
 const IOLCDControl = 0xff40
 const IOOAM_DMA_Transfer = 0xff46
+const IOSpeedSwitch = 0xff4d
 
 func (cpu *CPU) StoreMemory(address uint16, value uint8) {
     switch {
@@ -694,60 +684,21 @@ func (cpu *CPU) StoreMemory(address uint16, value uint8) {
             cpu.PPU.ViewPortY = value
         case address == IOViewPortX:
             cpu.PPU.ViewPortX = value
-        case address >= IOWaveFormStart && address <= IOWaveFormEnd:
-            index := int(address - IOWaveFormStart)
-            cpu.APU.SetWavePattern(value, index)
+        case address >= IOSoundChannel1Sweep && address <= IOWaveFormEnd:
+            cpu.APU.WriteRegister(address, value)
         case address == IOJoypad:
             buttons := value & 0b100000
             dpad := value & 0b10000
-            cpu.Joypad.SetButtons(buttons == 0)
-            cpu.Joypad.SetDpad(dpad == 0)
-        case address == IOSoundChannel1Sweep:
-            cpu.APU.SetPulse1Sweep(value)
-        case address == IOSoundChannel1Volume:
-            cpu.APU.SetPulse1Volume(value)
-        case address == IOSoundChannel1PeriodHigh:
-            cpu.APU.SetPulse1PeriodHigh(value)
-        case address == IOSoundChannel1PeriodLow:
-            cpu.APU.SetPulse1PeriodLow(value)
-        case address == IOSoundChannel1Duty:
-            cpu.APU.SetPulse1Duty(value)
-        case address == IOSoundChannel2Duty:
-            cpu.APU.SetPulse2Duty(value)
-        case address == IOSoundChannel2Volume:
-            cpu.APU.SetPulse2Volume(value)
-        case address == IOSoundChannel2PeriodLow:
-            cpu.APU.SetPulse2PeriodLow(value)
-        case address == IOSoundChannel2PeriodHigh:
-            cpu.APU.SetPulse2PeriodHigh(value)
-        case address == IOSoundChannel3Length:
-            cpu.APU.SetWaveLength(value)
-        case address == IOSoundChannel3DAC:
-            cpu.APU.SetWaveDAC(value)
-        case address == IOSoundChannel3Volume:
-            cpu.APU.SetWaveVolume(value)
-        case address == IOSoundChannel3PeriodLow:
-            cpu.APU.SetWavePeriodLow(value)
-        case address == IOSoundChannel3PeriodHigh:
-            cpu.APU.SetWavePeriodHigh(value)
-        case address == IOSoundChannel4Volume:
-            cpu.APU.SetNoiseVolume(value)
-        case address == IOSoundChannel4Control:
-            cpu.APU.SetNoiseControl(value)
-        case address == IOSoundChannel4Length:
-            cpu.APU.SetNoiseLength(value)
-        case address == IOSoundChannel4Frequency:
-            cpu.APU.SetNoiseFrequency(value)
-        case address == IOMasterVolume:
-            cpu.APU.SetMasterVolume(value)
-        case address == IOSoundPanning:
-            cpu.APU.SetPanning(value)
-        case address == IOSoundOnOff:
-            cpu.APU.SetMasterEnabled(value & 0b1000_0000 > 0)
+            cpu.Joypad.SetSelection(buttons == 0, dpad == 0)
+            if cpu.SGB != nil {
+                cpu.SGB.WriteJoypad(value, cpu.PPU)
+            }
+            // selecting a row with a button already held down pulls a line low
+            cpu.checkJoypad()
         case address == IOSerialTransferData:
-            // ignore for now
+            cpu.SerialData = value
         case address == IOSerialTransferControl:
-            // ignore
+            cpu.writeSerialControl(value)
         case address == IOWindowY:
             cpu.PPU.WindowY = value
         case address == IOWindowX:
@@ -755,18 +706,35 @@ func (cpu *CPU) StoreMemory(address uint16, value uint8) {
         case address == IOLCDYCompare:
             cpu.PPU.LCDYCompare = value
         case address == IOTimerDivider:
-            cpu.TimerDivider = 0
+            cpu.resetDivider()
         case address == IOTimerModulo:
             cpu.TimerModulo = value
         case address == IOTimerCounter:
+            // writing TIMA in the cycle after an overflow cancels the reload
+            cpu.timerOverflow = false
             cpu.Timer = value
         case address == IOTimerControl:
+            old := cpu.timerSignal()
             enable := (value & 0b100) > 0
             clockSelect := value & 0b11
             cpu.TimerEnable = enable
             cpu.TimerClockSelect = clockSelect
+            if old && !cpu.timerSignal() {
+                cpu.incrementTimer()
+            }
         case address == IOOAM_DMA_Transfer:
-            if value <= 0xf1 {
+            cpu.dmaRegister = value
+            if cpu.Tick != nil {
+                // copy one byte per machine cycle as the system is ticked. sources past
+                // 0xdf read echo ram, which mirrors work ram
+                cpu.dmaSource = uint16(value) << 8
+                if cpu.dmaSource >= 0xe000 {
+                    cpu.dmaSource -= 0x2000
+                }
+                cpu.dmaIndex = 0
+                cpu.dmaDelay = 1
+                cpu.dmaActive = true
+            } else if value <= 0xf1 {
                 source := uint16(value) << 8
                 for oam := range uint16(0xa0) {
                     cpu.PPU.WriteOAM(oam, cpu.LoadMemory8(source + oam))
@@ -777,6 +745,10 @@ func (cpu *CPU) StoreMemory(address uint16, value uint8) {
                 // cpu.Cycles += 160
             }
 
+        case address == IOSpeedSwitch:
+            if cpu.CGB {
+                cpu.SpeedSwitchArmed = value & 0b1 != 0
+            }
         case address == IOPalette:
             cpu.PPU.Palette = value
         case address == IOObjPalette0:
@@ -797,7 +769,7 @@ func (cpu *CPU) StoreMemory(address uint16, value uint8) {
             // ignore
         default:
             if cpu.Error {
-                log.Printf("Warning: unhandled memory write at address 0x%x", address)
+                cpu.Logger.Warn(LogIO, "unhandled memory write", "address", Hex(address), "value", Hex(value))
             }
     }
 }
@@ -817,99 +789,311 @@ func (cpu *CPU) StoreMemory(address uint16, value uint8) {
 func (cpu *CPU) LoadMemory8(address uint16) uint8 {
     // log.Printf("Load memory at address 0x%x", address)
 
+    value, ok := cpu.readMemory(address)
+    if !ok {
+        cpu.Logger.Warn(LogIO, "unhandled memory read", "address", Hex(address))
+    }
+
+    return value
+}
+
+// for debuggers: read what the cpu would see at an address without logging, changing
+// any state or taking any cycles. addresses with nothing mapped read as 0xff
+func (cpu *CPU) Peek(address uint16) uint8 {
+    switch {
+        case address < 0x8000 || (address >= 0xa000 && address < 0xc000):
+            return cpu.MBC.Peek(address)
+        case (address >= VRamStart && address < VRamEnd) || (address >= OAMStart && address < OAMEnd):
+            return cpu.PPU.Peek(address)
+        case address >= IOSoundChannel1Sweep && address <= IOWaveFormEnd:
+            return cpu.APU.Peek(address)
+    }
+
+    value, ok := cpu.readMemory(address)
+    if !ok {
+        return 0xff
+    }
+
+    return value
+}
+
+// for debuggers: change what the cpu sees at an address. rom is patched in place, and
+// registers whose writes start something (dma, serial transfers, resetting the divider,
+// sgb packets, sound triggers) only have their value set
+func (cpu *CPU) Poke(address uint16, value uint8) {
+    switch {
+        case address < 0x8000 || (address >= 0xa000 && address < 0xc000):
+            cpu.MBC.Poke(address, value)
+        case (address >= VRamStart && address < VRamEnd) || (address >= OAMStart && address < OAMEnd):
+            cpu.PPU.Poke(address, value)
+        case address >= IOSoundChannel1Sweep && address <= IOWaveFormEnd:
+            cpu.APU.Poke(address, value)
+        case address == IOJoypad:
+            cpu.Joypad.setSelectionQuiet(value & 0b10_0000 == 0, value & 0b1_0000 == 0)
+        case address == IOSerialTransferControl:
+            cpu.SerialControl = value
+        case address == IOTimerDivider:
+            cpu.TimerDivider = uint16(value) << 8
+        case address == IOTimerCounter:
+            cpu.Timer = value
+        case address == IOTimerControl:
+            cpu.TimerEnable = value & 0b100 != 0
+            cpu.TimerClockSelect = value & 0b11
+        case address == IOOAM_DMA_Transfer:
+            cpu.dmaRegister = value
+        case address == IOLCDStatus:
+            cpu.PPU.LCDStatus = value
+        case address == IOLCDY:
+            cpu.PPU.LCDY = value
+        default:
+            // everything else is plain storage, so write it the normal way
+            if _, ok := cpu.readMemory(address); ok {
+                cpu.StoreMemory(address, value)
+            }
+    }
+}
+
+// returns false if nothing is mapped at the address
+func (cpu *CPU) readMemory(address uint16) (uint8, bool) {
     switch {
-        case address < 0x8000: return cpu.MBC.Read(address)
-        case address >= 0xa000 && address < 0xc000: return cpu.MBC.Read(address)
+        case address < 0x8000: return cpu.MBC.Read(address), true
+        case address >= 0xa000 && address < 0xc000: return cpu.MBC.Read(address), true
         case address >= VRamStart && address < VRamEnd:
-            return cpu.PPU.LoadVRam(address - VRamStart)
+            return cpu.PPU.LoadVRam(address - VRamStart), true
         case address >= WRamStart && address < WRamEnd:
-            return cpu.Ram[address - WRamStart]
+            return cpu.Ram[address - WRamStart], true
         case address >= WRamMirrorStart && address < WRamMirrorEnd:
-            return cpu.Ram[address - WRamMirrorStart]
+            return cpu.Ram[address - WRamMirrorStart], true
         case address >= 0xff80 && address <= 0xfffe:
-            return cpu.HighRam[address - 0xff80]
+            return cpu.HighRam[address - 0xff80], true
         case address >= OAMStart && address < OAMEnd:
-            return cpu.PPU.ReadOAM(address - OAMStart)
+            return cpu.PPU.ReadOAM(address - OAMStart), true
         case address == IOLCDControl:
-            return cpu.PPU.LCDControl
+            return cpu.PPU.LCDControl, true
         case address == IOLCDStatus:
-            return cpu.PPU.LCDStatus
+            return cpu.PPU.LCDStatus, true
         case address == IOInterruptEnable:
-            return cpu.InterruptEnable
+            return cpu.InterruptEnable, true
         case address == IOLCDYCompare:
-            return cpu.PPU.LCDYCompare
+            return cpu.PPU.LCDYCompare, true
         case address == IOInterrupt:
-            return cpu.InterruptFlag
+            // the upper 3 bits are unused and read as 1
+            return cpu.InterruptFlag | 0b1110_0000, true
         case address == IOWindowY:
-            return cpu.PPU.WindowY
+            return cpu.PPU.WindowY, true
         case address == IOWindowX:
-            return cpu.PPU.WindowX
+            return cpu.PPU.WindowX, true
         case address == IOViewPortY:
-            return cpu.PPU.ViewPortY
+            return cpu.PPU.ViewPortY, true
         case address == IOViewPortX:
-            return cpu.PPU.ViewPortX
+            return cpu.PPU.ViewPortX, true
         case address == IOTimerCounter:
-            return cpu.Timer
+            return cpu.Timer, true
+        case address == IOSerialTransferData:
+            return cpu.SerialData, true
+        case address == IOSerialTransferControl:
+            return cpu.readSerialControl(), true
         case address == IOTimerDivider:
             // log.Printf("read io timer divider: 0x%x", cpu.TimerDivider)
-            return uint8(cpu.TimerDivider / 256)
+            return uint8(cpu.TimerDivider >> 8), true
+        case address == IOTimerModulo:
+            return cpu.TimerModulo, true
+        case address == IOTimerControl:
+            var out uint8 = 0b1111_1000
+            if cpu.TimerEnable {
+                out |= 0b100
+            }
+            return out | (cpu.TimerClockSelect & 0b11), true
+        case address == IOOAM_DMA_Transfer:
+            return cpu.dmaRegister, true
+        case address == IOSpeedSwitch:
+            if !cpu.CGB {
+                return 0xff, true
+            }
+
+            // bit 7 is the current speed, bit 0 is the armed flag
+            var out uint8 = 0b0111_1110
+            if cpu.DoubleSpeed {
+                out |= 0b1000_0000
+            }
+            if cpu.SpeedSwitchArmed {
+                out |= 0b1
+            }
+            return out, true
         case address == IOObjPalette0:
-            return cpu.PPU.ObjPalette0
+            return cpu.PPU.ObjPalette0, true
         case address == IOObjPalette1:
-            return cpu.PPU.ObjPalette1
+            return cpu.PPU.ObjPalette1, true
         case address == IOJoypad:
-            return cpu.Joypad.GetValue()
+            if cpu.SGB != nil {
+                return cpu.SGB.ReadJoypad(cpu.Joypad.GetValue()), true
+            }
+            return cpu.Joypad.GetValue(), true
         case address == IOPalette:
-            return cpu.PPU.Palette
-        case address == IOSoundChannel1Sweep:
-            // log.Printf("Warning: read IOSoundChannel1Sweep at 0x%x", address)
-            return cpu.APU.ReadPulse1Sweep()
-        case address == IOSoundChannel1Duty:
-            log.Printf("Warning: read IOSoundChannel1Duty at 0x%x", address)
-            // FIXME: need apu
-            return 0
-        case address == IOMasterVolume:
-            return cpu.APU.GetMasterVolume()
-        case address == IOSoundChannel3DAC:
-            log.Printf("Warning: read IOSoundChannel3DAC at 0x%x", address)
-            // FIXME: need apu
-            return 0
-        case address == IOSoundPanning:
-            return cpu.APU.ReadSoundPanning()
-        case address == IOSoundOnOff:
-            return cpu.APU.ReadMasterControl()
-        case address == IOSoundChannel4Volume:
-            return cpu.APU.ReadNoiseVolume()
+            return cpu.PPU.Palette, true
+        case address >= IOSoundChannel1Sweep && address <= IOWaveFormEnd:
+            return cpu.APU.ReadRegister(address), true
         case address == IOLCDY:
-            return cpu.PPU.LCDY
+            return cpu.PPU.LCDY, true
     }
 
-    log.Printf("Warning: unhandled memory read at address 0x%x", address)
+    return 0, false
+}
 
-    return 0
+// the timer increments on the falling edge of this signal, which is one bit of
+// the divider selected by TAC and'ed with the timer enable flag
+func (cpu *CPU) timerSignal() bool {
+    if !cpu.TimerEnable {
+        return false
+    }
+
+    var bit uint16
+    switch cpu.TimerClockSelect {
+        case 0: bit = 9 // 4096hz
+        case 1: bit = 3 // 262144hz
+        case 2: bit = 5 // 65536hz
+        case 3: bit = 7 // 16384hz
+    }
+
+    return cpu.TimerDivider & (1 << bit) != 0
 }
 
-func (cpu *CPU) RunTimer(cycles uint64) {
-    cpu.TimerDivider += uint16(cycles)
+// the apu frame sequencer is clocked by a falling edge of DIV bit 4, or bit 5 in double speed
+func (cpu *CPU) frameSequencerSignal() bool {
+    if cpu.DoubleSpeed {
+        return cpu.TimerDivider & (1 << 13) != 0
+    }
 
-    if cpu.TimerEnable {
-        cpu.TimerRate -= int64(cycles)
-        if cpu.TimerRate <= 0 {
-            switch cpu.TimerClockSelect {
-                case 0: cpu.TimerRate = 1024
-                case 1: cpu.TimerRate = 16
-                case 2: cpu.TimerRate = 64
-                case 3: cpu.TimerRate = 256
-            }
+    return cpu.TimerDivider & (1 << 12) != 0
+}
+
+// resetting the divider can cause a falling edge on the timer and frame sequencer inputs
+func (cpu *CPU) resetDivider() {
+    oldTimer := cpu.timerSignal()
+    oldSequencer := cpu.frameSequencerSignal()
+    cpu.TimerDivider = 0
+    if oldTimer {
+        cpu.incrementTimer()
+    }
+    if oldSequencer {
+        cpu.APU.ClockFrameSequencer()
+    }
+}
+
+func (cpu *CPU) incrementTimer() {
+    cpu.Timer += 1
+    if cpu.Timer == 0 {
+        // TIMA reads as 0 for one cycle before it is reloaded
+        cpu.timerOverflow = true
+    }
+}
+
+// run the timer for some number of machine cycles
+func (cpu *CPU) RunTimer(cycles uint64) {
+    for range cycles {
+        if cpu.timerOverflow {
+            cpu.timerOverflow = false
+            cpu.Timer = cpu.TimerModulo
+            cpu.InterruptFlag |= 0b00000100
+        }
 
+        old := cpu.timerSignal()
+        oldSequencer := cpu.frameSequencerSignal()
+        cpu.TimerDivider += 4
+        if old && !cpu.timerSignal() {
+            cpu.incrementTimer()
             // log.Printf("timer is now %v", cpu.Timer)
-            cpu.Timer += 1
-            if cpu.Timer == 0 {
-                cpu.InterruptFlag |= 0b00000100
-                cpu.Timer = cpu.TimerModulo
-            }
         }
+        if oldSequencer && !cpu.frameSequencerSignal() {
+            cpu.APU.ClockFrameSequencer()
+        }
+    }
+}
+
+// copy bytes for an in-progress OAM DMA transfer, one per machine cycle
+func (cpu *CPU) runDMA(cycles uint64) {
+    for range cycles {
+        if !cpu.dmaActive {
+            return
+        }
+
+        if cpu.dmaDelay > 0 {
+            cpu.dmaDelay -= 1
+            continue
+        }
+
+        cpu.PPU.WriteOAM(cpu.dmaIndex, cpu.LoadMemory8(cpu.dmaSource + cpu.dmaIndex))
+        cpu.dmaIndex += 1
+        if cpu.dmaIndex >= 0xa0 {
+            cpu.dmaActive = false
+        }
+    }
+}
+
+// number of master clock cycles (4194304hz) in one machine cycle. in double speed mode
+// the cpu runs twice as fast so a machine cycle is only 2 clocks long
+func (cpu *CPU) MachineCycleLength() uint64 {
+    if cpu.DoubleSpeed {
+        return 2
+    }
+
+    return 4
+}
+
+// run the ppu, apu, timer, dma and serial port for some number of machine cycles
+func (cpu *CPU) RunSystem(cycles uint64) {
+    // the ppu and apu always run at the normal rate, while the timer and dma
+    // are clocked by the cpu and so speed up in double speed mode
+    clocks := cycles * cpu.MachineCycleLength()
+    cpu.PPU.Run(clocks, cpu)
+    cpu.APU.Run(clocks)
+    cpu.RunTimer(cycles)
+    cpu.runDMA(cycles)
+    cpu.runSerial(cycles)
+}
+
+// when enabled the cpu ticks the rest of the system on every memory access
+// instead of the caller running the system after each instruction
+func (cpu *CPU) SetCycleAccurate(enabled bool) {
+    if enabled {
+        cpu.Tick = cpu.RunSystem
+    } else {
+        cpu.Tick = nil
+    }
+}
+
+func (cpu *CPU) CycleAccurate() bool {
+    return cpu.Tick != nil
+}
+
+func (cpu *CPU) tick(cycles uint64) {
+    if cpu.Tick != nil && cycles > 0 {
+        cpu.ticked += cycles
+        cpu.Tick(cycles)
+    }
+}
+
+// a memory read made by an instruction, which happens at the end of its machine cycle
+func (cpu *CPU) readBus(address uint16) uint8 {
+    cpu.tick(1)
+
+    // only high ram and io registers are reachable while oam dma is running
+    if cpu.dmaActive && cpu.dmaDelay == 0 && address < 0xff00 {
+        return 0xff
+    }
+
+    return cpu.LoadMemory8(address)
+}
+
+// a memory write made by an instruction, which happens at the end of its machine cycle
+func (cpu *CPU) writeBus(address uint16, value uint8) {
+    cpu.tick(1)
+
+    if cpu.dmaActive && cpu.dmaDelay == 0 && address < 0xff00 {
+        return
     }
+
+    cpu.StoreMemory(address, value)
 }
 
 func (cpu *CPU) LoadMemory16(address uint16) uint16 {
@@ -986,9 +1170,9 @@ func (cpu *CPU) SetRegister8(r8 R8, value uint8) {
 }
 
 func (cpu *CPU) Pop16() uint16 {
-    low := cpu.LoadMemory8(cpu.SP)
+    low := cpu.readBus(cpu.SP)
     cpu.SP += 1
-    high := cpu.LoadMemory8(cpu.SP)
+    high := cpu.readBus(cpu.SP)
     cpu.SP += 1
     return (uint16(high) << 8) | uint16(low)
 }
@@ -997,15 +1181,20 @@ func (cpu *CPU) Push16(value uint16) {
     low := uint8(value & 0xff)
     high := uint8((value >> 8) & 0xff)
 
+    // the stack pointer is decremented in an internal cycle before the writes
+    cpu.tick(1)
+
     cpu.SP -= 1
-    cpu.StoreMemory(cpu.SP, high)
+    cpu.writeBus(cpu.SP, high)
     cpu.SP -= 1
-    cpu.StoreMemory(cpu.SP, low)
+    cpu.writeBus(cpu.SP, low)
 }
 
 func (cpu *CPU) doRetCond(cond bool) {
     if cond {
         cpu.Cycles += 5
+        // the condition is checked in an internal cycle
+        cpu.tick(1)
         cpu.PC = cpu.Pop16()
     } else {
         cpu.Cycles += 2
@@ -1162,8 +1351,34 @@ func (cpu *CPU) doXorA(value uint8) {
 // returns how many cycles the instruction took
 func (cpu *CPU) Execute(instruction Instruction) uint64 {
     oldCycles := cpu.Cycles
+    cpu.ticked = 0
+
+    if cpu.Stopped {
+        // the whole system is stopped, only a button press wakes it up
+        if cpu.joypadLineLow() {
+            cpu.Stopped = false
+        }
+
+        cpu.Cycles += 1
+        return 1
+    }
+
+    if cpu.Halted {
+        // no instructions execute while halted but the rest of the system keeps running
+        cpu.Cycles += 1
+        cpu.tick(1)
+        return 1
+    }
+
+    // an ei executed by the previous instruction takes effect after this one
+    enableInterrupts := cpu.enableInterruptsDelay
+    cpu.enableInterruptsDelay = false
+
+    // the opcode and its immediate bytes were fetched one per machine cycle
+    cpu.tick(uint64(instruction.Length))
+
     if cpu.Debug {
-        log.Printf("cycle=%v pc=0x%x stack=0x%x bc=0x%x hl=0x%x executing instruction: %+v", cpu.Cycles, cpu.PC, cpu.SP, cpu.BC, cpu.HL, instruction)
+        cpu.Logger.Debug(LogCPU, "executing instruction", "cycle", cpu.Cycles, "pc", Hex(cpu.PC), "stack", Hex(cpu.SP), "bc", Hex(cpu.BC), "hl", Hex(cpu.HL), "instruction", instruction)
     }
     switch instruction.Opcode {
         case Nop:
@@ -1187,38 +1402,38 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             cpu.PC += 3
         case StoreBCMemA:
             cpu.Cycles += 2
-            cpu.StoreMemory(cpu.BC, cpu.A)
+            cpu.writeBus(cpu.BC, cpu.A)
             cpu.PC += 1
         case StoreDEMemA:
             cpu.Cycles += 2
-            cpu.StoreMemory(cpu.DE, cpu.A)
+            cpu.writeBus(cpu.DE, cpu.A)
             cpu.PC += 1
         case StoreHLIncMemA:
             cpu.Cycles += 2
-            cpu.StoreMemory(cpu.HL, cpu.A)
+            cpu.writeBus(cpu.HL, cpu.A)
             cpu.HL += 1
             cpu.PC += 1
         case StoreHLDecMemA:
             cpu.Cycles += 2
-            cpu.StoreMemory(cpu.HL, cpu.A)
+            cpu.writeBus(cpu.HL, cpu.A)
             cpu.HL -= 1
             cpu.PC += 1
         case LoadAMemBC:
             cpu.Cycles += 2
-            cpu.A = cpu.LoadMemory8(cpu.BC)
+            cpu.A = cpu.readBus(cpu.BC)
             cpu.PC += 1
         case LoadAMemDE:
             cpu.Cycles += 2
-            cpu.A = cpu.LoadMemory8(cpu.DE)
+            cpu.A = cpu.readBus(cpu.DE)
             cpu.PC += 1
         case LoadAMemHLI:
             cpu.Cycles += 2
-            cpu.A = cpu.LoadMemory8(cpu.HL)
+            cpu.A = cpu.readBus(cpu.HL)
             cpu.HL += 1
             cpu.PC += 1
         case LoadAMemHLD:
             cpu.Cycles += 2
-            cpu.A = cpu.LoadMemory8(cpu.HL)
+            cpu.A = cpu.readBus(cpu.HL)
             cpu.HL -= 1
             cpu.PC += 1
         case StoreSPMem16:
@@ -1227,8 +1442,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             value1 := uint8(cpu.SP & 0xff)
             value2 := uint8((cpu.SP >> 8) & 0xff)
 
-            cpu.StoreMemory(instruction.Immediate16, value1)
-            cpu.StoreMemory(instruction.Immediate16+1, value2)
+            cpu.writeBus(instruction.Immediate16, value1)
+            cpu.writeBus(instruction.Immediate16+1, value2)
 
             cpu.PC += 3
 
@@ -1241,34 +1456,34 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             cpu.Cycles += 2
             cpu.PC += 1
             address := 0xff00 + uint16(cpu.GetRegister8(R8C))
-            cpu.StoreMemory(address, cpu.A)
+            cpu.writeBus(address, cpu.A)
 
         case LdhAC:
             cpu.Cycles += 2
             address := 0xff00 + uint16(cpu.GetRegister8(R8C))
-            cpu.A = cpu.LoadMemory8(address)
+            cpu.A = cpu.readBus(address)
             cpu.PC += 1
 
         case LdhImmediate8A:
-            cpu.Cycles += 2
+            cpu.Cycles += 3
             cpu.PC += 2
             address := 0xff00 + uint16(instruction.Immediate8)
-            cpu.StoreMemory(address, cpu.A)
+            cpu.writeBus(address, cpu.A)
 
         case LdhAImmediate8:
             cpu.Cycles += 3
             address := 0xff00 + uint16(instruction.Immediate8)
-            cpu.A = cpu.LoadMemory8(address)
+            cpu.A = cpu.readBus(address)
             cpu.PC += 2
 
         case LdImmediate16A:
             cpu.Cycles += 4
-            cpu.StoreMemory(instruction.Immediate16, cpu.A)
+            cpu.writeBus(instruction.Immediate16, cpu.A)
             cpu.PC += 3
 
         case LdAImmediate16:
             cpu.Cycles += 4
-            cpu.A = cpu.LoadMemory8(instruction.Immediate16)
+            cpu.A = cpu.readBus(instruction.Immediate16)
             cpu.PC += 3
 
         case JR:
@@ -1310,6 +1525,7 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
         case ReturnFromInterrupt:
             cpu.Cycles += 4
             cpu.PC = cpu.Pop16()
+            // unlike ei, reti enables interrupts immediately
             cpu.InterruptMasterFlag = true
 
         case JrNz:
@@ -1350,11 +1566,14 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
         case DisableInterrupts:
             cpu.Cycles += 1
             cpu.InterruptMasterFlag = false
+            // di right after ei cancels the pending enable
+            enableInterrupts = false
             cpu.PC += 1
 
         case EnableInterrupts:
             cpu.Cycles += 1
-            cpu.InterruptMasterFlag = true
+            // IME is set after the next instruction executes
+            cpu.enableInterruptsDelay = true
             cpu.PC += 1
 
         case IncBC:
@@ -1484,7 +1703,7 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
         case Inc8HL:
             cpu.Cycles += 3
-            value := cpu.LoadMemory8(cpu.HL)
+            value := cpu.readBus(cpu.HL)
             cpu.SetFlagN(false)
 
             carry := uint8(0)
@@ -1496,7 +1715,7 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             value += 1
             cpu.SetFlagZ(value == 0)
 
-            cpu.StoreMemory(cpu.HL, value)
+            cpu.writeBus(cpu.HL, value)
             cpu.PC += 1
 
         case Inc8A:
@@ -1623,7 +1842,7 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
         case Dec8HL:
             cpu.Cycles += 3
-            value := cpu.LoadMemory8(cpu.HL)
+            value := cpu.readBus(cpu.HL)
 
             carry := uint8(0)
             if value & 0b1111 == 0 {
@@ -1634,7 +1853,7 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             value -= 1
             cpu.SetFlagN(true)
             cpu.SetFlagZ(value == 0)
-            cpu.StoreMemory(cpu.HL, value)
+            cpu.writeBus(cpu.HL, value)
 
             cpu.PC += 1
 
@@ -1679,7 +1898,7 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
         case StoreHLImmediate:
             cpu.Cycles += 3
-            cpu.StoreMemory(cpu.HL, instruction.Immediate8)
+            cpu.writeBus(cpu.HL, instruction.Immediate8)
             cpu.PC += 2
 
         case LoadR8R8:
@@ -1688,13 +1907,15 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             var value uint8
 
             if instruction.R8_2 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_2)
             }
 
             if instruction.R8_1 == R8HL {
-                cpu.StoreMemory(cpu.HL, value)
+                cpu.Cycles += 1
+                cpu.writeBus(cpu.HL, value)
             } else {
                 cpu.SetRegister8(instruction.R8_1, value)
             }
@@ -1703,9 +1924,9 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
         case PopAF:
             cpu.Cycles += 3
-            low := cpu.LoadMemory8(cpu.SP)
+            low := cpu.readBus(cpu.SP)
             cpu.SP += 1
-            high := cpu.LoadMemory8(cpu.SP)
+            high := cpu.readBus(cpu.SP)
             cpu.SP += 1
             cpu.F = low & 0b11110000
             cpu.A = high
@@ -1713,9 +1934,9 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
         case PopR16:
             cpu.Cycles += 3
-            low := cpu.LoadMemory8(cpu.SP)
+            low := cpu.readBus(cpu.SP)
             cpu.SP += 1
-            high := cpu.LoadMemory8(cpu.SP)
+            high := cpu.readBus(cpu.SP)
             cpu.SP += 1
 
             full := (uint16(high) << 8) | uint16(low)
@@ -1744,10 +1965,11 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
         case PushAF:
             cpu.Cycles += 4
+            cpu.tick(1)
             cpu.SP -= 1
-            cpu.StoreMemory(cpu.SP, cpu.A)
+            cpu.writeBus(cpu.SP, cpu.A)
             cpu.SP -= 1
-            cpu.StoreMemory(cpu.SP, cpu.F)
+            cpu.writeBus(cpu.SP, cpu.F)
             cpu.PC += 1
 
         case AddAR8:
@@ -1756,7 +1978,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             var value uint8
 
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -1819,7 +2042,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             var value uint8
 
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -1837,7 +2061,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -1856,7 +2081,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -1874,7 +2100,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -1892,7 +2119,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -1910,7 +2138,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -1929,7 +2158,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -1993,14 +2223,16 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
 
             newValue, carry := RotateLeft(value)
             if instruction.R8_1 == R8HL {
-                cpu.StoreMemory(cpu.HL, newValue)
+                cpu.Cycles += 1
+                cpu.writeBus(cpu.HL, newValue)
             } else {
                 cpu.SetRegister8(instruction.R8_1, newValue)
             }
@@ -2026,14 +2258,16 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
 
             newValue, carry := RotateRight(value)
             if instruction.R8_1 == R8HL {
-                cpu.StoreMemory(cpu.HL, newValue)
+                cpu.Cycles += 1
+                cpu.writeBus(cpu.HL, newValue)
             } else {
                 cpu.SetRegister8(instruction.R8_1, newValue)
             }
@@ -2062,7 +2296,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -2072,7 +2307,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             newValue := (value << 1) | oldCarry
 
             if instruction.R8_1 == R8HL {
-                cpu.StoreMemory(cpu.HL, newValue)
+                cpu.Cycles += 1
+                cpu.writeBus(cpu.HL, newValue)
             } else {
                 cpu.SetRegister8(instruction.R8_1, newValue)
             }
@@ -2100,7 +2336,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -2110,7 +2347,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             newValue := (value >> 1) | (oldCarry << 7)
 
             if instruction.R8_1 == R8HL {
-                cpu.StoreMemory(cpu.HL, newValue)
+                cpu.Cycles += 1
+                cpu.writeBus(cpu.HL, newValue)
             } else {
                 cpu.SetRegister8(instruction.R8_1, newValue)
             }
@@ -2125,7 +2363,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -2133,7 +2372,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             carry := value >> 7
             newValue := value << 1
             if instruction.R8_1 == R8HL {
-                cpu.StoreMemory(cpu.HL, newValue)
+                cpu.Cycles += 1
+                cpu.writeBus(cpu.HL, newValue)
             } else {
                 cpu.SetRegister8(instruction.R8_1, newValue)
             }
@@ -2148,7 +2388,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -2156,7 +2397,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             carry := value & 0b1
             newValue := (value >> 1) | (value & 0x80)
             if instruction.R8_1 == R8HL {
-                cpu.StoreMemory(cpu.HL, newValue)
+                cpu.Cycles += 1
+                cpu.writeBus(cpu.HL, newValue)
             } else {
                 cpu.SetRegister8(instruction.R8_1, newValue)
             }
@@ -2171,7 +2413,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -2179,7 +2422,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             carry := value & 0b1
             newValue := value >> 1
             if instruction.R8_1 == R8HL {
-                cpu.StoreMemory(cpu.HL, newValue)
+                cpu.Cycles += 1
+                cpu.writeBus(cpu.HL, newValue)
             } else {
                 cpu.SetRegister8(instruction.R8_1, newValue)
             }
@@ -2194,7 +2438,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -2205,7 +2450,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             newValue := (lower << 4) | upper
 
             if instruction.R8_1 == R8HL {
-                cpu.StoreMemory(cpu.HL, newValue)
+                cpu.Cycles += 1
+                cpu.writeBus(cpu.HL, newValue)
             } else {
                 cpu.SetRegister8(instruction.R8_1, newValue)
             }
@@ -2221,7 +2467,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -2236,7 +2483,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -2244,7 +2492,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             newValue := value & ^(1 << instruction.Immediate8)
 
             if instruction.R8_1 == R8HL {
-                cpu.StoreMemory(cpu.HL, newValue)
+                cpu.Cycles += 1
+                cpu.writeBus(cpu.HL, newValue)
             } else {
                 cpu.SetRegister8(instruction.R8_1, newValue)
             }
@@ -2255,7 +2504,8 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
 
             var value uint8
             if instruction.R8_1 == R8HL {
-                value = cpu.LoadMemory8(cpu.HL)
+                cpu.Cycles += 1
+                value = cpu.readBus(cpu.HL)
             } else {
                 value = cpu.GetRegister8(instruction.R8_1)
             }
@@ -2263,16 +2513,29 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             newValue := value | (1 << instruction.Immediate8)
 
             if instruction.R8_1 == R8HL {
-                cpu.StoreMemory(cpu.HL, newValue)
+                cpu.Cycles += 1
+                cpu.writeBus(cpu.HL, newValue)
             } else {
                 cpu.SetRegister8(instruction.R8_1, newValue)
             }
 
         case Stop:
-            cpu.Stopped = true
-            cpu.PC += 1
+            cpu.Cycles += 1
+            // stop is followed by a padding byte that is skipped
+            cpu.PC += 2
+            cpu.resetDivider()
+
+            if cpu.CGB && cpu.SpeedSwitchArmed {
+                // on the cgb stop performs the speed switch instead of stopping
+                cpu.SpeedSwitchArmed = false
+                cpu.DoubleSpeed = !cpu.DoubleSpeed
+            } else if !cpu.joypadLineLow() {
+                cpu.Stopped = true
+            }
 
         case Halt:
+            cpu.Cycles += 1
+            cpu.PC += 1
             cpu.Halted = true
 
         case DAA:
@@ -2316,11 +2579,22 @@ func (cpu *CPU) Execute(instruction Instruction) uint64 {
             cpu.PC += 1
 
         default:
-            log.Printf("Execute error: unknown opcode %v", instruction.Opcode)
+            cpu.Logger.Error(LogCPU, "unknown opcode", "opcode", instruction.Opcode, "pc", Hex(cpu.PC))
             cpu.Cycles += 1
     }
 
-    return cpu.Cycles - oldCycles
+    cycles := cpu.Cycles - oldCycles
+
+    // internal cycles at the end of the instruction
+    if cycles > cpu.ticked {
+        cpu.tick(cycles - cpu.ticked)
+    }
+
+    if enableInterrupts {
+        cpu.InterruptMasterFlag = true
+    }
+
+    return cycles
 }
 
 func (cpu *CPU) EnableVBlank() {
@@ -2336,50 +2610,81 @@ func (cpu *CPU) EnableStatInterrupt() {
     cpu.InterruptFlag |= 0b00010
 }
 
+type interruptInfo struct {
+    Bits uint8
+    Vector uint16
+}
+
+// in priority order, vblank is serviced first
+var interrupts = []interruptInfo{
+    {0b00001, 0x0040}, // vblank
+    {0b00010, 0x0048}, // lcd
+    {0b00100, 0x0050}, // timer
+    {0b01000, 0x0058}, // serial
+    {0b10000, 0x0060}, // joypad
+}
+
+// returns the interrupts that are both requested and enabled
+func (cpu *CPU) pendingInterrupts() uint8 {
+    return cpu.InterruptEnable & cpu.InterruptFlag & 0b11111
+}
+
+// dispatch the highest priority pending interrupt, if any. returns how many cycles it took
 func (cpu *CPU) HandleInterrupts() uint64 {
-    if cpu.InterruptMasterFlag {
-        // check joypad, serial, timer, lcd, vblank in that order
-        var joypadBits uint8 = 0b10000
-        var serialBits uint8 = 0b01000
-        var timerBits uint8  = 0b00100
-        var lcdBits uint8    = 0b00010
-        var vblankBits uint8 = 0b00001
-
-        type Info struct {
-            Bits uint8
-            Vector uint8
-        }
+    cpu.ticked = 0
 
-        infos := []Info{
-            {joypadBits, 0x0060},
-            {serialBits, 0x0058},
-            {timerBits, 0x0050},
-            {lcdBits, 0x0048},
-            {vblankBits, 0x0040},
-        }
+    cpu.checkJoypad()
 
-        for _, info := range infos {
-            if (cpu.InterruptEnable & info.Bits) == info.Bits && (cpu.InterruptFlag & info.Bits) == info.Bits {
-                // clear IF flag
-                cpu.InterruptFlag &= ^info.Bits
-                // clear IME
-                cpu.InterruptMasterFlag = false
-                // interrupt takes 5 cycles, reset vector itself takes 4
-                /*
-                if info.Bits == lcdBits {
-                    log.Printf("Invoke interrupt %v 0x%x", info.Bits, info.Vector)
-                }
-                */
+    if cpu.Stopped {
+        return 0
+    }
 
-                cpu.Push16(cpu.PC)
-                cpu.PC = uint16(info.Vector)
+    var cycles uint64 = 0
 
-                return 5
-            }
+    if cpu.Halted && cpu.pendingInterrupts() != 0 {
+        // a pending interrupt exits halt even if IME is off, which takes a cycle
+        cpu.Halted = false
+        cycles += 1
+        cpu.tick(1)
+    }
+
+    if !cpu.InterruptMasterFlag || cpu.pendingInterrupts() == 0 {
+        return cycles
+    }
+
+    cpu.InterruptMasterFlag = false
+
+    // two wait cycles, then two pushes and the cycle that loads pc, 5 in all
+    cpu.tick(2)
+
+    cpu.SP -= 1
+    cpu.writeBus(cpu.SP, uint8(cpu.PC >> 8))
+
+    // the interrupt is chosen after the upper byte of pc is pushed. if the push
+    // overwrote IE and nothing is pending anymore then dispatch is cancelled and
+    // execution continues at 0x0000
+    pending := cpu.pendingInterrupts()
+
+    cpu.SP -= 1
+    cpu.writeBus(cpu.SP, uint8(cpu.PC & 0xff))
+
+    cpu.PC = 0
+    for _, info := range interrupts {
+        if pending & info.Bits != 0 {
+            // clear IF flag
+            cpu.InterruptFlag &= ^info.Bits
+            cpu.PC = info.Vector
+            /*
+            log.Printf("Invoke interrupt %v 0x%x", info.Bits, info.Vector)
+            */
+            break
         }
     }
 
-    return 0
+    // pc is loaded in the last cycle
+    cpu.tick(1)
+
+    return cycles + 5
 }
 
 func makeLoadR16Imm16Instruction(r16 R16, immediate uint16) Instruction {
@@ -2480,6 +2785,12 @@ func makeDecR8Instruction(r8 R8) Instruction {
 
 // instructions should be at least 3 bytes long for 'opcode immediate immediate'
 func (cpu *CPU) DecodeInstruction() (Instruction, uint8) {
+    instruction, length := cpu.decodeInstruction()
+    instruction.Length = length
+    return instruction, length
+}
+
+func (cpu *CPU) decodeInstruction() (Instruction, uint8) {
     instruction := cpu.LoadMemory8(cpu.PC)
 
     // special case for CB prefix
@@ -2643,7 +2954,7 @@ func (cpu *CPU) DecodeInstruction() (Instruction, uint8) {
             }
 
         case 0b01:
-            if instruction & 0b11111 == 0b110110 {
+            if instruction & 0b111111 == 0b110110 {
                 return Instruction{Opcode: Halt}, 1
             }
 
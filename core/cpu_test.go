@@ -0,0 +1,81 @@
+package core
+
+import (
+    "testing"
+)
+
+// run some nops and then the code, and return A afterwards. the timer is reset to
+// count every 4 machine cycles just before the nops
+func runAfterNops(t *testing.T, cycleAccurate bool, nops int, code []uint8) uint8 {
+    rom := make([]uint8, 0x8000)
+    end := 0x100 + nops + len(code)
+    copy(rom[0x100 + nops:], code)
+
+    cpu := MakeCPU(&MBC0{rom: rom}, 44100)
+    cpu.InitializeDMG()
+    cpu.SetCycleAccurate(cycleAccurate)
+    cpu.InterruptMasterFlag = false
+    cpu.PC = 0x100
+
+    cpu.StoreMemory(IOTimerControl, 0b101)
+    cpu.StoreMemory(IOTimerCounter, 0)
+    cpu.StoreMemory(IOTimerDivider, 0)
+
+    machine := MakeMachine(cpu)
+    for steps := 0; cpu.PC != uint16(end); steps++ {
+        if steps > nops + len(code) {
+            t.Fatalf("the code did not finish at 0x%x, pc is 0x%x", end, cpu.PC)
+        }
+        machine.StepInstruction()
+    }
+
+    return cpu.A
+}
+
+// LDH A,(TIMA) reads in its third machine cycle and LD A,(HL) in its second, so in
+// cycle accurate mode they see the timer as it is partway through the instruction
+func TestReadTimerDuringInstruction(test *testing.T) {
+    ldh := []uint8{0xf0, 0x05}
+    // LD HL,0xff05 then LD A,(HL)
+    ldHL := []uint8{0x21, 0x05, 0xff, 0x7e}
+
+    for nops := range 12 {
+        if value := runAfterNops(test, true, nops, ldh); value != uint8((nops + 3) / 4) {
+            test.Errorf("ldh after %v nops read TIMA %v, expected %v", nops, value, (nops + 3) / 4)
+        }
+
+        if value := runAfterNops(test, true, nops, ldHL); value != uint8((nops + 5) / 4) {
+            test.Errorf("ld (hl) after %v nops read TIMA %v, expected %v", nops, value, (nops + 5) / 4)
+        }
+
+        // otherwise the read happens before any of the instruction's time has passed
+        if value := runAfterNops(test, false, nops, ldh); value != uint8(nops / 4) {
+            test.Errorf("ldh after %v nops without cycle accuracy read TIMA %v, expected %v", nops, value, nops / 4)
+        }
+    }
+}
+
+// a read of LY in the third cycle of LDH sees the same line as a read made 3 cycles
+// later without cycle accuracy, including when the line changes in between
+func TestReadLYDuringInstruction(test *testing.T) {
+    ldh := []uint8{0xf0, 0x44}
+
+    changed := false
+    last := runAfterNops(test, true, 0, ldh)
+    for nops := range 240 {
+        accurate := runAfterNops(test, true, nops, ldh)
+        expected := runAfterNops(test, false, nops + 3, ldh)
+        if accurate != expected {
+            test.Errorf("ldh after %v nops read LY %v, expected %v", nops, accurate, expected)
+        }
+
+        if accurate != last {
+            changed = true
+        }
+        last = accurate
+    }
+
+    if !changed {
+        test.Errorf("LY never changed")
+    }
+}
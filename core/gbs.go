@@ -0,0 +1,311 @@
+package core
+
+import (
+    "io"
+    "fmt"
+    "bytes"
+    "strings"
+    "encoding/binary"
+)
+
+// gbs files hold the sound driver and music data ripped from a game along with the
+// addresses of its init and play routines
+// https://ocremix.org/info/GBS_Format_Specification
+
+const gbsHeaderSize = 0x70
+
+// the init and play routines are called with this as their return address. it is in
+// echo ram so no real code runs there
+const gbsReturnAddress = 0xf00d
+
+type GBSFile struct {
+    Version uint8
+    // number of songs, numbered from 1
+    Songs uint8
+    FirstSong uint8
+    LoadAddress uint16
+    InitAddress uint16
+    PlayAddress uint16
+    StackPointer uint16
+    TimerModulo uint8
+    TimerControl uint8
+    Title string
+    Author string
+    Copyright string
+    Code []byte
+}
+
+func gbsString(data []byte) string {
+    end := bytes.IndexByte(data, 0)
+    if end == -1 {
+        end = len(data)
+    }
+    return strings.TrimSpace(string(data[:end]))
+}
+
+func LoadGBS(reader io.Reader) (*GBSFile, error) {
+    data, err := io.ReadAll(reader)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(data) < gbsHeaderSize || !bytes.Equal(data[0:3], []byte("GBS")) {
+        return nil, fmt.Errorf("not a gbs file")
+    }
+
+    gbs := GBSFile{
+        Version: data[0x03],
+        Songs: data[0x04],
+        FirstSong: data[0x05],
+        LoadAddress: binary.LittleEndian.Uint16(data[0x06:]),
+        InitAddress: binary.LittleEndian.Uint16(data[0x08:]),
+        PlayAddress: binary.LittleEndian.Uint16(data[0x0a:]),
+        StackPointer: binary.LittleEndian.Uint16(data[0x0c:]),
+        TimerModulo: data[0x0e],
+        TimerControl: data[0x0f],
+        Title: gbsString(data[0x10:0x30]),
+        Author: gbsString(data[0x30:0x50]),
+        Copyright: gbsString(data[0x50:0x70]),
+        Code: data[gbsHeaderSize:],
+    }
+
+    if gbs.Version != 1 {
+        return nil, fmt.Errorf("unsupported gbs version %v", gbs.Version)
+    }
+
+    if gbs.LoadAddress < 0x400 {
+        // the rst and interrupt vectors would overlap the code
+        return nil, fmt.Errorf("gbs load address 0x%x is too low", gbs.LoadAddress)
+    }
+
+    if int(gbs.LoadAddress) + len(gbs.Code) > 0x8000 * 256 {
+        return nil, fmt.Errorf("gbs file is too large")
+    }
+
+    return &gbs, nil
+}
+
+// number of master clocks between calls to the play routine
+func (gbs *GBSFile) PlayPeriod() uint64 {
+    if gbs.TimerControl & 0b100 != 0 {
+        // clocks per timer increment for each TAC clock select
+        var divider uint64
+        switch gbs.TimerControl & 0b11 {
+            case 0: divider = 1024
+            case 1: divider = 16
+            case 2: divider = 64
+            case 3: divider = 256
+        }
+
+        period := divider * (256 - uint64(gbs.TimerModulo))
+
+        // bit 7 runs the cpu, and so the timer, at double speed
+        if gbs.TimerControl & 0x80 != 0 {
+            period /= 2
+        }
+
+        return period
+    }
+
+    // one frame, about 59.7hz
+    return 70224
+}
+
+// the rom is banked with mbc1 style writes to 0x2000-0x3fff, and there is 8k of ram
+// at 0xa000 that music drivers use for their own state
+type gbsMBC struct {
+    rom MBC
+    ram []uint8
+}
+
+func (mbc *gbsMBC) Read(address uint16) uint8 {
+    if address >= 0xa000 && address < 0xc000 {
+        return mbc.ram[address - 0xa000]
+    }
+
+    return mbc.rom.Read(address)
+}
+
+func (mbc *gbsMBC) Write(address uint16, value uint8) {
+    if address >= 0xa000 && address < 0xc000 {
+        mbc.ram[address - 0xa000] = value
+        return
+    }
+
+    mbc.rom.Write(address, value)
+}
+
+func (mbc *gbsMBC) SetLogger(logger *Logger) {
+    mbc.rom.SetLogger(logger)
+}
+
+func (mbc *gbsMBC) Reset() {
+    mbc.rom.Reset()
+}
+
+func (mbc *gbsMBC) Peek(address uint16) uint8 {
+    if address >= 0xa000 && address < 0xc000 {
+        return mbc.ram[address - 0xa000]
+    }
+
+    return mbc.rom.Peek(address)
+}
+
+func (mbc *gbsMBC) Poke(address uint16, value uint8) {
+    if address >= 0xa000 && address < 0xc000 {
+        mbc.ram[address - 0xa000] = value
+        return
+    }
+
+    mbc.rom.Poke(address, value)
+}
+
+// build a rom image with the code at its load address
+func (gbs *GBSFile) makeMBC() MBC {
+    size := int(gbs.LoadAddress) + len(gbs.Code)
+    // whole 16k banks, at least 2 of them
+    size = max(0x8000, (size + 0x3fff) / 0x4000 * 0x4000)
+
+    rom := make([]uint8, size)
+    copy(rom[gbs.LoadAddress:], gbs.Code)
+
+    // the rst instructions jump to the copies of the vectors at the load address
+    for vector := uint16(0); vector < 0x40; vector += 8 {
+        target := gbs.LoadAddress + vector
+        rom[vector] = 0xc3 // jp
+        rom[vector + 1] = uint8(target)
+        rom[vector + 2] = uint8(target >> 8)
+    }
+
+    // play is called on a schedule rather than from an interrupt, so one that a routine
+    // enables just returns
+    for vector := 0x40; vector <= 0x60; vector += 8 {
+        rom[vector] = 0xd9 // reti
+    }
+
+    var banked MBC
+    if size <= 0x8000 {
+        banked = &MBC0{rom: rom}
+    } else {
+        banked = &MBC1{rom: rom, romBank: 1}
+    }
+
+    return &gbsMBC{
+        rom: banked,
+        ram: make([]uint8, 0x2000),
+    }
+}
+
+// runs the routines in a gbs file on a cpu so its apu plays the music
+type GBSPlayer struct {
+    GBS *GBSFile
+    Cpu *CPU
+    // the current song, numbered from 0
+    Song int
+
+    sampleRate uint32
+    // master clocks the cpu has run for since the song started
+    clock uint64
+    // clock at which play is called next
+    nextPlay uint64
+    // a routine is running and has not returned yet
+    running bool
+}
+
+func MakeGBSPlayer(gbs *GBSFile, sampleRate uint32) (*GBSPlayer, error) {
+    player := &GBSPlayer{
+        GBS: gbs,
+        sampleRate: sampleRate,
+    }
+
+    err := player.StartSong(int(gbs.FirstSong) - 1)
+    if err != nil {
+        return nil, err
+    }
+
+    return player, nil
+}
+
+// start a song from a fresh machine. songs are numbered from 0
+func (player *GBSPlayer) StartSong(song int) error {
+    if song < 0 || song >= int(player.GBS.Songs) {
+        return fmt.Errorf("song %v out of range, there are %v songs", song + 1, player.GBS.Songs)
+    }
+
+    cpu := MakeCPU(player.GBS.makeMBC(), player.sampleRate)
+    cpu.InitializeDMG()
+    // nothing is drawn so don't bother running the lcd
+    cpu.StoreMemory(IOLCDControl, 0)
+    cpu.StoreMemory(IOTimerModulo, player.GBS.TimerModulo)
+    cpu.StoreMemory(IOTimerControl, player.GBS.TimerControl & 0b111)
+    if player.GBS.TimerControl & 0x80 != 0 {
+        cpu.CGB = true
+        cpu.DoubleSpeed = true
+    }
+
+    if player.Cpu != nil {
+        // keep the output stream and the mute and solo settings
+        cpu.APU.AudioStream = player.Cpu.APU.AudioStream
+        cpu.APU.SetScopeEnabled(player.Cpu.APU.IsScopeEnabled())
+        for _, channel := range AllChannels {
+            cpu.APU.SetMuted(channel, player.Cpu.APU.IsMuted(channel))
+            cpu.APU.SetSolo(channel, player.Cpu.APU.IsSolo(channel))
+        }
+    }
+
+    player.Cpu = cpu
+    player.Song = song
+    player.clock = 0
+    player.nextPlay = 0
+
+    cpu.SP = player.GBS.StackPointer
+    cpu.A = uint8(song)
+    player.call(player.GBS.InitAddress)
+
+    return nil
+}
+
+func (player *GBSPlayer) call(address uint16) {
+    player.Cpu.Push16(gbsReturnAddress)
+    player.Cpu.PC = address
+    player.running = true
+}
+
+// run the machine for some number of master clocks, calling the play routine at its rate
+func (player *GBSPlayer) Run(clocks uint64) {
+    cpu := player.Cpu
+    end := player.clock + clocks
+
+    for player.clock < end {
+        if player.running {
+            if cpu.PC == gbsReturnAddress {
+                player.running = false
+                continue
+            }
+
+            cycles := cpu.HandleInterrupts()
+            instruction, _ := cpu.DecodeInstruction()
+            cycles += cpu.Execute(instruction)
+            cpu.RunSystem(cycles)
+            player.clock += cycles * cpu.MachineCycleLength()
+        } else {
+            if player.clock >= player.nextPlay {
+                // init is done, start calling play
+                player.nextPlay += player.GBS.PlayPeriod()
+                player.call(player.GBS.PlayAddress)
+                continue
+            }
+
+            // idle until the next play call
+            idle := min(end, player.nextPlay) - player.clock
+            cycles := (idle + cpu.MachineCycleLength() - 1) / cpu.MachineCycleLength()
+            cpu.RunSystem(cycles)
+            player.clock += cycles * cpu.MachineCycleLength()
+        }
+    }
+}
+
+// seconds of the current song played so far
+func (player *GBSPlayer) Elapsed() float64 {
+    return float64(player.clock) / CPUSpeed
+}
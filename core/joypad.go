@@ -0,0 +1,196 @@
+package core
+
+type Button int
+const (
+    ButtonA Button = iota
+    ButtonB
+    ButtonSelect
+    ButtonStart
+    ButtonRight
+    ButtonLeft
+    ButtonUp
+    ButtonDown
+)
+
+func (button Button) String() string {
+    switch button {
+        case ButtonA: return "a"
+        case ButtonB: return "b"
+        case ButtonSelect: return "select"
+        case ButtonStart: return "start"
+        case ButtonRight: return "right"
+        case ButtonLeft: return "left"
+        case ButtonUp: return "up"
+        case ButtonDown: return "down"
+    }
+
+    return "unknown"
+}
+
+var AllButtons = []Button{ButtonA, ButtonB, ButtonSelect, ButtonStart, ButtonRight, ButtonLeft, ButtonUp, ButtonDown}
+
+// the buttons are wired in a matrix, the program selects the dpad row and/or the button
+// row through bits 4 and 5 of 0xff00 and reads the P10-P13 lines in the lower 4 bits.
+// a pressed button pulls its line low
+type Joypad struct {
+    // use SetPressed to change these so that the joypad interrupt is raised
+    Up bool
+    Down bool
+    Left bool
+    Right bool
+    A bool
+    B bool
+    Start bool
+    Select bool
+
+    // if true then return buttons, otherwise dpad
+    ReadButtons bool
+    ReadDpad bool
+
+    // last state of the P10-P13 lines
+    lines uint8
+    // a line went from high to low since the last time the interrupt was checked
+    interrupt bool
+}
+
+func (joypad *Joypad) Reset() {
+    for _, button := range AllButtons {
+        joypad.SetPressed(button, false)
+    }
+}
+
+func (joypad *Joypad) IsPressed(button Button) bool {
+    switch button {
+        case ButtonA: return joypad.A
+        case ButtonB: return joypad.B
+        case ButtonSelect: return joypad.Select
+        case ButtonStart: return joypad.Start
+        case ButtonRight: return joypad.Right
+        case ButtonLeft: return joypad.Left
+        case ButtonUp: return joypad.Up
+        case ButtonDown: return joypad.Down
+    }
+
+    return false
+}
+
+// press or release a button. if this pulls one of the selected input lines low
+// then the joypad interrupt will be requested
+func (joypad *Joypad) SetPressed(button Button, pressed bool) {
+    switch button {
+        case ButtonA: joypad.A = pressed
+        case ButtonB: joypad.B = pressed
+        case ButtonSelect: joypad.Select = pressed
+        case ButtonStart: joypad.Start = pressed
+        case ButtonRight: joypad.Right = pressed
+        case ButtonLeft: joypad.Left = pressed
+        case ButtonUp: joypad.Up = pressed
+        case ButtonDown: joypad.Down = pressed
+    }
+
+    joypad.update()
+}
+
+func (joypad *Joypad) GetDpad() uint8 {
+    var buttons uint8 = 0b1111
+    if joypad.Up {
+        buttons &= 0b1011
+    }
+    if joypad.Down {
+        buttons &= 0b0111
+    }
+    if joypad.Left {
+        buttons &= 0b1101
+    }
+    if joypad.Right {
+        buttons &= 0b1110
+    }
+    return buttons
+}
+
+func (joypad *Joypad) GetButtons() uint8 {
+    // start=3, select=2, b=1, a=0
+    var buttons uint8 = 0b1111
+    if joypad.A {
+        buttons &= 0b1110
+    }
+    if joypad.B {
+        buttons &= 0b1101
+    }
+    if joypad.Start {
+        buttons &= 0b0111
+    }
+    if joypad.Select {
+        buttons &= 0b1011
+    }
+    return buttons
+}
+
+// the state of the P10-P13 lines. when both rows are selected a line is low
+// if a button in either row is pressed
+func (joypad *Joypad) getLines() uint8 {
+    var lines uint8 = 0b1111
+    if joypad.ReadButtons {
+        lines &= joypad.GetButtons()
+    }
+
+    if joypad.ReadDpad {
+        lines &= joypad.GetDpad()
+    }
+
+    return lines
+}
+
+// the value read from 0xff00. the unused upper bits read as 1, bits 4 and 5 are
+// the row selection as written (0 means selected)
+func (joypad *Joypad) GetValue() uint8 {
+    var out uint8 = 0b1100_0000
+    if !joypad.ReadButtons {
+        out |= 0b10_0000
+    }
+    if !joypad.ReadDpad {
+        out |= 0b01_0000
+    }
+
+    return out | joypad.getLines()
+}
+
+// recompute the input lines and note any high to low transition
+func (joypad *Joypad) update() {
+    lines := joypad.getLines()
+    if joypad.lines & ^lines & 0b1111 != 0 {
+        joypad.interrupt = true
+    }
+    joypad.lines = lines
+}
+
+// returns true once for every time the interrupt was raised
+func (joypad *Joypad) takeInterrupt() bool {
+    interrupt := joypad.interrupt
+    joypad.interrupt = false
+    return interrupt
+}
+
+// select the rows to read, both at once as a write to 0xff00 would
+func (joypad *Joypad) SetSelection(buttons bool, dpad bool) {
+    joypad.ReadButtons = buttons
+    joypad.ReadDpad = dpad
+    joypad.update()
+}
+
+// select the rows without raising the interrupt, for debuggers
+func (joypad *Joypad) setSelectionQuiet(buttons bool, dpad bool) {
+    joypad.ReadButtons = buttons
+    joypad.ReadDpad = dpad
+    joypad.lines = joypad.getLines()
+}
+
+func (joypad *Joypad) SetButtons(buttons bool) {
+    joypad.ReadButtons = buttons
+    joypad.update()
+}
+
+func (joypad *Joypad) SetDpad(dpad bool) {
+    joypad.ReadDpad = dpad
+    joypad.update()
+}
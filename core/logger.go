@@ -0,0 +1,268 @@
+package core
+
+import (
+    "fmt"
+    "math"
+    "sync"
+    "time"
+    "strings"
+    "context"
+    "log/slog"
+)
+
+// the part of the system a log message comes from, each has its own level
+type LogCategory int
+
+const (
+    LogCPU LogCategory = iota
+    LogPPU
+    LogAPU
+    LogMBC
+    // memory accesses that nothing handles, the link port and the sgb
+    LogIO
+    logCategoryCount
+)
+
+var LogCategories = []LogCategory{LogCPU, LogPPU, LogAPU, LogMBC, LogIO}
+
+func (category LogCategory) String() string {
+    switch category {
+        case LogCPU: return "cpu"
+        case LogPPU: return "ppu"
+        case LogAPU: return "apu"
+        case LogMBC: return "mbc"
+        case LogIO: return "io"
+    }
+
+    return "unknown"
+}
+
+// a level above every other, which turns a category off
+const LogOff = slog.Level(math.MaxInt32)
+
+// a warning that repeats more than this many times in a window is dropped until the
+// window ends. the number dropped is logged with the next warning after that, or by
+// Flush
+const LogBurst = 5
+const LogWindow = time.Second
+
+// how often a warning has been logged in the current window
+type logRepeat struct {
+    category LogCategory
+    level slog.Level
+    message string
+    start time.Time
+    count int
+}
+
+// sends messages from the emulator to a slog handler, with a level per category.
+// a nil logger uses DefaultLogger
+type Logger struct {
+    // nil to use the handler of slog.Default() at the time of the message
+    handler slog.Handler
+    levels [logCategoryCount]slog.Level
+
+    lock sync.Mutex
+    repeats map[string]*logRepeat
+}
+
+// used by anything that was not given a logger of its own
+var DefaultLogger = MakeLogger(nil)
+
+// every category starts at info
+func MakeLogger(handler slog.Handler) *Logger {
+    return &Logger{
+        handler: handler,
+        repeats: make(map[string]*logRepeat),
+    }
+}
+
+func (logger *Logger) orDefault() *Logger {
+    if logger == nil {
+        return DefaultLogger
+    }
+    return logger
+}
+
+func (logger *Logger) SetLevel(category LogCategory, level slog.Level) {
+    logger.lock.Lock()
+    defer logger.lock.Unlock()
+    logger.levels[category] = level
+}
+
+func (logger *Logger) Level(category LogCategory) slog.Level {
+    logger = logger.orDefault()
+    logger.lock.Lock()
+    defer logger.lock.Unlock()
+    return logger.levels[category]
+}
+
+func (logger *Logger) Enabled(category LogCategory, level slog.Level) bool {
+    return level >= logger.Level(category)
+}
+
+func parseLogLevel(name string) (slog.Level, error) {
+    if strings.EqualFold(name, "off") {
+        return LogOff, nil
+    }
+
+    var level slog.Level
+    err := level.UnmarshalText([]byte(name))
+    return level, err
+}
+
+// set the levels from a comma separated list, where each entry is a level for every
+// category or category=level. for example "warn,cpu=debug,mbc=off"
+func (logger *Logger) Configure(spec string) error {
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+
+        name, levelName, found := strings.Cut(entry, "=")
+        if !found {
+            level, err := parseLogLevel(entry)
+            if err != nil {
+                return fmt.Errorf("unknown log level '%v'", entry)
+            }
+            for _, category := range LogCategories {
+                logger.SetLevel(category, level)
+            }
+            continue
+        }
+
+        level, err := parseLogLevel(levelName)
+        if err != nil {
+            return fmt.Errorf("unknown log level '%v'", levelName)
+        }
+
+        matched := false
+        for _, category := range LogCategories {
+            if category.String() == strings.ToLower(strings.TrimSpace(name)) {
+                logger.SetLevel(category, level)
+                matched = true
+            }
+        }
+
+        if !matched {
+            return fmt.Errorf("unknown log category '%v'", name)
+        }
+    }
+
+    return nil
+}
+
+// removes the repeats whose window has ended, or all of them, and returns the ones
+// that had messages dropped. the lock must be held
+func (logger *Logger) endRepeats(now time.Time, all bool) []logRepeat {
+    var dropped []logRepeat
+    for key, repeat := range logger.repeats {
+        if all || now.Sub(repeat.start) >= LogWindow {
+            if repeat.count > LogBurst {
+                dropped = append(dropped, *repeat)
+            }
+            delete(logger.repeats, key)
+        }
+    }
+    return dropped
+}
+
+// returns false if the message has been repeated too often and should be dropped, and
+// the windows that ended with messages dropped
+func (logger *Logger) allow(category LogCategory, level slog.Level, message string, now time.Time) (bool, []logRepeat) {
+    logger.lock.Lock()
+    defer logger.lock.Unlock()
+
+    dropped := logger.endRepeats(now, false)
+
+    key := category.String() + ":" + message
+    repeat, ok := logger.repeats[key]
+    if !ok {
+        repeat = &logRepeat{category: category, level: level, message: message, start: now}
+        logger.repeats[key] = repeat
+    }
+
+    repeat.count += 1
+    return repeat.count <= LogBurst, dropped
+}
+
+func (logger *Logger) getHandler() slog.Handler {
+    if logger.handler == nil {
+        return slog.Default().Handler()
+    }
+    return logger.handler
+}
+
+func reportDropped(handler slog.Handler, now time.Time, dropped []logRepeat) {
+    for _, repeat := range dropped {
+        record := slog.NewRecord(now, repeat.level, "dropped repeated messages", 0)
+        record.AddAttrs(slog.String("category", repeat.category.String()), slog.String("message", repeat.message), slog.Int("count", repeat.count - LogBurst))
+        handler.Handle(context.Background(), record)
+    }
+}
+
+// log the number of messages dropped in windows that have not ended yet. call it
+// before exiting so that a flood at the end is not lost
+func (logger *Logger) Flush() {
+    logger = logger.orDefault()
+    now := time.Now()
+
+    logger.lock.Lock()
+    dropped := logger.endRepeats(now, true)
+    logger.lock.Unlock()
+
+    reportDropped(logger.getHandler(), now, dropped)
+}
+
+// log a message with slog style key value pairs. warnings and errors are rate limited
+func (logger *Logger) Log(category LogCategory, level slog.Level, message string, args ...any) {
+    logger = logger.orDefault()
+    if !logger.Enabled(category, level) {
+        return
+    }
+
+    handler := logger.getHandler()
+    if !handler.Enabled(context.Background(), level) {
+        return
+    }
+
+    now := time.Now()
+
+    if level >= slog.LevelWarn {
+        allowed, dropped := logger.allow(category, level, message, now)
+        reportDropped(handler, now, dropped)
+        if !allowed {
+            return
+        }
+    }
+
+    record := slog.NewRecord(now, level, message, 0)
+    record.AddAttrs(slog.String("category", category.String()))
+    record.Add(args...)
+    handler.Handle(context.Background(), record)
+}
+
+func (logger *Logger) Debug(category LogCategory, message string, args ...any) {
+    logger.Log(category, slog.LevelDebug, message, args...)
+}
+
+func (logger *Logger) Info(category LogCategory, message string, args ...any) {
+    logger.Log(category, slog.LevelInfo, message, args...)
+}
+
+func (logger *Logger) Warn(category LogCategory, message string, args ...any) {
+    logger.Log(category, slog.LevelWarn, message, args...)
+}
+
+func (logger *Logger) Error(category LogCategory, message string, args ...any) {
+    logger.Log(category, slog.LevelError, message, args...)
+}
+
+// an address or register value shown in hex. formatting is left until the message
+// is actually written
+type Hex uint32
+
+func (value Hex) LogValue() slog.Value {
+    return slog.StringValue(fmt.Sprintf("0x%x", uint32(value)))
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+    "context"
+    "log/slog"
+    "testing"
+)
+
+// keeps every record it is given
+type recordHandler struct {
+    records []slog.Record
+}
+
+func (handler *recordHandler) Enabled(context context.Context, level slog.Level) bool {
+    return true
+}
+
+func (handler *recordHandler) Handle(context context.Context, record slog.Record) error {
+    handler.records = append(handler.records, record)
+    return nil
+}
+
+func (handler *recordHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return handler
+}
+
+func (handler *recordHandler) WithGroup(name string) slog.Handler {
+    return handler
+}
+
+// the number of dropped messages is logged even if the message never comes again
+func TestLoggerFlushDropped(test *testing.T) {
+    handler := &recordHandler{}
+    logger := MakeLogger(handler)
+
+    for range LogBurst + 3 {
+        logger.Warn(LogIO, "flood")
+    }
+    if len(handler.records) != LogBurst {
+        test.Fatalf("%v messages were logged, expected %v", len(handler.records), LogBurst)
+    }
+
+    logger.Flush()
+    if len(handler.records) != LogBurst + 1 {
+        test.Fatalf("the dropped messages were not reported")
+    }
+
+    report := handler.records[LogBurst]
+    count := 0
+    report.Attrs(func(attr slog.Attr) bool {
+        if attr.Key == "count" {
+            count = int(attr.Value.Int64())
+        }
+        return true
+    })
+    if report.Level != slog.LevelWarn || count != 3 {
+        test.Errorf("reported %v dropped at %v, expected 3 at warn", count, report.Level)
+    }
+
+    // nothing is left to report
+    logger.Flush()
+    if len(handler.records) != LogBurst + 1 {
+        test.Errorf("the dropped messages were reported twice")
+    }
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+    "image"
+)
+
+// runs a cpu together with the rest of the system, so a frontend only has to feed it
+// input and time and take frames and audio out
+type Machine struct {
+    Cpu *CPU
+    // called each time the lcd finishes a frame
+    OnFrame func()
+
+    // master clocks left over from the last RunCycles, negative if it ran over
+    budget int64
+    // set when a frame finishes, cleared by RunFrame
+    frameDone bool
+    audio []float32
+}
+
+func MakeMachine(cpu *CPU) *Machine {
+    return &Machine{
+        Cpu: cpu,
+    }
+}
+
+// run one instruction, or dispatch an interrupt and run the instruction it jumps to,
+// and run the rest of the system for as long as that took. returns the number of
+// master clocks that passed
+func (machine *Machine) StepInstruction() int64 {
+    cpu := machine.Cpu
+
+    cycles := cpu.HandleInterrupts()
+
+    next, _ := cpu.DecodeInstruction()
+    cycles += cpu.Execute(next)
+
+    // in cycle accurate mode the cpu already ran the system as it executed.
+    // the lcd does not run while the cpu is stopped
+    if !cpu.CycleAccurate() && !cpu.Stopped {
+        cpu.RunSystem(cycles)
+    }
+
+    select {
+        case <-cpu.PPU.Draw:
+            machine.frameDone = true
+            if machine.OnFrame != nil {
+                machine.OnFrame()
+            }
+        default:
+    }
+
+    return int64(cycles * cpu.MachineCycleLength())
+}
+
+// run for some number of master clocks. instructions are not split, so the time one
+// runs over by is taken off the next call
+func (machine *Machine) RunCycles(clocks int64) {
+    machine.budget += clocks
+
+    for machine.budget > 0 {
+        machine.budget -= machine.StepInstruction()
+    }
+}
+
+// run until the lcd finishes the next frame. while the lcd is off no frames are made,
+// so this stops after a frame's worth of time instead
+func (machine *Machine) RunFrame() {
+    machine.frameDone = false
+
+    var clocks int64
+    for !machine.frameDone && clocks < FrameClocks {
+        clocks += machine.StepInstruction()
+    }
+}
+
+// set which buttons are held down, buttons not in the map are released
+func (machine *Machine) SetInput(pressed map[Button]bool) {
+    for _, button := range AllButtons {
+        machine.Cpu.Joypad.SetPressed(button, pressed[button])
+    }
+}
+
+// the last frame the lcd finished
+func (machine *Machine) Framebuffer() *image.RGBA {
+    return machine.Cpu.PPU.Frame()
+}
+
+// take all of the audio made so far as interleaved left/right samples at the sample
+// rate the cpu was made with. the slice is reused by the next call
+func (machine *Machine) DrainAudio() []float32 {
+    stream := machine.Cpu.APU.GetAudioStream()
+
+    size := stream.Buffered() * 2
+    if cap(machine.audio) < size {
+        machine.audio = make([]float32, size)
+    }
+
+    count := stream.ReadSamples(machine.audio[:size])
+    return machine.audio[:count]
+}
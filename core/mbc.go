@@ -2,12 +2,28 @@ package core
 
 import (
     "fmt"
-    "log"
 )
 
 type MBC interface {
     Read(address uint16) uint8
     Write(address uint16, value uint8)
+    // for debuggers: read what the cpu would see without logging or changing any state
+    Peek(address uint16) uint8
+    // for debuggers: change the byte the cpu sees at an address. rom is patched and ram
+    // is written even if it is disabled, the bank registers are left alone
+    Poke(address uint16, value uint8)
+    SetLogger(logger *Logger)
+    // put the bank registers back to how they are at power on, ram is kept
+    Reset()
+}
+
+// gives an mbc somewhere to log bad accesses
+type mbcLogger struct {
+    logger *Logger
+}
+
+func (mbc *mbcLogger) SetLogger(logger *Logger) {
+    mbc.logger = logger
 }
 
 func (mbc0 *MBC0) Read(address uint16) uint8 {
@@ -23,16 +39,35 @@ func (mbc0 *MBC0) Write(address uint16, value uint8) {
     if address == 0x2000 {
         // ignore
     } else if mbc0.showError {
-        log.Printf("Attempted to write to ROM at address 0x%x", address)
+        mbc0.logger.Warn(LogMBC, "write to rom", "address", Hex(address))
+    }
+}
+
+func (mbc0 *MBC0) Peek(address uint16) uint8 {
+    if int(address) < len(mbc0.rom) && address < 0x8000 {
+        return mbc0.rom[address]
+    }
+    return 0
+}
+
+func (mbc0 *MBC0) Poke(address uint16, value uint8) {
+    if int(address) < len(mbc0.rom) && address < 0x8000 {
+        mbc0.rom[address] = value
     }
 }
 
+// there are no bank registers
+func (mbc0 *MBC0) Reset() {
+}
+
 type MBC0 struct {
+    mbcLogger
     rom []uint8
     showError bool
 }
 
 type MBC1 struct {
+    mbcLogger
     rom []uint8
     romBank uint8 // 0x2000 register
     ramBank uint8 // 0x4000 register
@@ -42,47 +77,99 @@ type MBC1 struct {
     mode uint8
 }
 
+// the offset in the rom of an address in 0x0000-0x7fff with the current banks
+func (mbc1 *MBC1) romOffset(address uint16) uint32 {
+    if address < 0x4000 {
+        if mbc1.mode == 0 {
+            return uint32(address)
+        }
+        return (uint32(mbc1.ramBank) << 19) | uint32(address)
+    }
+
+    return (uint32(mbc1.ramBank) << 19) | (uint32(mbc1.romBank) << 14) | uint32(address & 0b11_1111_1111_1111)
+}
+
+// the byte behind an address in 0xa000-0xbfff with the current bank, or nil if
+// the bank is past the end of ram
+func (mbc1 *MBC1) ramByte(address uint16) *uint8 {
+    address2 := (uint32(mbc1.ramBank) << 13) | uint32(address - 0xa000)
+    if address2 >= uint32(len(mbc1.ram)) {
+        return nil
+    }
+    return &mbc1.ram[address2]
+}
+
 func (mbc1 *MBC1) Read(address uint16) uint8 {
     switch {
-        case address < 0x4000:
-            if mbc1.mode == 0 {
-                return mbc1.rom[address]
-            }
-
-            address2 := (uint32(mbc1.ramBank) << 19) | uint32(address)
+        case address < 0x8000:
+            address2 := mbc1.romOffset(address)
             if address2 >= uint32(len(mbc1.rom)) {
-                log.Printf("Attempted to read from ROM at address 0x%x", address)
-                return 0
-            }
-            return mbc1.rom[address2]
-            
-        case address >= 0x4000 && address < 0x8000:
-            address2 := (uint32(mbc1.ramBank) << 19) | (uint32(mbc1.romBank) << 14) | uint32(address & 0b11_1111_1111_1111)
-            if address2 >= uint32(len(mbc1.rom)) {
-                log.Printf("Attempted to read from ROM at address 0x%x", address)
+                mbc1.logger.Warn(LogMBC, "read past the end of rom", "address", Hex(address))
                 return 0
             }
             // log.Printf("mbc1 read 0x4000 range address=0x%x, romBank=%d, ramBank=%d, address2=0x%x value=0x%x", address, mbc1.romBank, mbc1.ramBank, address2, mbc1.rom[address2])
             return mbc1.rom[address2]
         case address >= 0xA000 && address < 0xC000:
             if mbc1.ramEnabled {
-                if mbc1.ramBank == 0 {
-                    return mbc1.rom[address - 0xa000]
-                }
-
-                address2 := (uint32(mbc1.ramBank) << 13) | uint32(address - 0xa000)
-                if address2 >= uint32(len(mbc1.ram)) {
-                    log.Printf("Attempted to read from RAM at address 0x%x", address)
+                ram := mbc1.ramByte(address)
+                if ram == nil {
+                    mbc1.logger.Warn(LogMBC, "read past the end of ram", "address", Hex(address))
                     return 0
                 }
 
-                return mbc1.ram[address2]
+                return *ram
             }
     }
 
     return 0
 }
 
+// the cartridge ram, which a battery keeps when the game boy is off
+func (mbc1 *MBC1) SaveRAM() []uint8 {
+    return mbc1.ram
+}
+
+func (mbc1 *MBC1) Reset() {
+    mbc1.romBank = 1
+    mbc1.ramBank = 0
+    mbc1.ramEnabled = false
+    mbc1.mode = 0
+}
+
+func (mbc1 *MBC1) Peek(address uint16) uint8 {
+    switch {
+        case address < 0x8000:
+            address2 := mbc1.romOffset(address)
+            if address2 < uint32(len(mbc1.rom)) {
+                return mbc1.rom[address2]
+            }
+        case address >= 0xa000 && address < 0xc000:
+            if mbc1.ramEnabled {
+                ram := mbc1.ramByte(address)
+                if ram != nil {
+                    return *ram
+                }
+            }
+    }
+
+    return 0
+}
+
+func (mbc1 *MBC1) Poke(address uint16, value uint8) {
+    switch {
+        case address < 0x8000:
+            address2 := mbc1.romOffset(address)
+            if address2 < uint32(len(mbc1.rom)) {
+                mbc1.rom[address2] = value
+            }
+        case address >= 0xa000 && address < 0xc000:
+            ram := mbc1.ramByte(address)
+            if ram != nil {
+                *ram = value
+            }
+    }
+}
+
 func (mbc1 *MBC1) Write(address uint16, value uint8) {
     // log.Printf("mbc1 write: 0x%x = 0x%x", address, value)
     switch {
@@ -104,25 +191,22 @@ func (mbc1 *MBC1) Write(address uint16, value uint8) {
             mbc1.mode = value & 0x01
         case address >= 0xA000 && address < 0xC000:
             if mbc1.ramEnabled {
-                if mbc1.ramBank == 0 {
-                    mbc1.rom[address - 0xa000] = value
-                } else {
-                    address2 := (uint32(mbc1.ramBank) << 13) | uint32(address - 0xa000)
-                    if address2 >= uint32(len(mbc1.ram)) {
-                        log.Printf("Attempted to write to RAM at address 0x%x", address)
-                        return
-                    }
-                    mbc1.ram[address2] = value
+                ram := mbc1.ramByte(address)
+                if ram == nil {
+                    mbc1.logger.Warn(LogMBC, "write past the end of ram", "address", Hex(address))
+                    return
                 }
+                *ram = value
             } else {
-                log.Printf("Warning: mbc1 write to RAM when disabled: 0x%x = 0x%x", address, value)
+                mbc1.logger.Warn(LogMBC, "write to disabled ram", "address", Hex(address), "value", Hex(value))
             }
         default:
-            log.Printf("Warning: Attempted to write to ROM at address 0x%x: 0x%x", address, value)
+            mbc1.logger.Warn(LogMBC, "unhandled write", "address", Hex(address), "value", Hex(value))
     }
 }
 
 type MBC3 struct {
+    mbcLogger
     rom []uint8
     ramEnabled bool
     ram []uint8
@@ -132,40 +216,109 @@ type MBC3 struct {
     rtcValues []uint8
 }
 
+// the offset in the rom of an address in 0x0000-0x7fff with the current bank
+func (mbc3 *MBC3) romOffset(address uint16) uint32 {
+    if address < 0x4000 {
+        return uint32(address)
+    }
+    return (uint32(mbc3.romBank) << 14) | uint32(address & 0b11_1111_1111_1111)
+}
+
+// the ram byte or rtc register behind an address in 0xa000-0xbfff, or nil if the
+// bank is past the end of ram
+func (mbc3 *MBC3) ramByte(address uint16) *uint8 {
+    if mbc3.rtc != 0 {
+        if int(mbc3.rtc - 8) >= len(mbc3.rtcValues) {
+            return nil
+        }
+        return &mbc3.rtcValues[mbc3.rtc - 8]
+    }
+
+    address2 := (uint32(mbc3.ramBank) << 13) | uint32(address - 0xa000)
+    if address2 >= uint32(len(mbc3.ram)) {
+        return nil
+    }
+    return &mbc3.ram[address2]
+}
+
 func (mbc3 *MBC3) Read(address uint16) uint8 {
     switch {
-        case address < 0x4000:
-            return mbc3.rom[address]
-        case address >= 0x4000 && address < 0x8000:
-            address2 := (uint32(mbc3.romBank) << 14) | uint32(address & 0b11_1111_1111_1111)
+        case address < 0x8000:
+            address2 := mbc3.romOffset(address)
             if address2 >= uint32(len(mbc3.rom)) {
-                log.Printf("Attempted to read from ROM at address 0x%x", address)
+                mbc3.logger.Warn(LogMBC, "read past the end of rom", "address", Hex(address))
                 return 0
             }
             // log.Printf("mbc1 read 0x4000 range address=0x%x, romBank=%d, ramBank=%d, address2=0x%x value=0x%x", address, mbc1.romBank, mbc1.ramBank, address2, mbc1.rom[address2])
             return mbc3.rom[address2]
         case address >= 0xa000 && address < 0xc000:
             if mbc3.ramEnabled {
+                ram := mbc3.ramByte(address)
+                if ram == nil {
+                    mbc3.logger.Warn(LogMBC, "read past the end of ram", "address", Hex(address))
+                    return 0
+                }
 
-                if mbc3.rtc == 0 {
-                    address2 := (uint32(mbc3.ramBank) << 13) | uint32(address - 0xa000)
-                    if address2 >= uint32(len(mbc3.ram)) {
-                        log.Printf("Attempted to read from RAM at address 0x%x", address)
-                        return 0
-                    }
+                return *ram
+            }
+    }
 
-                    return mbc3.ram[address2]
-                } else {
-                    return mbc3.rtcValues[mbc3.rtc - 8]
+    mbc3.logger.Warn(LogMBC, "unhandled read", "address", Hex(address))
+
+    return 0
+}
+
+func (mbc3 *MBC3) SaveRAM() []uint8 {
+    return mbc3.ram
+}
+
+// the seconds, minutes, hours and day registers of the clock
+func (mbc3 *MBC3) RTC() []uint8 {
+    return mbc3.rtcValues
+}
+
+// the clock keeps running, so its registers are kept too
+func (mbc3 *MBC3) Reset() {
+    mbc3.ramEnabled = false
+    mbc3.ramBank = 0
+    mbc3.romBank = 1
+    mbc3.rtc = 0
+}
+
+func (mbc3 *MBC3) Peek(address uint16) uint8 {
+    switch {
+        case address < 0x8000:
+            address2 := mbc3.romOffset(address)
+            if address2 < uint32(len(mbc3.rom)) {
+                return mbc3.rom[address2]
+            }
+        case address >= 0xa000 && address < 0xc000:
+            if mbc3.ramEnabled {
+                ram := mbc3.ramByte(address)
+                if ram != nil {
+                    return *ram
                 }
             }
     }
 
-    log.Printf("Warning: mbc3: read from unsupported address 0x%x", address)
-
     return 0
 }
 
+func (mbc3 *MBC3) Poke(address uint16, value uint8) {
+    switch {
+        case address < 0x8000:
+            address2 := mbc3.romOffset(address)
+            if address2 < uint32(len(mbc3.rom)) {
+                mbc3.rom[address2] = value
+            }
+        case address >= 0xa000 && address < 0xc000:
+            ram := mbc3.ramByte(address)
+            if ram != nil {
+                *ram = value
+            }
+    }
+}
+
 func (mbc3 *MBC3) Write(address uint16, value uint8) {
     switch {
         case address < 0x2000:
@@ -175,10 +328,11 @@ func (mbc3 *MBC3) Write(address uint16, value uint8) {
                 mbc3.ramEnabled = false
             }
         case address >= 0x2000 && address < 0x4000:
-            if value == 0 {
-                value = 1
-            }
+            // bank 0 can't be mapped at 0x4000, it selects bank 1 instead
             mbc3.romBank = value & 0x7F
+            if mbc3.romBank == 0 {
+                mbc3.romBank = 1
+            }
         case address >= 0x4000 && address < 0x6000:
             if value <= 7 {
                 mbc3.rtc = 0
@@ -190,37 +344,40 @@ func (mbc3 *MBC3) Write(address uint16, value uint8) {
             // FIXME: latch the current time into the rtc registers
         case address >= 0xa000 && address < 0xc000:
             if mbc3.ramEnabled {
-                if mbc3.rtc == 0 {
-                    address2 := (uint32(mbc3.ramBank) << 13) | uint32(address - 0xa000)
-                    if address2 >= uint32(len(mbc3.ram)) {
-                        log.Printf("Attempted to write to RAM at address 0x%x", address)
-                        return
-                    }
-                    mbc3.ram[address2] = value
-                } else {
-                    mbc3.rtcValues[mbc3.rtc - 8] = value
+                ram := mbc3.ramByte(address)
+                if ram == nil {
+                    mbc3.logger.Warn(LogMBC, "write past the end of ram", "address", Hex(address))
+                    return
                 }
+                *ram = value
             }
         default:
-            log.Printf("mbc3: unhandled write to address 0x%x: 0x%x", address, value)
+            mbc3.logger.Warn(LogMBC, "unhandled write", "address", Hex(address), "value", Hex(value))
     }
 }
 
 type MBC2 struct {
+    mbcLogger
     rom []uint8
     ram []uint8
     romBank uint8
     ramEnable bool
 }
 
+// the offset in the rom of an address in 0x0000-0x7fff with the current bank
+func (mbc2 *MBC2) romOffset(address uint16) uint32 {
+    if address < 0x4000 {
+        return uint32(address)
+    }
+    return (uint32(mbc2.romBank) << 14) | uint32(address & 0b11_1111_1111_1111)
+}
+
 func (mbc2 *MBC2) Read(address uint16) uint8 {
     switch {
-        case address < 0x4000:
-            return mbc2.rom[address]
-        case address >= 0x4000 && address < 0x8000:
-            address2 := (uint32(mbc2.romBank) << 14) | uint32(address & 0b11_1111_1111_1111)
+        case address < 0x8000:
+            address2 := mbc2.romOffset(address)
             if address2 >= uint32(len(mbc2.rom)) {
-                log.Printf("Attempted to read from ROM at address 0x%x", address)
+                mbc2.logger.Warn(LogMBC, "read past the end of rom", "address", Hex(address))
                 return 0
             }
             // log.Printf("mbc1 read 0x4000 range address=0x%x, romBank=%d, ramBank=%d, address2=0x%x value=0x%x", address, mbc1.romBank, mbc1.ramBank, address2, mbc1.rom[address2])
@@ -229,7 +386,7 @@ func (mbc2 *MBC2) Read(address uint16) uint8 {
             if mbc2.ramEnable {
                 address2 := address & 0b1_1111_1111
                 if address2 >= uint16(len(mbc2.ram)) {
-                    log.Printf("Attempted to read from RAM at address 0x%x", address)
+                    mbc2.logger.Warn(LogMBC, "read past the end of ram", "address", Hex(address))
                     return 0
                 }
                 return mbc2.ram[address2]
@@ -237,11 +394,52 @@ func (mbc2 *MBC2) Read(address uint16) uint8 {
 
     }
 
-    log.Printf("Warning: mbc2: read from unsupported address 0x%x", address)
+    mbc2.logger.Warn(LogMBC, "unhandled read", "address", Hex(address))
+
+    return 0
+}
+
+func (mbc2 *MBC2) SaveRAM() []uint8 {
+    return mbc2.ram
+}
+
+func (mbc2 *MBC2) Reset() {
+    mbc2.romBank = 1
+    mbc2.ramEnable = false
+}
+
+func (mbc2 *MBC2) Peek(address uint16) uint8 {
+    switch {
+        case address < 0x8000:
+            address2 := mbc2.romOffset(address)
+            if address2 < uint32(len(mbc2.rom)) {
+                return mbc2.rom[address2]
+            }
+        case address >= 0xa000 && address < 0xc000:
+            address2 := address & 0b1_1111_1111
+            if mbc2.ramEnable && address2 < uint16(len(mbc2.ram)) {
+                return mbc2.ram[address2]
+            }
+    }
 
     return 0
 }
 
+func (mbc2 *MBC2) Poke(address uint16, value uint8) {
+    switch {
+        case address < 0x8000:
+            address2 := mbc2.romOffset(address)
+            if address2 < uint32(len(mbc2.rom)) {
+                mbc2.rom[address2] = value
+            }
+        case address >= 0xa000 && address < 0xc000:
+            address2 := address & 0b1_1111_1111
+            if address2 < uint16(len(mbc2.ram)) {
+                mbc2.ram[address2] = value
+            }
+    }
+}
+
 func (mbc2 *MBC2) Write(address uint16, value uint8) {
     switch {
         case address < 0x4000:
@@ -261,13 +459,13 @@ func (mbc2 *MBC2) Write(address uint16, value uint8) {
             if mbc2.ramEnable {
                 address2 := address & 0b1_1111_1111
                 if address2 >= uint16(len(mbc2.ram)) {
-                    log.Printf("Attempted to write to RAM at address 0x%x", address)
+                    mbc2.logger.Warn(LogMBC, "write past the end of ram", "address", Hex(address))
                 } else {
                     mbc2.ram[address2] = value
                 }
             }
         default:
-            log.Printf("MBC2: unhandled write to address 0x%x: 0x%x", address, value)
+            mbc2.logger.Warn(LogMBC, "unhandled write", "address", Hex(address), "value", Hex(value))
     }
 }
 
@@ -290,6 +488,7 @@ func MakeMBC(mbcType uint8, rom []uint8) (MBC, error) {
         case 3, 0x13:
             return &MBC3{
                 rom: rom,
+                romBank: 1,
                 ram: make([]uint8, 0x2000 * 8), // 8 banks of 8k each
                 rtcValues: make([]uint8, 5), // 5 RTC values
             }, nil
@@ -0,0 +1,80 @@
+package core
+
+// how a value has to compare with the last search to stay a candidate
+type SearchFilter int
+
+const (
+    SearchUnchanged SearchFilter = iota
+    SearchChanged
+    SearchDecreased
+    SearchIncreased
+)
+
+func (filter SearchFilter) String() string {
+    switch filter {
+        case SearchUnchanged: return "unchanged"
+        case SearchChanged: return "changed"
+        case SearchDecreased: return "decreased"
+        case SearchIncreased: return "increased"
+    }
+
+    return "unknown"
+}
+
+// the ram a game keeps its variables in: cartridge ram, work ram and high ram
+var searchRanges = [][2]uint32{
+    {0xa000, 0xc000},
+    {WRamStart, WRamEnd},
+    {0xff80, 0xffff},
+}
+
+// narrows down the address of a game variable by repeatedly keeping the addresses
+// whose value changed, or didn't, since the last look
+type MemorySearch struct {
+    Candidates []uint16
+    // the value of each address when it was last looked at
+    previous [0x10000]uint8
+}
+
+func MakeMemorySearch(cpu *CPU) *MemorySearch {
+    search := &MemorySearch{}
+
+    for _, area := range searchRanges {
+        for address := area[0]; address < area[1]; address++ {
+            search.Candidates = append(search.Candidates, uint16(address))
+            search.previous[address] = cpu.Peek(uint16(address))
+        }
+    }
+
+    return search
+}
+
+// keep the candidates that pass the filter, and remember their current values
+func (search *MemorySearch) Filter(cpu *CPU, filter SearchFilter) {
+    kept := search.Candidates[:0]
+
+    for _, address := range search.Candidates {
+        value := cpu.Peek(address)
+        last := search.previous[address]
+
+        var keep bool
+        switch filter {
+            case SearchUnchanged: keep = value == last
+            case SearchChanged: keep = value != last
+            case SearchDecreased: keep = value < last
+            case SearchIncreased: keep = value > last
+        }
+
+        if keep {
+            kept = append(kept, address)
+            search.previous[address] = value
+        }
+    }
+
+    search.Candidates = kept
+}
+
+// the value an address had at the last search
+func (search *MemorySearch) Previous(address uint16) uint8 {
+    return search.previous[address]
+}
@@ -0,0 +1,221 @@
+package core
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "bufio"
+    "strings"
+    "strconv"
+    "image/color"
+    "path/filepath"
+    "encoding/json"
+)
+
+// the colors the 4 shades of the dmg are shown as, from lightest to darkest. the
+// background and each of the two object palettes can use different colors
+type DisplayPalette struct {
+    Name string
+    Background [4]color.RGBA
+    Object0 [4]color.RGBA
+    Object1 [4]color.RGBA
+}
+
+// a palette that uses the same colors for the background and objects
+func MakeDisplayPalette(name string, colors [4]color.RGBA) DisplayPalette {
+    return DisplayPalette{
+        Name: name,
+        Background: colors,
+        Object0: colors,
+        Object1: colors,
+    }
+}
+
+var PalettePresets = []DisplayPalette{
+    MakeDisplayPalette("green", [4]color.RGBA{
+        {0xbc, 0xe9, 0xbb, 255}, // light green
+        {0x9e, 0xc3, 0x9d, 255}, // dark green
+        {0x60, 0x77, 0x60, 255}, // dark gray
+        {0x2a, 0x34, 0x2a, 255}, // black
+    }),
+    MakeDisplayPalette("pocket", [4]color.RGBA{
+        {0xe0, 0xdb, 0xcd, 255},
+        {0xa8, 0x9f, 0x94, 255},
+        {0x70, 0x6b, 0x66, 255},
+        {0x2b, 0x2b, 0x26, 255},
+    }),
+    MakeDisplayPalette("light", [4]color.RGBA{
+        {0x6b, 0xd3, 0xc0, 255},
+        {0x3f, 0xa8, 0x98, 255},
+        {0x1c, 0x6e, 0x65, 255},
+        {0x06, 0x30, 0x2c, 255},
+    }),
+    MakeDisplayPalette("contrast", [4]color.RGBA{
+        {255, 255, 255, 255}, // white
+        {0xaa, 0xaa, 0xaa, 255}, // light gray
+        {0x55, 0x55, 0x55, 255}, // dark gray
+        {0, 0, 0, 255}, // black
+    }),
+}
+
+// parse a color in the form #rrggbb
+func parseHexColor(value string) (color.RGBA, error) {
+    value = strings.TrimPrefix(strings.TrimSpace(value), "#")
+    if len(value) != 6 {
+        return color.RGBA{}, fmt.Errorf("invalid color '%v'", value)
+    }
+
+    rgb, err := strconv.ParseUint(value, 16, 32)
+    if err != nil {
+        return color.RGBA{}, fmt.Errorf("invalid color '%v'", value)
+    }
+
+    return color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 255}, nil
+}
+
+func parseColors(values []string) ([4]color.RGBA, error) {
+    var out [4]color.RGBA
+    if len(values) != 4 {
+        return out, fmt.Errorf("expected 4 colors but found %v", len(values))
+    }
+
+    for i, value := range values {
+        parsed, err := parseHexColor(value)
+        if err != nil {
+            return out, err
+        }
+        out[i] = parsed
+    }
+
+    return out, nil
+}
+
+// a json palette lists colors from lightest to darkest. obj0 and obj1 are optional
+// and default to the background colors
+//
+//   {"name": "mine", "background": ["#ffffff", "#aaaaaa", "#555555", "#000000"],
+//    "obj0": [...], "obj1": [...]}
+func LoadPaletteJSON(reader io.Reader) (DisplayPalette, error) {
+    var data struct {
+        Name string `json:"name"`
+        Background []string `json:"background"`
+        Object0 []string `json:"obj0"`
+        Object1 []string `json:"obj1"`
+    }
+
+    err := json.NewDecoder(reader).Decode(&data)
+    if err != nil {
+        return DisplayPalette{}, err
+    }
+
+    background, err := parseColors(data.Background)
+    if err != nil {
+        return DisplayPalette{}, fmt.Errorf("background: %v", err)
+    }
+
+    palette := MakeDisplayPalette(data.Name, background)
+
+    if data.Object0 != nil {
+        palette.Object0, err = parseColors(data.Object0)
+        if err != nil {
+            return DisplayPalette{}, fmt.Errorf("obj0: %v", err)
+        }
+    }
+
+    if data.Object1 != nil {
+        palette.Object1, err = parseColors(data.Object1)
+        if err != nil {
+            return DisplayPalette{}, fmt.Errorf("obj1: %v", err)
+        }
+    }
+
+    return palette, nil
+}
+
+// a gimp palette with 4 colors used for everything, or 12 colors for the background,
+// obj0 and obj1, each from lightest to darkest
+func LoadPaletteGPL(reader io.Reader) (DisplayPalette, error) {
+    scanner := bufio.NewScanner(reader)
+
+    if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "GIMP Palette" {
+        return DisplayPalette{}, fmt.Errorf("not a gimp palette")
+    }
+
+    var name string
+    var colors []color.RGBA
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "Columns:") {
+            continue
+        }
+
+        if strings.HasPrefix(line, "Name:") {
+            name = strings.TrimSpace(strings.TrimPrefix(line, "Name:"))
+            continue
+        }
+
+        // r g b followed by an optional name
+        fields := strings.Fields(line)
+        if len(fields) < 3 {
+            return DisplayPalette{}, fmt.Errorf("invalid palette line '%v'", line)
+        }
+
+        var rgb [3]uint8
+        for i := range 3 {
+            value, err := strconv.ParseUint(fields[i], 10, 8)
+            if err != nil {
+                return DisplayPalette{}, fmt.Errorf("invalid palette line '%v'", line)
+            }
+            rgb[i] = uint8(value)
+        }
+
+        colors = append(colors, color.RGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 255})
+    }
+
+    if scanner.Err() != nil {
+        return DisplayPalette{}, scanner.Err()
+    }
+
+    switch len(colors) {
+        case 4:
+            return MakeDisplayPalette(name, [4]color.RGBA(colors)), nil
+        case 12:
+            return DisplayPalette{
+                Name: name,
+                Background: [4]color.RGBA(colors[0:4]),
+                Object0: [4]color.RGBA(colors[4:8]),
+                Object1: [4]color.RGBA(colors[8:12]),
+            }, nil
+    }
+
+    return DisplayPalette{}, fmt.Errorf("expected 4 or 12 colors but found %v", len(colors))
+}
+
+// load a .json or .gpl palette file. palettes without a name are named after the file
+func LoadPalette(path string) (DisplayPalette, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return DisplayPalette{}, err
+    }
+    defer file.Close()
+
+    var palette DisplayPalette
+    switch strings.ToLower(filepath.Ext(path)) {
+        case ".json":
+            palette, err = LoadPaletteJSON(file)
+        case ".gpl":
+            palette, err = LoadPaletteGPL(file)
+        default:
+            return DisplayPalette{}, fmt.Errorf("unknown palette format '%v'", filepath.Ext(path))
+    }
+
+    if err != nil {
+        return DisplayPalette{}, err
+    }
+
+    if palette.Name == "" {
+        palette.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+    }
+
+    return palette, nil
+}
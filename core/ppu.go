@@ -1,7 +1,8 @@
 package core
 
 import (
-    "log"
+    "image"
+    "image/draw"
     "image/color"
 )
 
@@ -29,21 +30,26 @@ type PPU struct {
     LineSprites []int
 
     Dot uint16
-    Screen [][]color.RGBA
+    // the frame being drawn, swapped with frontBuffer at the start of vblank
+    backBuffer *image.RGBA
+    // the last complete frame
+    frontBuffer *image.RGBA
+    // the colors each shade is drawn with
+    DisplayPalette DisplayPalette
+    // when set the sgb picks the colors instead of DisplayPalette
+    SGB *SGB
     // if the cpu should draw then this channel will have something in it
     Draw chan bool
 
     Debug bool
+    Logger *Logger
 }
 
 func MakePPU() *PPU {
-    screen := make([][]color.RGBA, ScreenHeight)
-    for i := range screen {
-        screen[i] = make([]color.RGBA, ScreenWidth)
-    }
-
     return &PPU{
-        Screen: screen,
+        backBuffer: image.NewRGBA(image.Rect(0, 0, ScreenWidth, ScreenHeight)),
+        frontBuffer: image.NewRGBA(image.Rect(0, 0, ScreenWidth, ScreenHeight)),
+        DisplayPalette: PalettePresets[0],
         VideoRam: make([]uint8, 8192),
         OAM: make([]uint8, ScreenWidth),
         Sprites: make([]Sprite, 40),
@@ -52,6 +58,55 @@ func MakePPU() *PPU {
     }
 }
 
+// the last completed frame. it stays valid until the next frame is completed, at
+// which point the ppu starts drawing into it again
+func (ppu *PPU) Frame() *image.RGBA {
+    return ppu.frontBuffer
+}
+
+// write a pixel on the current line of the frame being drawn
+func (ppu *PPU) setPixel(x uint16, pixel color.RGBA) {
+    offset := int(ppu.LCDY) * ppu.backBuffer.Stride + int(x) * 4
+    pix := ppu.backBuffer.Pix[offset:offset+4:offset+4]
+    pix[0] = pixel.R
+    pix[1] = pixel.G
+    pix[2] = pixel.B
+    pix[3] = pixel.A
+}
+
+// write a shade on the current line, using the given colors unless the sgb colors the screen
+func (ppu *PPU) setShade(x uint16, shade uint8, colors *[4]color.RGBA) {
+    if ppu.SGB != nil {
+        ppu.setPixel(x, ppu.SGB.shadeColor(x, ppu.LCDY, shade))
+        return
+    }
+
+    ppu.setPixel(x, colors[shade])
+}
+
+// apply the sgb screen mask to a finished frame. returns false if the frame should
+// not be shown
+func (ppu *PPU) maskFrame() bool {
+    if ppu.SGB == nil {
+        return true
+    }
+
+    var fill color.RGBA
+    switch ppu.SGB.Mask {
+        case SGBMaskFreeze:
+            return false
+        case SGBMaskBlack:
+            fill = color.RGBA{A: 255}
+        case SGBMaskColor0:
+            fill = ppu.SGB.Palettes[0][0]
+        default:
+            return true
+    }
+
+    draw.Draw(ppu.backBuffer, ppu.backBuffer.Bounds(), image.NewUniform(fill), image.Point{}, draw.Src)
+    return true
+}
+
 type Sprite struct {
     X uint8
     Y uint8
@@ -97,7 +152,7 @@ func (ppu *PPU) WriteVRam(address uint16, value uint8) {
         */
         ppu.VideoRam[address] = value
     } else {
-        log.Printf("PPU: VRAM write out of bounds: %x", address)
+        ppu.Logger.Warn(LogPPU, "vram write out of bounds", "address", Hex(address))
     }
 }
 
@@ -105,13 +160,13 @@ func (ppu *PPU) LoadVRam(address uint16) uint8 {
     if address < uint16(len(ppu.VideoRam)) {
         return ppu.VideoRam[address]
     }
-    log.Printf("PPU: VRAM read out of bounds: %x", address)
+    ppu.Logger.Warn(LogPPU, "vram read out of bounds", "address", Hex(address))
     return 0
 }
 
 func (ppu *PPU) CopyOAM(data []uint8) {
     if len(data) > len(ppu.OAM) {
-        log.Printf("PPU: OAM copy out of bounds: %x", len(data))
+        ppu.Logger.Warn(LogPPU, "oam copy out of bounds", "length", len(data))
         return
     }
 
@@ -124,7 +179,7 @@ func (ppu *PPU) WriteOAM(address uint16, value uint8) {
         // log.Printf("Write oam 0x%x = 0x%x", address, value)
         ppu.OAM[address] = value
     } else {
-        log.Printf("PPU: OAM write out of bounds: %x", address)
+        ppu.Logger.Warn(LogPPU, "oam write out of bounds", "address", Hex(address))
     }
 }
 
@@ -132,6 +187,28 @@ func (ppu *PPU) ReadOAM(address uint16) uint8 {
     return ppu.OAM[address]
 }
 
+// for debuggers: read vram or oam at a bus address without any access checks
+func (ppu *PPU) Peek(address uint16) uint8 {
+    switch {
+        case address >= VRamStart && address < VRamEnd && int(address - VRamStart) < len(ppu.VideoRam):
+            return ppu.VideoRam[address - VRamStart]
+        case address >= OAMStart && address < OAMEnd && int(address - OAMStart) < len(ppu.OAM):
+            return ppu.OAM[address - OAMStart]
+    }
+
+    return 0xff
+}
+
+// for debuggers: write vram or oam at a bus address
+func (ppu *PPU) Poke(address uint16, value uint8) {
+    switch {
+        case address >= VRamStart && address < VRamEnd && int(address - VRamStart) < len(ppu.VideoRam):
+            ppu.VideoRam[address - VRamStart] = value
+        case address >= OAMStart && address < OAMEnd && int(address - OAMStart) < len(ppu.OAM):
+            ppu.OAM[address - OAMStart] = value
+    }
+}
+
 func (ppu *PPU) LargeSpriteMode() bool {
     // bit 2 of LCDControl
     return (ppu.LCDControl & 0x4) != 0
@@ -159,6 +236,7 @@ func bitN(value uint8, bit uint8) uint8 {
 
 type System interface {
     EnableStatInterrupt()
+    EnableVBlank()
 }
 
 // set lower 2 bits of LCDStatus
@@ -186,18 +264,6 @@ func (ppu *PPU) GetPPUMode() uint8 {
     return ppu.LCDStatus & 0b11
 }
 
-var dmgPalette = [4]color.RGBA{
-    {0xbc, 0xe9, 0xbb, 255}, // light green
-    {0x9e, 0xc3, 0x9d, 255}, // dark green
-    {0x60, 0x77, 0x60, 255}, // dark gray
-    {0x2a, 0x34, 0x2a, 255}, // black
-    /*
-    {255, 255, 255, 255}, // white
-    {192, 192, 192, 255}, // light gray
-    {96, 96, 96, 255}, // dark gray
-    {0, 0, 0, 255}, // black
-    */
-}
 
 func (ppu *PPU) GetPalette(palette uint8, colorIndex uint8) uint8 {
     return (palette >> (colorIndex * 2)) & 0b11
@@ -263,7 +329,7 @@ func (ppu *PPU) Run(ppuCycles uint64, system System) {
                     }
 
                     if ppu.Debug && len(ppu.LineSprites) > 0 {
-                        log.Printf("PPU: Found %d sprites on line %d", len(ppu.LineSprites), ppu.LCDY)
+                        ppu.Logger.Debug(LogPPU, "found sprites", "count", len(ppu.LineSprites), "line", ppu.LCDY)
                     }
                 }
 
@@ -284,6 +350,11 @@ func (ppu *PPU) Run(ppuCycles uint64, system System) {
                             size = 16
                         }
 
+                        if !ppu.GetBackgroundEnabled() {
+                            // without the background the screen is blank behind the sprites
+                            ppu.setShade(x, 0, &ppu.DisplayPalette.Background)
+                        }
+
                         if ppu.GetBackgroundEnabled() {
                             // get background tile index
                             tileMap1AddressBase := ppu.BackgroundTileMapAddress()
@@ -331,9 +402,7 @@ func (ppu *PPU) Run(ppuCycles uint64, system System) {
                             bit := uint8(7 - (offsetX & 7))
                             paletteColor := bitN(lowByte, bit) | (bitN(highByte, bit) << 1)
 
-                            pixelColor := dmgPalette[ppu.GetPalette(ppu.Palette, paletteColor)]
-
-                            ppu.Screen[ppu.LCDY][x] = pixelColor
+                            ppu.setShade(x, ppu.GetPalette(ppu.Palette, paletteColor), &ppu.DisplayPalette.Background)
                         }
 
                         if ppu.ShowWindow() && ppu.LCDY >= ppu.WindowY && x >= uint16(ppu.WindowX) - 7 {
@@ -378,9 +447,7 @@ func (ppu *PPU) Run(ppuCycles uint64, system System) {
                             bit := uint8(7 - (offsetX & 7))
                             paletteColor := bitN(lowByte, bit) | (bitN(highByte, bit) << 1)
 
-                            pixelColor := dmgPalette[ppu.GetPalette(ppu.Palette, paletteColor)]
-
-                            ppu.Screen[ppu.LCDY][x] = pixelColor
+                            ppu.setShade(x, ppu.GetPalette(ppu.Palette, paletteColor), &ppu.DisplayPalette.Background)
                         }
 
                         if ppu.ShowObjects() {
@@ -417,13 +484,10 @@ func (ppu *PPU) Run(ppuCycles uint64, system System) {
                                     paletteColor := bitN(lowByte, bit) | (bitN(highByte, bit) << 1)
 
                                     if paletteColor != 0 {
-                                        var pixelColor color.RGBA
                                         switch sprite.Palette() {
-                                            case 0: pixelColor = dmgPalette[ppu.GetPalette(ppu.ObjPalette0, paletteColor)]
-                                            case 1: pixelColor = dmgPalette[ppu.GetPalette(ppu.ObjPalette1, paletteColor)]
+                                            case 0: ppu.setShade(x, ppu.GetPalette(ppu.ObjPalette0, paletteColor), &ppu.DisplayPalette.Object0)
+                                            case 1: ppu.setShade(x, ppu.GetPalette(ppu.ObjPalette1, paletteColor), &ppu.DisplayPalette.Object1)
                                         }
-
-                                        ppu.Screen[ppu.LCDY][x] = pixelColor
                                     }
                                 }
                             }
@@ -456,6 +520,13 @@ func (ppu *PPU) Run(ppuCycles uint64, system System) {
             ppu.LCDY += 1
 
             if ppu.LCDY == ScreenHeight {
+                // the frame is done, show it and draw the next one into the other buffer
+                if ppu.maskFrame() {
+                    ppu.frontBuffer, ppu.backBuffer = ppu.backBuffer, ppu.frontBuffer
+                }
+
+                system.EnableVBlank()
+
                 select {
                     case ppu.Draw <- true:
                     default:
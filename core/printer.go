@@ -0,0 +1,308 @@
+package core
+
+import (
+    "os"
+    "fmt"
+    "image"
+    "image/png"
+    "image/color"
+    "path/filepath"
+)
+
+// the game boy printer, which is sent packets over the link port
+// https://gbdev.io/pandocs/Gameboy_Printer.html
+//
+// a packet is 0x88 0x33, command, compression, 16-bit length, data, 16-bit checksum
+// of everything after the magic bytes, and then two bytes during which the printer
+// replies with 0x81 and its status
+
+const (
+    PrinterCommandInit = 0x01
+    PrinterCommandPrint = 0x02
+    PrinterCommandData = 0x04
+    PrinterCommandStatus = 0x0f
+)
+
+// status bits
+const (
+    PrinterStatusChecksumError = 0x01
+    PrinterStatusPrinting = 0x02
+    PrinterStatusFull = 0x04
+    PrinterStatusUnprocessed = 0x08
+)
+
+const (
+    printerStateMagic1 = iota
+    printerStateMagic2
+    printerStateCommand
+    printerStateCompression
+    printerStateLengthLow
+    printerStateLengthHigh
+    printerStateData
+    printerStateChecksumLow
+    printerStateChecksumHigh
+    printerStateAlive
+    printerStateStatus
+)
+
+// the printer holds up to 8k of tile data, 20 tiles per row
+const printerBufferSize = 0x2000
+const printerRowBytes = ScreenWidth / 8 * 16
+
+// number of status replies that report the printer as busy after printing
+const printerBusyReplies = 4
+
+type Printer struct {
+    // printouts are written here as png files
+    Directory string
+    Logger *Logger
+
+    state int
+    command uint8
+    compression uint8
+    length uint16
+    data []uint8
+    // sum of the bytes received so far
+    sum uint16
+    checksum uint16
+
+    status uint8
+    busy int
+    // tile data waiting to be printed
+    buffer []uint8
+    // strips printed since the paper was last fed out
+    strips []*image.Gray
+}
+
+func MakePrinter(directory string) *Printer {
+    return &Printer{
+        Directory: directory,
+    }
+}
+
+func (printer *Printer) Exchange(value uint8) uint8 {
+    switch printer.state {
+        case printerStateMagic1:
+            if value == 0x88 {
+                printer.state = printerStateMagic2
+            }
+        case printerStateMagic2:
+            if value == 0x33 {
+                printer.state = printerStateCommand
+            } else {
+                printer.state = printerStateMagic1
+            }
+        case printerStateCommand:
+            printer.command = value
+            printer.sum = uint16(value)
+            printer.data = printer.data[:0]
+            printer.state = printerStateCompression
+        case printerStateCompression:
+            printer.compression = value
+            printer.sum += uint16(value)
+            printer.state = printerStateLengthLow
+        case printerStateLengthLow:
+            printer.length = uint16(value)
+            printer.sum += uint16(value)
+            printer.state = printerStateLengthHigh
+        case printerStateLengthHigh:
+            printer.length |= uint16(value) << 8
+            printer.sum += uint16(value)
+            if printer.length == 0 {
+                printer.state = printerStateChecksumLow
+            } else {
+                printer.state = printerStateData
+            }
+        case printerStateData:
+            printer.data = append(printer.data, value)
+            printer.sum += uint16(value)
+            if len(printer.data) == int(printer.length) {
+                printer.state = printerStateChecksumLow
+            }
+        case printerStateChecksumLow:
+            printer.checksum = uint16(value)
+            printer.state = printerStateChecksumHigh
+        case printerStateChecksumHigh:
+            printer.checksum |= uint16(value) << 8
+            printer.state = printerStateAlive
+            printer.runCommand()
+        case printerStateAlive:
+            printer.state = printerStateStatus
+            return 0x81
+        case printerStateStatus:
+            printer.state = printerStateMagic1
+            return printer.status
+    }
+
+    return 0
+}
+
+func (printer *Printer) runCommand() {
+    if printer.checksum != printer.sum {
+        printer.status |= PrinterStatusChecksumError
+        return
+    }
+    printer.status &^= PrinterStatusChecksumError
+
+    switch printer.command {
+        case PrinterCommandInit:
+            printer.buffer = printer.buffer[:0]
+            printer.status = 0
+            printer.busy = 0
+        case PrinterCommandData:
+            data := printer.data
+            if printer.compression != 0 {
+                data = decompressPrinterData(data)
+            }
+
+            printer.buffer = append(printer.buffer, data...)
+            if len(printer.buffer) >= printerBufferSize {
+                printer.buffer = printer.buffer[:printerBufferSize]
+                printer.status |= PrinterStatusFull
+            }
+
+            // an empty data packet marks the end of the data
+            if len(data) > 0 {
+                printer.status |= PrinterStatusUnprocessed
+            }
+        case PrinterCommandPrint:
+            if len(printer.data) < 4 {
+                printer.status |= PrinterStatusChecksumError
+                return
+            }
+
+            printer.print(printer.data[1], printer.data[2])
+
+            printer.buffer = printer.buffer[:0]
+            printer.status &^= PrinterStatusUnprocessed | PrinterStatusFull
+            printer.status |= PrinterStatusPrinting
+            printer.busy = printerBusyReplies
+        case PrinterCommandStatus:
+            if printer.busy > 0 {
+                printer.busy -= 1
+                if printer.busy == 0 {
+                    printer.status &^= PrinterStatusPrinting
+                }
+            }
+    }
+}
+
+// a byte with bit 7 set repeats the next byte (n & 0x7f) + 2 times, otherwise the
+// next n + 1 bytes are copied as is
+func decompressPrinterData(data []uint8) []uint8 {
+    var out []uint8
+    for i := 0; i < len(data); {
+        control := data[i]
+        i += 1
+
+        if control & 0x80 != 0 {
+            if i >= len(data) {
+                break
+            }
+            for range int(control & 0x7f) + 2 {
+                out = append(out, data[i])
+            }
+            i += 1
+        } else {
+            count := min(int(control) + 1, len(data) - i)
+            out = append(out, data[i:i + count]...)
+            i += count
+        }
+    }
+
+    return out
+}
+
+// turn the buffered tiles into a strip of paper. the high nibble of the margins is
+// the space fed before the strip and the low nibble the space after, where a non-zero
+// margin after means the printout is finished
+func (printer *Printer) print(margins uint8, palette uint8) {
+    rows := len(printer.buffer) / printerRowBytes
+    if rows > 0 {
+        // some games leave the palette at 0 to mean the usual one
+        if palette == 0 {
+            palette = 0xe4
+        }
+
+        shades := [4]uint8{255, 170, 85, 0}
+        strip := image.NewGray(image.Rect(0, 0, ScreenWidth, rows * 8))
+
+        for tile := range rows * ScreenWidth / 8 {
+            tileX := tile % (ScreenWidth / 8)
+            tileY := tile / (ScreenWidth / 8)
+            data := printer.buffer[tile * 16:]
+
+            for y := range 8 {
+                low := data[y * 2]
+                high := data[y * 2 + 1]
+                for x := range 8 {
+                    index := bitN(low, uint8(7 - x)) | bitN(high, uint8(7 - x)) << 1
+                    shade := (palette >> (index * 2)) & 0b11
+                    strip.SetGray(tileX * 8 + x, tileY * 8 + y, color.Gray{Y: shades[shade]})
+                }
+            }
+        }
+
+        printer.strips = append(printer.strips, strip)
+    }
+
+    if margins & 0xf != 0 {
+        printer.Flush()
+    }
+}
+
+// write out the strips printed so far as one png
+func (printer *Printer) Flush() {
+    if len(printer.strips) == 0 {
+        return
+    }
+
+    height := 0
+    for _, strip := range printer.strips {
+        height += strip.Bounds().Dy()
+    }
+
+    out := image.NewGray(image.Rect(0, 0, ScreenWidth, height))
+    y := 0
+    for _, strip := range printer.strips {
+        copy(out.Pix[y * out.Stride:], strip.Pix)
+        y += strip.Bounds().Dy()
+    }
+    printer.strips = nil
+
+    err := printer.save(out)
+    if err != nil {
+        printer.Logger.Error(LogIO, "unable to save printout", "error", err)
+    }
+}
+
+func (printer *Printer) SetLogger(logger *Logger) {
+    printer.Logger = logger
+}
+
+func (printer *Printer) save(printout image.Image) error {
+    err := os.MkdirAll(printer.Directory, 0755)
+    if err != nil {
+        return err
+    }
+
+    // don't overwrite printouts from earlier runs. any error other than the file
+    // already existing would happen for every name, so give up on it
+    var path string
+    var file *os.File
+    for i := 1; ; i++ {
+        path = filepath.Join(printer.Directory, fmt.Sprintf("printout-%03d.png", i))
+        file, err = os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0644)
+        if err == nil {
+            break
+        }
+        if !os.IsExist(err) {
+            return err
+        }
+    }
+    defer file.Close()
+
+    printer.Logger.Info(LogIO, "saving printout", "path", path)
+
+    return png.Encode(file, printout)
+}
@@ -0,0 +1,76 @@
+package core
+
+// something plugged into the link port. the game boy and the device shift a byte
+// into each other at the same time
+type SerialDevice interface {
+    // receive a byte from the game boy and return the byte sent back
+    Exchange(value uint8) uint8
+}
+
+// a serial device that logs, such as the printer, gets the cpu's logger
+type loggingDevice interface {
+    SetLogger(logger *Logger)
+}
+
+// plug a device into the link port, or unplug it with nil
+func (cpu *CPU) AttachSerial(device SerialDevice) {
+    cpu.Serial = device
+    if logging, ok := device.(loggingDevice); ok {
+        logging.SetLogger(cpu.Logger)
+    }
+}
+
+// machine cycles to shift out a byte at 8192hz, or 262144hz with the cgb fast clock
+const serialTransferCycles = 8 * 128
+const serialFastTransferCycles = 8 * 4
+
+// SC was written, start a transfer if bit 7 is set and this side drives the clock
+func (cpu *CPU) writeSerialControl(value uint8) {
+    cpu.SerialControl = value
+
+    if value & 0x80 == 0 {
+        cpu.serialCycles = 0
+        return
+    }
+
+    // with an external clock the transfer waits for the other game boy, which never
+    // comes since nothing emulates one
+    if value & 0x1 == 0 {
+        return
+    }
+
+    cpu.serialCycles = serialTransferCycles
+    if cpu.CGB && value & 0x2 != 0 {
+        cpu.serialCycles = serialFastTransferCycles
+    }
+}
+
+func (cpu *CPU) readSerialControl() uint8 {
+    if cpu.CGB {
+        return cpu.SerialControl | 0b0111_1100
+    }
+    return cpu.SerialControl | 0b0111_1110
+}
+
+// run an in-progress serial transfer for some number of machine cycles
+func (cpu *CPU) runSerial(cycles uint64) {
+    if cpu.serialCycles == 0 {
+        return
+    }
+
+    if cycles < cpu.serialCycles {
+        cpu.serialCycles -= cycles
+        return
+    }
+    cpu.serialCycles = 0
+
+    // with nothing connected the line is pulled high
+    received := uint8(0xff)
+    if cpu.Serial != nil {
+        received = cpu.Serial.Exchange(cpu.SerialData)
+    }
+
+    cpu.SerialData = received
+    cpu.SerialControl &= 0b0111_1111
+    cpu.InterruptFlag |= 0b01000
+}
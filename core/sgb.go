@@ -0,0 +1,509 @@
+package core
+
+import (
+    "image"
+    "image/color"
+)
+
+// super game boy support. the game talks to the snes by sending 16 byte packets
+// through the joypad register, one bit per pulse of P14 or P15
+// https://gbdev.io/pandocs/SGB_Functions.html
+
+const SGBBorderWidth = 256
+const SGBBorderHeight = 224
+
+// where the game boy screen sits inside the border
+const SGBScreenX = (SGBBorderWidth - ScreenWidth) / 2
+const SGBScreenY = (SGBBorderHeight - ScreenHeight) / 2
+
+// the screen is colored in 8x8 cells
+const sgbCellsWide = ScreenWidth / 8
+const sgbCellsHigh = ScreenHeight / 8
+
+const (
+    SGBCommandPal01 = 0x00
+    SGBCommandPal23 = 0x01
+    SGBCommandPal03 = 0x02
+    SGBCommandPal12 = 0x03
+    SGBCommandAttrBlock = 0x04
+    SGBCommandAttrLine = 0x05
+    SGBCommandAttrDivide = 0x06
+    SGBCommandAttrChr = 0x07
+    SGBCommandPalSet = 0x0a
+    SGBCommandPalTransfer = 0x0b
+    SGBCommandMultiplayer = 0x11
+    SGBCommandChrTransfer = 0x13
+    SGBCommandPctTransfer = 0x14
+    SGBCommandAttrTransfer = 0x15
+    SGBCommandAttrSet = 0x16
+    SGBCommandMask = 0x17
+)
+
+// MASK_EN modes
+const (
+    SGBMaskNone = 0
+    // keep showing the last frame
+    SGBMaskFreeze = 1
+    SGBMaskBlack = 2
+    // fill the screen with color 0
+    SGBMaskColor0 = 3
+)
+
+// the palette the snes starts up with, the same as sgb palette 1-A
+var sgbDefaultPalette = [4]color.RGBA{
+    {0xf8, 0xe8, 0xc8, 255},
+    {0xd8, 0x90, 0x48, 255},
+    {0xa8, 0x28, 0x20, 255},
+    {0x30, 0x18, 0x50, 255},
+}
+
+type SGB struct {
+    // the four palettes used on the game boy screen
+    Palettes [4][4]color.RGBA
+    // the palette of each 8x8 cell of the screen
+    Attributes [sgbCellsHigh][sgbCellsWide]uint8
+    Mask uint8
+
+    // 512 palettes loaded by PAL_TRN, picked from with PAL_SET
+    systemPalettes [512][4]color.RGBA
+    // 45 attribute files loaded by ATTR_TRN, 90 bytes each
+    attributeFiles [45 * 90]uint8
+    // 256 4bpp border tiles loaded by CHR_TRN
+    borderTiles [256 * 32]uint8
+    // 32x32 tile map followed by the border palettes, loaded by PCT_TRN
+    borderMap [0x880]uint8
+    border *image.RGBA
+    // the color 0 the border was drawn with
+    backdrop color.RGBA
+    // incremented whenever the border changes
+    BorderVersion int
+
+    // packet being received
+    packet [16]uint8
+    bit int
+    receiving bool
+    // a bit was just sent and P14/P15 have to go high again before the next one
+    waitIdle bool
+    // the packets of a command received so far
+    command []uint8
+
+    // MLT_REQ, number of joypads and the one being read
+    players uint8
+    player uint8
+    // last value written to P14/P15
+    selection uint8
+}
+
+func MakeSGB() *SGB {
+    sgb := &SGB{
+        players: 1,
+        selection: 0x30,
+        border: image.NewRGBA(image.Rect(0, 0, SGBBorderWidth, SGBBorderHeight)),
+    }
+
+    for i := range sgb.Palettes {
+        sgb.Palettes[i] = sgbDefaultPalette
+    }
+
+    sgb.renderBorder()
+
+    return sgb
+}
+
+// convert a snes 15-bit bgr color
+func sgbColor(low uint8, high uint8) color.RGBA {
+    value := uint16(low) | uint16(high) << 8
+    expand := func(c uint16) uint8 {
+        return uint8(c << 3 | c >> 2)
+    }
+    return color.RGBA{
+        R: expand(value & 0x1f),
+        G: expand((value >> 5) & 0x1f),
+        B: expand((value >> 10) & 0x1f),
+        A: 255,
+    }
+}
+
+// the color of a shade at a position on the screen
+func (sgb *SGB) shadeColor(x uint16, y uint8, shade uint8) color.RGBA {
+    return sgb.Palettes[sgb.Attributes[y / 8][x / 8]][shade]
+}
+
+// the border with the area behind the game boy screen filled in with color 0
+func (sgb *SGB) Border() *image.RGBA {
+    return sgb.border
+}
+
+// called on each write to the joypad register. the ppu is needed by the commands that
+// copy data out of vram
+func (sgb *SGB) WriteJoypad(value uint8, ppu *PPU) {
+    value &= 0x30
+
+    // the next joypad is selected when the lines go back to idle
+    if sgb.players > 1 && value == 0x30 && sgb.selection != 0x30 {
+        sgb.player = (sgb.player + 1) % sgb.players
+    }
+    sgb.selection = value
+
+    switch value {
+        case 0x00:
+            // reset pulse, a new packet starts
+            sgb.receiving = true
+            sgb.waitIdle = true
+            sgb.bit = 0
+            sgb.packet = [16]uint8{}
+        case 0x30:
+            sgb.waitIdle = false
+        case 0x10, 0x20:
+            if !sgb.receiving || sgb.waitIdle {
+                return
+            }
+            sgb.waitIdle = true
+
+            // P14 low sends a 0, P15 low sends a 1
+            if sgb.bit == 128 {
+                // the stop bit
+                sgb.receiving = false
+                sgb.receivePacket(ppu)
+                return
+            }
+
+            if value == 0x10 {
+                sgb.packet[sgb.bit / 8] |= 1 << (sgb.bit % 8)
+            }
+            sgb.bit += 1
+    }
+}
+
+// the joypad register as the game sees it. with more than one joypad the id of the
+// current one shows up when neither row is selected
+func (sgb *SGB) ReadJoypad(value uint8) uint8 {
+    if sgb.players > 1 {
+        if sgb.selection == 0x30 {
+            return (value & 0xf0) | (0xf - sgb.player)
+        }
+        if sgb.player != 0 {
+            // nothing is plugged into the other ports
+            return value | 0xf
+        }
+    }
+
+    return value
+}
+
+func (sgb *SGB) receivePacket(ppu *PPU) {
+    sgb.command = append(sgb.command, sgb.packet[:]...)
+
+    // the low 3 bits of the first byte are the number of packets in the command
+    length := int(sgb.command[0] & 0b111)
+    if length == 0 {
+        length = 1
+    }
+
+    if len(sgb.command) >= length * 16 {
+        sgb.runCommand(sgb.command[0] >> 3, sgb.command, ppu)
+        sgb.command = nil
+    }
+}
+
+// set color 0 of every palette and colors 1-3 of two of them
+func (sgb *SGB) setPalettes(first int, second int, data []uint8) {
+    color0 := sgbColor(data[1], data[2])
+    for i := range sgb.Palettes {
+        sgb.Palettes[i][0] = color0
+    }
+
+    for i := range 3 {
+        sgb.Palettes[first][i + 1] = sgbColor(data[3 + i * 2], data[4 + i * 2])
+        sgb.Palettes[second][i + 1] = sgbColor(data[9 + i * 2], data[10 + i * 2])
+    }
+}
+
+func (sgb *SGB) attrBlock(data []uint8) {
+    count := int(data[1])
+    for set := range count {
+        offset := 2 + set * 6
+        if offset + 6 > len(data) {
+            break
+        }
+
+        control := data[offset] & 0b111
+        inside := data[offset + 1] & 0b11
+        line := (data[offset + 1] >> 2) & 0b11
+        outside := (data[offset + 1] >> 4) & 0b11
+        x1 := int(data[offset + 2] & 0x1f)
+        y1 := int(data[offset + 3] & 0x1f)
+        x2 := int(data[offset + 4] & 0x1f)
+        y2 := int(data[offset + 5] & 0x1f)
+
+        // changing only the inside or only the outside also changes the surrounding line
+        switch control {
+            case 0b001:
+                control = 0b011
+                line = inside
+            case 0b100:
+                control = 0b110
+                line = outside
+        }
+
+        for y := range sgbCellsHigh {
+            for x := range sgbCellsWide {
+                switch {
+                    case x > x1 && x < x2 && y > y1 && y < y2:
+                        if control & 0b001 != 0 {
+                            sgb.Attributes[y][x] = inside
+                        }
+                    case x >= x1 && x <= x2 && y >= y1 && y <= y2:
+                        if control & 0b010 != 0 {
+                            sgb.Attributes[y][x] = line
+                        }
+                    default:
+                        if control & 0b100 != 0 {
+                            sgb.Attributes[y][x] = outside
+                        }
+                }
+            }
+        }
+    }
+}
+
+func (sgb *SGB) attrLine(data []uint8) {
+    count := int(data[1])
+    for i := range count {
+        if 2 + i >= len(data) {
+            break
+        }
+
+        value := data[2 + i]
+        line := int(value & 0x1f)
+        palette := (value >> 5) & 0b11
+
+        if value & 0x80 != 0 {
+            // a row
+            if line < sgbCellsHigh {
+                for x := range sgbCellsWide {
+                    sgb.Attributes[line][x] = palette
+                }
+            }
+        } else {
+            // a column
+            if line < sgbCellsWide {
+                for y := range sgbCellsHigh {
+                    sgb.Attributes[y][line] = palette
+                }
+            }
+        }
+    }
+}
+
+func (sgb *SGB) attrDivide(data []uint8) {
+    after := data[1] & 0b11
+    before := (data[1] >> 2) & 0b11
+    line := (data[1] >> 4) & 0b11
+    horizontal := data[1] & 0x40 != 0
+    position := int(data[2] & 0x1f)
+
+    for y := range sgbCellsHigh {
+        for x := range sgbCellsWide {
+            coordinate := x
+            if horizontal {
+                coordinate = y
+            }
+
+            switch {
+                case coordinate < position: sgb.Attributes[y][x] = before
+                case coordinate == position: sgb.Attributes[y][x] = line
+                default: sgb.Attributes[y][x] = after
+            }
+        }
+    }
+}
+
+func (sgb *SGB) attrChr(data []uint8) {
+    x := int(data[1])
+    y := int(data[2])
+    count := int(data[3]) | int(data[4]) << 8
+    vertical := data[5] == 1
+
+    for i := range count {
+        offset := 6 + i / 4
+        if offset >= len(data) || x >= sgbCellsWide || y >= sgbCellsHigh {
+            break
+        }
+
+        // 4 palettes per byte, starting at the high bits
+        sgb.Attributes[y][x] = (data[offset] >> (6 - (i % 4) * 2)) & 0b11
+
+        if vertical {
+            y += 1
+            if y == sgbCellsHigh {
+                y = 0
+                x += 1
+            }
+        } else {
+            x += 1
+            if x == sgbCellsWide {
+                x = 0
+                y += 1
+            }
+        }
+    }
+}
+
+// load one of the attribute files sent with ATTR_TRN
+func (sgb *SGB) attrSet(file int) {
+    if file >= 45 {
+        return
+    }
+
+    data := sgb.attributeFiles[file * 90:]
+    for i := range sgbCellsWide * sgbCellsHigh {
+        sgb.Attributes[i / sgbCellsWide][i % sgbCellsWide] = (data[i / 4] >> (6 - (i % 4) * 2)) & 0b11
+    }
+}
+
+func (sgb *SGB) palSet(data []uint8) {
+    for i := range sgb.Palettes {
+        index := (int(data[1 + i * 2]) | int(data[2 + i * 2]) << 8) & 0x1ff
+        sgb.Palettes[i] = sgb.systemPalettes[index]
+    }
+
+    if data[9] & 0x80 != 0 {
+        sgb.attrSet(int(data[9] & 0x3f))
+    }
+
+    if data[9] & 0x40 != 0 {
+        sgb.Mask = SGBMaskNone
+    }
+}
+
+func (sgb *SGB) palTransfer(vram []uint8) {
+    for i := range sgb.systemPalettes {
+        for c := range 4 {
+            offset := i * 8 + c * 2
+            sgb.systemPalettes[i][c] = sgbColor(vram[offset], vram[offset + 1])
+        }
+    }
+}
+
+// draw the border from the transferred tiles and map
+func (sgb *SGB) renderBorder() {
+    // the backdrop shows through color 0
+    backdrop := sgb.Palettes[0][0]
+    sgb.backdrop = backdrop
+
+    for tileY := range SGBBorderHeight / 8 {
+        for tileX := range SGBBorderWidth / 8 {
+            entry := int(sgb.borderMap[(tileY * 32 + tileX) * 2]) | int(sgb.borderMap[(tileY * 32 + tileX) * 2 + 1]) << 8
+            tile := sgb.borderTiles[(entry & 0xff) * 32:]
+            // palettes 4-7 are stored after the map
+            palette := ((entry >> 10) & 0b111) % 4
+            xFlip := entry & 0x4000 != 0
+            yFlip := entry & 0x8000 != 0
+
+            for y := range 8 {
+                row := y
+                if yFlip {
+                    row = 7 - y
+                }
+
+                for x := range 8 {
+                    bit := 7 - x
+                    if xFlip {
+                        bit = x
+                    }
+
+                    // 4 bitplanes, the first two interleaved like game boy tiles and the
+                    // other two 16 bytes later
+                    index := (tile[row * 2] >> bit) & 1 |
+                             ((tile[row * 2 + 1] >> bit) & 1) << 1 |
+                             ((tile[16 + row * 2] >> bit) & 1) << 2 |
+                             ((tile[16 + row * 2 + 1] >> bit) & 1) << 3
+
+                    pixel := backdrop
+                    if index != 0 {
+                        offset := 0x800 + palette * 32 + int(index) * 2
+                        pixel = sgbColor(sgb.borderMap[offset], sgb.borderMap[offset + 1])
+                    }
+
+                    sgb.border.SetRGBA(tileX * 8 + x, tileY * 8 + y, pixel)
+                }
+            }
+        }
+    }
+
+    sgb.BorderVersion += 1
+}
+
+func (sgb *SGB) runCommand(command uint8, data []uint8, ppu *PPU) {
+    switch command {
+        case SGBCommandPal01: sgb.setPalettes(0, 1, data)
+        case SGBCommandPal23: sgb.setPalettes(2, 3, data)
+        case SGBCommandPal03: sgb.setPalettes(0, 3, data)
+        case SGBCommandPal12: sgb.setPalettes(1, 2, data)
+        case SGBCommandAttrBlock: sgb.attrBlock(data)
+        case SGBCommandAttrLine: sgb.attrLine(data)
+        case SGBCommandAttrDivide: sgb.attrDivide(data)
+        case SGBCommandAttrChr: sgb.attrChr(data)
+        case SGBCommandPalSet: sgb.palSet(data)
+        case SGBCommandAttrSet:
+            sgb.attrSet(int(data[1] & 0x3f))
+            if data[1] & 0x40 != 0 {
+                sgb.Mask = SGBMaskNone
+            }
+        case SGBCommandMask:
+            sgb.Mask = data[1] & 0b11
+        case SGBCommandMultiplayer:
+            switch data[1] & 0b11 {
+                case 1: sgb.players = 2
+                case 3: sgb.players = 4
+                default: sgb.players = 1
+            }
+            sgb.player = 0
+        case SGBCommandPalTransfer, SGBCommandChrTransfer, SGBCommandPctTransfer, SGBCommandAttrTransfer:
+            sgb.transfer(command, data, ppu)
+        default:
+            ppu.Logger.Warn(LogIO, "unhandled sgb command", "command", Hex(command))
+    }
+
+    // PAL01-PAL12 and PAL_SET can change color 0, which is behind the border too
+    if sgb.Palettes[0][0] != sgb.backdrop {
+        sgb.renderBorder()
+    }
+}
+
+// VRAM transfers send 4k of data by showing it on the screen. the first 256 tiles of the
+// background map, read left to right and top to bottom, hold the data
+func (ppu *PPU) transferData() []uint8 {
+    data := make([]uint8, 0x1000)
+    mapBase := ppu.BackgroundTileMapAddress()
+
+    for i := range 256 {
+        tileIndex := ppu.VideoRam[mapBase + uint16(i / 20) * 32 + uint16(i % 20)]
+
+        address := ppu.backgroundTileAddress(tileIndex)
+        copy(data[i * 16:i * 16 + 16], ppu.VideoRam[address:address + 16])
+    }
+
+    return data
+}
+
+// finish a command that copies data out of vram
+func (sgb *SGB) transfer(command uint8, data []uint8, ppu *PPU) {
+    vram := ppu.transferData()
+
+    switch command {
+        case SGBCommandPalTransfer:
+            sgb.palTransfer(vram)
+        case SGBCommandChrTransfer:
+            // tiles 0x00-0x7f or 0x80-0xff
+            offset := int(data[1] & 1) * 0x1000
+            copy(sgb.borderTiles[offset:offset + 0x1000], vram)
+            sgb.renderBorder()
+        case SGBCommandPctTransfer:
+            copy(sgb.borderMap[:], vram)
+            sgb.renderBorder()
+        case SGBCommandAttrTransfer:
+            copy(sgb.attributeFiles[:], vram)
+    }
+}
@@ -0,0 +1,32 @@
+package core
+
+import (
+    "testing"
+)
+
+// the border shows color 0 where its tiles are clear, so it follows PAL01
+func TestSGBBorderBackdrop(test *testing.T) {
+    sgb := MakeSGB()
+    version := sgb.BorderVersion
+
+    data := make([]uint8, 16)
+    data[0] = SGBCommandPal01 << 3 | 1
+    // color 0 is pure red
+    data[1] = 0x1f
+    sgb.runCommand(SGBCommandPal01, data, nil)
+
+    pixel := sgb.Border().RGBAAt(0, 0)
+    if pixel != sgbColor(0x1f, 0) {
+        test.Errorf("the backdrop is %v after PAL01, expected %v", pixel, sgbColor(0x1f, 0))
+    }
+    if sgb.BorderVersion == version {
+        test.Errorf("the border version did not change")
+    }
+
+    // the same color 0 again doesn't need the border drawn again
+    version = sgb.BorderVersion
+    sgb.runCommand(SGBCommandPal01, data, nil)
+    if sgb.BorderVersion != version {
+        test.Errorf("the border was drawn again for the same backdrop")
+    }
+}
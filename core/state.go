@@ -0,0 +1,284 @@
+package core
+
+import (
+    "fmt"
+    "math"
+    "encoding/binary"
+)
+
+// save states. each part of the system lists its state once in a serialize method,
+// which either writes the values out or reads them back in the same order.
+// the rom, the sgb and anything plugged into the link port are not saved
+
+const stateMagic = "GBST"
+const stateVersion = 1
+
+type stateBuffer struct {
+    data []byte
+    // reading the values back instead of writing them
+    loading bool
+    err error
+}
+
+func (state *stateBuffer) take(size int) []byte {
+    if state.err != nil {
+        return nil
+    }
+
+    if len(state.data) < size {
+        state.err = fmt.Errorf("save state is too short")
+        return nil
+    }
+
+    out := state.data[:size]
+    state.data = state.data[size:]
+    return out
+}
+
+func (state *stateBuffer) uint64(value *uint64) {
+    if state.loading {
+        data := state.take(8)
+        if data != nil {
+            *value = binary.LittleEndian.Uint64(data)
+        }
+    } else {
+        state.data = binary.LittleEndian.AppendUint64(state.data, *value)
+    }
+}
+
+// the bytes of a slice whose length is fixed, like ram
+func (state *stateBuffer) bytes(value []uint8) {
+    length := uint64(len(value))
+    state.uint64(&length)
+
+    if state.loading {
+        if state.err == nil && length != uint64(len(value)) {
+            state.err = fmt.Errorf("save state has %v bytes where %v were expected", length, len(value))
+            return
+        }
+        data := state.take(len(value))
+        if data != nil {
+            copy(value, data)
+        }
+    } else {
+        state.data = append(state.data, value...)
+    }
+}
+
+// save or load each value, which has to be a pointer to one of the types below
+func (state *stateBuffer) values(values ...any) {
+    for _, value := range values {
+        switch value := value.(type) {
+            case *bool:
+                var out uint64
+                if *value {
+                    out = 1
+                }
+                state.uint64(&out)
+                *value = out != 0
+            case *uint8:
+                out := uint64(*value)
+                state.uint64(&out)
+                *value = uint8(out)
+            case *int8:
+                out := uint64(*value)
+                state.uint64(&out)
+                *value = int8(out)
+            case *uint16:
+                out := uint64(*value)
+                state.uint64(&out)
+                *value = uint16(out)
+            case *uint32:
+                out := uint64(*value)
+                state.uint64(&out)
+                *value = uint32(out)
+            case *uint64:
+                state.uint64(value)
+            case *int:
+                out := uint64(*value)
+                state.uint64(&out)
+                *value = int(out)
+            case *float32:
+                out := uint64(math.Float32bits(*value))
+                state.uint64(&out)
+                *value = math.Float32frombits(uint32(out))
+            default:
+                panic(fmt.Sprintf("save state: unhandled type %T", value))
+        }
+    }
+}
+
+// implemented by the parts of the system that have state to save
+type stateful interface {
+    serialize(state *stateBuffer)
+}
+
+func (joypad *Joypad) serialize(state *stateBuffer) {
+    state.values(&joypad.Up, &joypad.Down, &joypad.Left, &joypad.Right, &joypad.A, &joypad.B, &joypad.Start, &joypad.Select)
+    state.values(&joypad.ReadButtons, &joypad.ReadDpad, &joypad.lines, &joypad.interrupt)
+}
+
+func (cpu *CPU) serialize(state *stateBuffer) {
+    state.values(&cpu.A, &cpu.F, &cpu.BC, &cpu.DE, &cpu.HL, &cpu.SP, &cpu.PC, &cpu.Cycles)
+    cpu.Joypad.serialize(state)
+    state.values(&cpu.InterruptMasterFlag, &cpu.enableInterruptsDelay, &cpu.InterruptFlag, &cpu.InterruptEnable)
+    state.values(&cpu.Timer, &cpu.TimerDivider, &cpu.TimerModulo, &cpu.TimerEnable, &cpu.TimerClockSelect, &cpu.timerOverflow)
+    state.values(&cpu.dmaRegister, &cpu.dmaSource, &cpu.dmaIndex, &cpu.dmaActive, &cpu.dmaDelay)
+    state.values(&cpu.Stopped, &cpu.Halted, &cpu.CGB, &cpu.SpeedSwitchArmed, &cpu.DoubleSpeed)
+    state.values(&cpu.SerialData, &cpu.SerialControl, &cpu.serialCycles)
+    state.bytes(cpu.Ram)
+    state.bytes(cpu.HighRam)
+
+    cpu.PPU.serialize(state)
+    cpu.APU.serialize(state)
+
+    if mbc, ok := cpu.MBC.(stateful); ok {
+        mbc.serialize(state)
+    }
+}
+
+func (ppu *PPU) serialize(state *stateBuffer) {
+    state.values(&ppu.ViewPortX, &ppu.ViewPortY, &ppu.WindowX, &ppu.WindowY)
+    state.values(&ppu.Palette, &ppu.ObjPalette0, &ppu.ObjPalette1)
+    state.values(&ppu.LCDStatus, &ppu.LCDControl, &ppu.LCDY, &ppu.LCDYCompare, &ppu.Dot)
+    state.bytes(ppu.VideoRam)
+    state.bytes(ppu.OAM)
+
+    for i := range ppu.Sprites {
+        sprite := &ppu.Sprites[i]
+        state.values(&sprite.X, &sprite.Y, &sprite.TileIndex, &sprite.Attributes)
+    }
+
+    // the sprites found on the current line, with a slot for every sprite so that a
+    // state is always the same size
+    count := len(ppu.LineSprites)
+    state.values(&count)
+    lineSprites := make([]int, len(ppu.Sprites))
+    copy(lineSprites, ppu.LineSprites)
+    for i := range lineSprites {
+        state.values(&lineSprites[i])
+    }
+
+    if state.loading && state.err == nil {
+        if count < 0 || count > len(lineSprites) {
+            state.err = fmt.Errorf("save state has %v sprites on a line", count)
+            return
+        }
+        ppu.LineSprites = append(ppu.LineSprites[:0], lineSprites[:count]...)
+    }
+}
+
+func (length *lengthCounter) serialize(state *stateBuffer) {
+    state.values(&length.LengthEnable, &length.Length)
+}
+
+func (envelope *envelope) serialize(state *stateBuffer) {
+    state.values(&envelope.Volume, &envelope.InitialVolume, &envelope.EnvelopeDirection, &envelope.EnvelopeSweep, &envelope.envelopeTimer)
+}
+
+func (pulse *Pulse) serialize(state *stateBuffer) {
+    state.values(&pulse.Enabled, &pulse.PanLeft, &pulse.PanRight)
+    pulse.lengthCounter.serialize(state)
+    pulse.envelope.serialize(state)
+    state.values(&pulse.Duty, &pulse.DutyIndex, &pulse.Period, &pulse.PeriodHigh, &pulse.PeriodLow)
+    state.values(&pulse.Pace, &pulse.Direction, &pulse.Step)
+    state.values(&pulse.sweepShadow, &pulse.sweepTimer, &pulse.sweepEnabled, &pulse.sweepNegated, &pulse.cycles)
+}
+
+func (wave *Wave) serialize(state *stateBuffer) {
+    state.values(&wave.Enabled, &wave.PanLeft, &wave.PanRight, &wave.DACEnabled, &wave.PeriodLow, &wave.PeriodHigh)
+    wave.lengthCounter.serialize(state)
+    state.values(&wave.Volume)
+    state.bytes(wave.samples)
+    state.values(&wave.sampleIndex, &wave.frequency, &wave.frequencyTimer)
+}
+
+func (noise *Noise) serialize(state *stateBuffer) {
+    state.values(&noise.Enabled, &noise.PanLeft, &noise.PanRight)
+    noise.envelope.serialize(state)
+    noise.lengthCounter.serialize(state)
+    state.values(&noise.LastBit, &noise.ClockShift, &noise.LFSR, &noise.LFSRLength, &noise.ClockDivider, &noise.frequencyTimer)
+}
+
+func (blip *blipBuffer) serialize(state *stateBuffer) {
+    for i := range blip.deltas {
+        state.values(&blip.deltas[i])
+    }
+    state.values(&blip.integrator, &blip.amplitude)
+}
+
+func (apu *APU) serialize(state *stateBuffer) {
+    state.values(&apu.counter, &apu.MasterEnabled, &apu.LeftVolume, &apu.RightVolume, &apu.vin, &apu.SampleCounter, &apu.frameStep)
+    apu.Pulse1.serialize(state)
+    apu.Pulse2.serialize(state)
+    apu.Wave.serialize(state)
+    apu.Noise.serialize(state)
+    state.bytes(apu.registers[:])
+
+    apu.leftBlip.serialize(state)
+    apu.rightBlip.serialize(state)
+    state.values(&apu.leftFilter.capacitor, &apu.rightFilter.capacitor)
+}
+
+func (mbc1 *MBC1) serialize(state *stateBuffer) {
+    state.values(&mbc1.romBank, &mbc1.ramBank, &mbc1.ramEnabled, &mbc1.mode)
+    state.bytes(mbc1.ram)
+}
+
+func (mbc2 *MBC2) serialize(state *stateBuffer) {
+    state.values(&mbc2.romBank, &mbc2.ramEnable)
+    state.bytes(mbc2.ram)
+}
+
+func (mbc3 *MBC3) serialize(state *stateBuffer) {
+    state.values(&mbc3.ramEnabled, &mbc3.ramBank, &mbc3.romBank, &mbc3.rtc)
+    state.bytes(mbc3.ram)
+    state.bytes(mbc3.rtcValues)
+}
+
+// the state of the whole system. states of the same rom are always the same size
+func (cpu *CPU) SaveState() []byte {
+    state := stateBuffer{data: []byte(stateMagic)}
+    version := uint64(stateVersion)
+    state.uint64(&version)
+    cpu.serialize(&state)
+    return state.data
+}
+
+// restore a state made by SaveState for the same rom
+func (cpu *CPU) LoadState(data []byte) error {
+    if len(data) < len(stateMagic) || string(data[:len(stateMagic)]) != stateMagic {
+        return fmt.Errorf("not a save state")
+    }
+
+    state := stateBuffer{data: data[len(stateMagic):], loading: true}
+
+    var version uint64
+    state.uint64(&version)
+    if state.err == nil && version != stateVersion {
+        return fmt.Errorf("save state version %v is not supported", version)
+    }
+
+    // states of a rom are always the same size, so a state of the wrong size is caught
+    // before anything is overwritten
+    current := cpu.SaveState()
+    if len(data) != len(current) {
+        return fmt.Errorf("save state is %v bytes where %v were expected", len(data), len(current))
+    }
+
+    cpu.serialize(&state)
+    if state.err != nil {
+        // a bad value partway through, go back to how things were
+        restore := stateBuffer{data: current[len(stateMagic) + 8:], loading: true}
+        cpu.serialize(&restore)
+        return state.err
+    }
+
+    // a frame that finished before the state was loaded shouldn't be drawn
+    select {
+        case <-cpu.PPU.Draw:
+        default:
+    }
+
+    return nil
+}
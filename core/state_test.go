@@ -0,0 +1,90 @@
+package core
+
+import (
+    "bytes"
+    "testing"
+)
+
+// a cpu running a loop that counts in work ram and copies the count to vram
+func makeStateTestCpu() *CPU {
+    rom := make([]uint8, 0x8000)
+    // LD HL,0xc000; loop: INC (HL); LD A,(HL); LD (0x8000),A; JR loop
+    copy(rom[0x100:], []uint8{0x21, 0x00, 0xc0, 0x34, 0x7e, 0xea, 0x00, 0x80, 0x18, 0xf9})
+    rom[0x147] = 1
+
+    mbc, _ := MakeMBC(1, rom)
+    cpu := MakeCPU(mbc, 44100)
+    cpu.InitializeDMG()
+    return cpu
+}
+
+func TestSaveStateRoundTrip(test *testing.T) {
+    cpu := makeStateTestCpu()
+    machine := MakeMachine(cpu)
+    for range 10 {
+        machine.RunFrame()
+    }
+
+    saved := cpu.SaveState()
+    for range 5 {
+        machine.RunFrame()
+    }
+    after := cpu.SaveState()
+
+    err := cpu.LoadState(saved)
+    if err != nil {
+        test.Fatalf("unable to load state: %v", err)
+    }
+    for range 5 {
+        machine.RunFrame()
+    }
+
+    if !bytes.Equal(cpu.SaveState(), after) {
+        test.Errorf("running on from a loaded state gave a different state")
+    }
+}
+
+// a state that is rejected must not change anything
+func TestLoadBadState(test *testing.T) {
+    cpu := makeStateTestCpu()
+    machine := MakeMachine(cpu)
+    machine.RunFrame()
+
+    saved := cpu.SaveState()
+    machine.RunFrame()
+    before := cpu.SaveState()
+
+    // find where the number of sprites on the current line is kept, which is checked
+    // after the cpu and most of the ppu have been read
+    lineSprites := cpu.PPU.LineSprites
+    cpu.PPU.LineSprites = make([]int, 1)
+    one := cpu.SaveState()
+    cpu.PPU.LineSprites = make([]int, 2)
+    two := cpu.SaveState()
+    cpu.PPU.LineSprites = lineSprites
+
+    badSprites := bytes.Clone(saved)
+    for i := range one {
+        if one[i] != two[i] {
+            badSprites[i] = 100
+            break
+        }
+    }
+
+    states := map[string][]byte{
+        "short": saved[:len(saved) - 1],
+        "long": append(bytes.Clone(saved), 0),
+        "junk": []byte("junk"),
+        "version": append([]byte(stateMagic), 99, 0, 0, 0, 0, 0, 0, 0),
+        "sprites": badSprites,
+    }
+
+    for name, state := range states {
+        if cpu.LoadState(state) == nil {
+            test.Errorf("%v state was loaded", name)
+        }
+        if !bytes.Equal(cpu.SaveState(), before) {
+            test.Errorf("%v state changed the cpu", name)
+        }
+    }
+}
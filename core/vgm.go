@@ -0,0 +1,389 @@
+package core
+
+import (
+    "io"
+    "fmt"
+    "bytes"
+    "bufio"
+    "compress/gzip"
+    "encoding/binary"
+)
+
+// vgm files log the register writes to a sound chip along with the time between
+// them, counted in 44100hz samples. the game boy apu uses command 0xb3
+
+const vgmSampleRate = 44100
+const vgmHeaderSize = 0x100
+const vgmVersion = 0x171
+
+const (
+    vgmCommandWait = 0x61
+    vgmCommandWait735 = 0x62
+    vgmCommandWait882 = 0x63
+    vgmCommandEnd = 0x66
+    vgmCommandDataBlock = 0x67
+    vgmCommandDMGWrite = 0xb3
+)
+
+// header field offsets
+const (
+    vgmEOFOffset = 0x04
+    vgmVersionOffset = 0x08
+    vgmTotalSamplesOffset = 0x18
+    vgmLoopOffset = 0x1c
+    vgmDataOffset = 0x34
+    vgmDMGClockOffset = 0x80
+)
+
+type VGMRecorder struct {
+    commands []byte
+    // the apu clock that corresponds to the start of the recording
+    clockBase int64
+    // apu clocks covered by the recording so far
+    elapsed int64
+    // samples written out with wait commands
+    samples uint64
+}
+
+func MakeVGMRecorder() *VGMRecorder {
+    return &VGMRecorder{}
+}
+
+// attach to an apu whose clock is at 'clock'. time continues from where the recording
+// left off, so the recorder can move to a new apu after a restart
+func (recorder *VGMRecorder) begin(clock uint64, registers [0x30]uint8) {
+    recorder.clockBase = int64(clock) - recorder.elapsed
+
+    // power on first, otherwise the other writes are ignored
+    recorder.command(IOSoundOnOff, registers[IOSoundOnOff - IOSoundChannel1Sweep])
+    recorder.command(IOMasterVolume, registers[IOMasterVolume - IOSoundChannel1Sweep])
+    recorder.command(IOSoundPanning, registers[IOSoundPanning - IOSoundChannel1Sweep])
+
+    for address := uint16(IOWaveFormStart); address <= IOWaveFormEnd; address++ {
+        recorder.command(address, registers[address - IOSoundChannel1Sweep])
+    }
+
+    for address := uint16(IOSoundChannel1Sweep); address <= IOSoundChannel4Control; address++ {
+        value := registers[address - IOSoundChannel1Sweep]
+        switch address {
+            case 0xff15, 0xff1f:
+                // unused
+                continue
+            case IOSoundChannel1PeriodHigh, IOSoundChannel2PeriodHigh, IOSoundChannel3PeriodHigh, IOSoundChannel4Control:
+                // don't retrigger the channels
+                value &= 0b0111_1111
+        }
+
+        recorder.command(address, value)
+    }
+}
+
+// emit wait commands up to the given apu clock
+func (recorder *VGMRecorder) sync(clock uint64) {
+    elapsed := int64(clock) - recorder.clockBase
+    if elapsed < recorder.elapsed {
+        return
+    }
+    recorder.elapsed = elapsed
+
+    target := uint64(elapsed) * vgmSampleRate / CPUSpeed
+    if target > recorder.samples {
+        recorder.wait(target - recorder.samples)
+        recorder.samples = target
+    }
+}
+
+func (recorder *VGMRecorder) wait(samples uint64) {
+    for samples > 0 {
+        switch {
+            case samples == 735:
+                recorder.commands = append(recorder.commands, vgmCommandWait735)
+                samples = 0
+            case samples == 882:
+                recorder.commands = append(recorder.commands, vgmCommandWait882)
+                samples = 0
+            case samples <= 16:
+                // 0x7n waits n+1 samples
+                recorder.commands = append(recorder.commands, 0x70 + uint8(samples - 1))
+                samples = 0
+            default:
+                amount := min(samples, 0xffff)
+                recorder.commands = append(recorder.commands, vgmCommandWait, uint8(amount), uint8(amount >> 8))
+                samples -= amount
+        }
+    }
+}
+
+func (recorder *VGMRecorder) command(address uint16, value uint8) {
+    recorder.commands = append(recorder.commands, vgmCommandDMGWrite, uint8(address - IOSoundChannel1Sweep), value)
+}
+
+// log a write to a sound register at the given apu clock
+func (recorder *VGMRecorder) Write(clock uint64, address uint16, value uint8) {
+    recorder.sync(clock)
+    recorder.command(address, value)
+}
+
+// write the recording as a vgm file
+func (recorder *VGMRecorder) Save(writer io.Writer) error {
+    header := make([]byte, vgmHeaderSize)
+    copy(header, "Vgm ")
+    binary.LittleEndian.PutUint32(header[vgmEOFOffset:], uint32(vgmHeaderSize + len(recorder.commands) + 1 - vgmEOFOffset))
+    binary.LittleEndian.PutUint32(header[vgmVersionOffset:], vgmVersion)
+    binary.LittleEndian.PutUint32(header[vgmTotalSamplesOffset:], uint32(recorder.samples))
+    // offsets are relative to the field they are stored in
+    binary.LittleEndian.PutUint32(header[vgmDataOffset:], vgmHeaderSize - vgmDataOffset)
+    binary.LittleEndian.PutUint32(header[vgmDMGClockOffset:], CPUSpeed)
+
+    _, err := writer.Write(header)
+    if err != nil {
+        return err
+    }
+
+    _, err = writer.Write(recorder.commands)
+    if err != nil {
+        return err
+    }
+
+    _, err = writer.Write([]byte{vgmCommandEnd})
+    return err
+}
+
+type VGMFile struct {
+    Data []byte
+    Version uint32
+    TotalSamples uint32
+    // where the commands start
+    DataOffset int
+    // where playback continues after the end, 0 if the song does not loop
+    LoopOffset int
+    DMGClock uint32
+}
+
+// load a vgm file, or a gzip compressed vgz file
+func LoadVGM(reader io.Reader) (*VGMFile, error) {
+    buffered := bufio.NewReader(reader)
+    magic, err := buffered.Peek(2)
+    if err != nil {
+        return nil, err
+    }
+
+    var input io.Reader = buffered
+    if magic[0] == 0x1f && magic[1] == 0x8b {
+        gzipReader, err := gzip.NewReader(buffered)
+        if err != nil {
+            return nil, err
+        }
+        defer gzipReader.Close()
+        input = gzipReader
+    }
+
+    data, err := io.ReadAll(input)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(data) < 0x40 || !bytes.Equal(data[0:4], []byte("Vgm ")) {
+        return nil, fmt.Errorf("not a vgm file")
+    }
+
+    readField := func(offset int) uint32 {
+        if offset + 4 > len(data) {
+            return 0
+        }
+        return binary.LittleEndian.Uint32(data[offset:])
+    }
+
+    vgm := VGMFile{
+        Data: data,
+        Version: readField(vgmVersionOffset),
+        TotalSamples: readField(vgmTotalSamplesOffset),
+        // versions before 1.50 always start at 0x40
+        DataOffset: 0x40,
+    }
+
+    if vgm.Version >= 0x150 && readField(vgmDataOffset) != 0 {
+        vgm.DataOffset = vgmDataOffset + int(readField(vgmDataOffset))
+    }
+
+    if readField(vgmLoopOffset) != 0 {
+        vgm.LoopOffset = vgmLoopOffset + int(readField(vgmLoopOffset))
+    }
+
+    if vgm.DataOffset > vgmDMGClockOffset {
+        vgm.DMGClock = readField(vgmDMGClockOffset)
+    }
+
+    if vgm.DMGClock == 0 {
+        return nil, fmt.Errorf("vgm file does not use the game boy sound chip")
+    }
+
+    if vgm.DataOffset >= len(data) || vgm.LoopOffset >= len(data) {
+        return nil, fmt.Errorf("invalid vgm data offset")
+    }
+
+    return &vgm, nil
+}
+
+// drives an apu from the register writes in a vgm file
+type VGMPlayer struct {
+    vgm *VGMFile
+    apu *APU
+    position int
+    // restart from the loop point at the end of the song
+    Loop bool
+    Done bool
+
+    // clocks the apu has been run for
+    clock uint64
+    // samples of waiting read from the file, which sets when the next command runs
+    samples uint64
+    // the value of samples the last time the song looped
+    loopSamples uint64
+    // clocks until the next frame sequencer step
+    sequencer uint64
+}
+
+func MakeVGMPlayer(vgm *VGMFile, apu *APU) *VGMPlayer {
+    return &VGMPlayer{
+        vgm: vgm,
+        apu: apu,
+        position: vgm.DataOffset,
+        sequencer: frameSequencerPeriod,
+    }
+}
+
+// the frame sequencer runs at 512hz. without a cpu to drive it from DIV the player clocks it
+const frameSequencerPeriod = CPUSpeed / 512
+
+func (player *VGMPlayer) runAPU(clocks uint64) {
+    player.clock += clocks
+    for clocks > 0 {
+        run := min(clocks, player.sequencer)
+        player.apu.Run(run)
+        clocks -= run
+        player.sequencer -= run
+        if player.sequencer == 0 {
+            player.sequencer = frameSequencerPeriod
+            player.apu.ClockFrameSequencer()
+        }
+    }
+}
+
+// the apu clock at which the next command runs
+func (player *VGMPlayer) nextClock() uint64 {
+    return player.samples * CPUSpeed / vgmSampleRate
+}
+
+func (player *VGMPlayer) readByte() (uint8, bool) {
+    if player.position >= len(player.vgm.Data) {
+        return 0, false
+    }
+
+    value := player.vgm.Data[player.position]
+    player.position += 1
+    return value, true
+}
+
+// skip the operands of a command meant for another chip
+func (player *VGMPlayer) skip(count int) {
+    player.position += count
+}
+
+// run one command, returns false at the end of the song
+func (player *VGMPlayer) step() (bool, error) {
+    command, ok := player.readByte()
+    if !ok {
+        return false, nil
+    }
+
+    switch {
+        case command == vgmCommandDMGWrite:
+            register, _ := player.readByte()
+            value, _ := player.readByte()
+            address := IOSoundChannel1Sweep + uint16(register)
+            if address <= IOWaveFormEnd {
+                player.apu.WriteRegister(address, value)
+            }
+        case command == vgmCommandWait:
+            low, _ := player.readByte()
+            high, _ := player.readByte()
+            player.samples += uint64(low) | uint64(high) << 8
+        case command == vgmCommandWait735:
+            player.samples += 735
+        case command == vgmCommandWait882:
+            player.samples += 882
+        case command >= 0x70 && command <= 0x7f:
+            player.samples += uint64(command & 0xf) + 1
+        case command >= 0x80 && command <= 0x8f:
+            // ym2612 dac write followed by a wait
+            player.samples += uint64(command & 0xf)
+        case command == vgmCommandEnd:
+            return false, nil
+        case command == vgmCommandDataBlock:
+            // 0x67 0x66 type size(32) data
+            player.skip(2)
+            if player.position + 4 > len(player.vgm.Data) {
+                return false, nil
+            }
+            size := binary.LittleEndian.Uint32(player.vgm.Data[player.position:])
+            player.skip(4 + int(size))
+        case command >= 0x30 && command <= 0x3f, command == 0x4f, command == 0x50, command == 0x94:
+            player.skip(1)
+        case command >= 0x40 && command <= 0x4e, command >= 0x51 && command <= 0x5f, command >= 0xa0 && command <= 0xbf:
+            player.skip(2)
+        case command >= 0xc0 && command <= 0xdf:
+            player.skip(3)
+        case command >= 0xe0, command == 0x90, command == 0x91, command == 0x95:
+            player.skip(4)
+        case command == 0x92:
+            player.skip(5)
+        case command == 0x93:
+            player.skip(10)
+        default:
+            return false, fmt.Errorf("unknown vgm command 0x%x at 0x%x", command, player.position - 1)
+    }
+
+    return true, nil
+}
+
+// run the apu for some number of clocks, applying register writes as their time comes
+func (player *VGMPlayer) Run(clocks uint64) error {
+    end := player.clock + clocks
+
+    for player.clock < end {
+        if player.Done {
+            player.runAPU(end - player.clock)
+            break
+        }
+
+        next := player.nextClock()
+        if next > player.clock {
+            player.runAPU(min(next, end) - player.clock)
+            continue
+        }
+
+        more, err := player.step()
+        if err != nil {
+            player.Done = true
+            return err
+        }
+
+        if !more {
+            // a loop with no waits in it would never finish
+            if player.Loop && player.vgm.LoopOffset != 0 && player.samples > player.loopSamples {
+                player.loopSamples = player.samples
+                player.position = player.vgm.LoopOffset
+            } else {
+                player.Done = true
+            }
+        }
+    }
+
+    return nil
+}
+
+// seconds of the song played so far
+func (player *VGMPlayer) Elapsed() float64 {
+    return float64(player.clock) / CPUSpeed
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+    "image"
+    "image/color"
+)
+
+// images of what is in vram and oam, for debugging
+
+// the 384 tiles are drawn 16 to a row
+const TileViewColumns = 16
+const TileViewRows = 384 / TileViewColumns
+
+// the 2 bit color of a pixel of the tile at a vram offset
+func (ppu *PPU) tilePixel(tileAddress uint16, x int, y int) uint8 {
+    low := ppu.VideoRam[tileAddress + uint16(y) * 2]
+    high := ppu.VideoRam[tileAddress + uint16(y) * 2 + 1]
+    bit := uint8(7 - x)
+    return bitN(low, bit) | bitN(high, bit) << 1
+}
+
+// draw a tile with a dmg palette register and the colors it maps to
+func (ppu *PPU) drawTile(out *image.RGBA, tileAddress uint16, left int, top int, palette uint8, colors *[4]color.RGBA, xFlip bool, yFlip bool, transparent bool) {
+    for y := range 8 {
+        for x := range 8 {
+            tileX := x
+            if xFlip {
+                tileX = 7 - x
+            }
+            tileY := y
+            if yFlip {
+                tileY = 7 - y
+            }
+
+            index := ppu.tilePixel(tileAddress, tileX, tileY)
+            if transparent && index == 0 {
+                continue
+            }
+            out.SetRGBA(left + x, top + y, colors[ppu.GetPalette(palette, index)])
+        }
+    }
+}
+
+// all 384 tiles in vram, 0x8000 first, drawn with the background palette
+func (ppu *PPU) RenderTiles() *image.RGBA {
+    out := image.NewRGBA(image.Rect(0, 0, TileViewColumns * 8, TileViewRows * 8))
+    for tile := range 384 {
+        ppu.drawTile(out, uint16(tile) * 16, tile % TileViewColumns * 8, tile / TileViewColumns * 8, ppu.Palette, &ppu.DisplayPalette.Background, false, false, false)
+    }
+
+    return out
+}
+
+// the vram offset of a background or window tile, using the tile data mode from LCDC
+func (ppu *PPU) backgroundTileAddress(tileIndex uint8) uint16 {
+    if ppu.GetBackgroundTileMode() == 0 && tileIndex < 128 {
+        return 0x1000 + uint16(tileIndex) * 16
+    }
+
+    return uint16(tileIndex) * 16
+}
+
+// the whole 256x256 tile map at a vram offset, 0x1800 for 0x9800 or 0x1c00 for 0x9c00
+func (ppu *PPU) RenderTileMap(mapAddress uint16) *image.RGBA {
+    out := image.NewRGBA(image.Rect(0, 0, 256, 256))
+    for y := range 32 {
+        for x := range 32 {
+            tileIndex := ppu.VideoRam[mapAddress + uint16(y * 32 + x)]
+            ppu.drawTile(out, ppu.backgroundTileAddress(tileIndex), x * 8, y * 8, ppu.Palette, &ppu.DisplayPalette.Background, false, false, false)
+        }
+    }
+
+    return out
+}
+
+// the 40 sprites in oam side by side, 8x16 each. 8x8 sprites only use the top half.
+// transparent pixels are left clear
+func (ppu *PPU) RenderSprites() *image.RGBA {
+    out := image.NewRGBA(image.Rect(0, 0, 40 * 8, 16))
+
+    for index, sprite := range ppu.ReadSprites() {
+        palette := ppu.ObjPalette0
+        colors := &ppu.DisplayPalette.Object0
+        if sprite.Palette() == 1 {
+            palette = ppu.ObjPalette1
+            colors = &ppu.DisplayPalette.Object1
+        }
+
+        if ppu.LargeSpriteMode() {
+            top := uint16(sprite.TileIndex & 0xfe) * 16
+            bottom := uint16(sprite.TileIndex | 1) * 16
+            if sprite.YFlipped() {
+                top, bottom = bottom, top
+            }
+            ppu.drawTile(out, top, index * 8, 0, palette, colors, sprite.XFlipped(), sprite.YFlipped(), true)
+            ppu.drawTile(out, bottom, index * 8, 8, palette, colors, sprite.XFlipped(), sprite.YFlipped(), true)
+        } else {
+            ppu.drawTile(out, uint16(sprite.TileIndex) * 16, index * 8, 0, palette, colors, sprite.XFlipped(), sprite.YFlipped(), true)
+        }
+    }
+
+    return out
+}
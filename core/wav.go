@@ -0,0 +1,108 @@
+package core
+
+import (
+    "encoding/binary"
+    "io"
+)
+
+// writes 16-bit stereo pcm samples to a wav file. the header is written up front
+// with a zero length and fixed up when the writer is closed
+type WavWriter struct {
+    writer io.WriteSeeker
+    sampleRate uint32
+    // bytes of sample data written so far
+    dataSize uint32
+    buffer []byte
+}
+
+func MakeWavWriter(writer io.WriteSeeker, sampleRate uint32) (*WavWriter, error) {
+    wav := &WavWriter{
+        writer: writer,
+        sampleRate: sampleRate,
+    }
+
+    err := wav.writeHeader()
+    if err != nil {
+        return nil, err
+    }
+
+    return wav, nil
+}
+
+func (wav *WavWriter) writeHeader() error {
+    const channels = 2
+    const bitsPerSample = 16
+
+    header := make([]byte, 44)
+    copy(header[0:], "RIFF")
+    binary.LittleEndian.PutUint32(header[4:], 36 + wav.dataSize)
+    copy(header[8:], "WAVE")
+    copy(header[12:], "fmt ")
+    binary.LittleEndian.PutUint32(header[16:], 16)
+    binary.LittleEndian.PutUint16(header[20:], 1) // pcm
+    binary.LittleEndian.PutUint16(header[22:], channels)
+    binary.LittleEndian.PutUint32(header[24:], wav.sampleRate)
+    binary.LittleEndian.PutUint32(header[28:], wav.sampleRate * channels * bitsPerSample / 8)
+    binary.LittleEndian.PutUint16(header[32:], channels * bitsPerSample / 8)
+    binary.LittleEndian.PutUint16(header[34:], bitsPerSample)
+    copy(header[36:], "data")
+    binary.LittleEndian.PutUint32(header[40:], wav.dataSize)
+
+    _, err := wav.writer.Write(header)
+    return err
+}
+
+func toPCM16(value float32) int16 {
+    value = max(-1, min(1, value))
+    return int16(value * 32767)
+}
+
+func (wav *WavWriter) AddSample(left float32, right float32) error {
+    wav.buffer = binary.LittleEndian.AppendUint16(wav.buffer, uint16(toPCM16(left)))
+    wav.buffer = binary.LittleEndian.AppendUint16(wav.buffer, uint16(toPCM16(right)))
+
+    // write in chunks rather than 4 bytes at a time
+    if len(wav.buffer) >= 4096 {
+        return wav.Flush()
+    }
+
+    return nil
+}
+
+// number of stereo samples added so far
+func (wav *WavWriter) Samples() uint64 {
+    return uint64(wav.dataSize + uint32(len(wav.buffer))) / 4
+}
+
+func (wav *WavWriter) Flush() error {
+    if len(wav.buffer) == 0 {
+        return nil
+    }
+
+    _, err := wav.writer.Write(wav.buffer)
+    wav.dataSize += uint32(len(wav.buffer))
+    wav.buffer = wav.buffer[:0]
+    return err
+}
+
+// flush any pending samples and update the header with the final size. the
+// underlying writer is not closed
+func (wav *WavWriter) Close() error {
+    err := wav.Flush()
+    if err != nil {
+        return err
+    }
+
+    _, err = wav.writer.Seek(0, io.SeekStart)
+    if err != nil {
+        return err
+    }
+
+    err = wav.writeHeader()
+    if err != nil {
+        return err
+    }
+
+    _, err = wav.writer.Seek(0, io.SeekEnd)
+    return err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "image/color"
+
+    "github.com/kazzmir/gameboy/core"
+
+    "github.com/hajimehoshi/ebiten/v2"
+    "github.com/hajimehoshi/ebiten/v2/vector"
+    "github.com/hajimehoshi/ebiten/v2/ebitenutil"
+)
+
+var channelColors = []color.RGBA{
+    color.RGBA{R: 0xff, G: 0x60, B: 0x60, A: 0xff},
+    color.RGBA{R: 0xff, G: 0xd0, B: 0x40, A: 0xff},
+    color.RGBA{R: 0x60, G: 0xd0, B: 0xff, A: 0xff},
+    color.RGBA{R: 0x80, G: 0xff, B: 0x80, A: 0xff},
+}
+
+// number of samples shown across the width of the oscilloscope, about 15ms
+const scopeSamples = 640
+
+// the wav files that each channel of the apu is written to
+type ChannelExport struct {
+    files []*os.File
+    writers []*core.WavWriter
+}
+
+// create prefix-pulse1.wav, prefix-pulse2.wav, prefix-wave.wav and prefix-noise.wav
+func MakeChannelExport(prefix string, sampleRate uint32) (*ChannelExport, error) {
+    export := &ChannelExport{}
+
+    for _, channel := range core.AllChannels {
+        file, err := os.Create(fmt.Sprintf("%v-%v.wav", prefix, channel))
+        if err != nil {
+            export.Close()
+            return nil, err
+        }
+
+        writer, err := core.MakeWavWriter(file, sampleRate)
+        if err != nil {
+            file.Close()
+            export.Close()
+            return nil, err
+        }
+
+        export.files = append(export.files, file)
+        export.writers = append(export.writers, writer)
+    }
+
+    return export, nil
+}
+
+// start writing the channels of this apu. a new apu takes over from the previous one
+func (export *ChannelExport) Attach(apu *core.APU) {
+    for i, channel := range core.AllChannels {
+        apu.SetChannelWriter(channel, export.writers[i])
+    }
+}
+
+func (export *ChannelExport) Close() error {
+    var out error
+    for i := range export.files {
+        err := export.writers[i].Close()
+        if err != nil && out == nil {
+            out = err
+        }
+        err = export.files[i].Close()
+        if err != nil && out == nil {
+            out = err
+        }
+    }
+
+    return out
+}
+
+// draw the recent waveform of each channel in its own horizontal strip
+func drawScope(screen *ebiten.Image, apu *core.APU) {
+    width := float32(screen.Bounds().Dx())
+    stripHeight := float32(screen.Bounds().Dy()) / float32(len(core.AllChannels))
+
+    vector.DrawFilledRect(screen, 0, 0, width, float32(screen.Bounds().Dy()), color.RGBA{A: 160}, false)
+
+    history := make([]float32, scopeSamples)
+    for i, channel := range core.AllChannels {
+        apu.ChannelHistory(channel, history)
+
+        top := stripHeight * float32(i)
+        middle := top + stripHeight / 2
+        // samples range from -1 to 1
+        scale := stripHeight / 2 * 0.9
+
+        // one line segment per screen pixel. the screen can be wider than the history,
+        // so the step is fractional
+        sample := func(x int) float32 {
+            return history[int(float32(x) * float32(len(history)) / width)]
+        }
+        for x := 1; x < int(width); x++ {
+            y1 := middle - sample(x-1) * scale
+            y2 := middle - sample(x) * scale
+            vector.StrokeLine(screen, float32(x-1), y1, float32(x), y2, 1, channelColors[i], false)
+        }
+
+        label := channel.String()
+        if !apu.IsAudible(channel) {
+            label += " (off)"
+        }
+        ebitenutil.DebugPrintAt(screen, label, 1, int(top))
+    }
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "os"
+    "log"
+    "strings"
+    "path/filepath"
+
+    "github.com/kazzmir/gameboy/core"
+)
+
+// path for a new capture in the capture directory
+func (engine *Engine) capturePath(extension string) string {
+    return filepath.Join(engine.captureDir, core.CaptureName(engine.title, extension))
+}
+
+// save what is on the screen, without the filter
+func (engine *Engine) saveScreenshot() {
+    path := engine.capturePath("png")
+    err := core.SaveScreenshot(path, engine.sourceFrame())
+    if err != nil {
+        log.Printf("Unable to save screenshot: %v", err)
+        return
+    }
+
+    log.Printf("Saved screenshot to %v", path)
+}
+
+// start recording a gif, or save the one being recorded
+func (engine *Engine) toggleGIF() {
+    if engine.gifRecorder == nil {
+        engine.gifRecorder = core.MakeGIFRecorder()
+        log.Printf("Recording gif")
+        return
+    }
+
+    recorder := engine.gifRecorder
+    engine.gifRecorder = nil
+
+    path := engine.capturePath("gif")
+    file, err := os.Create(path)
+    if err != nil {
+        log.Printf("Unable to save gif: %v", err)
+        return
+    }
+    defer file.Close()
+
+    err = recorder.Save(file)
+    if err != nil {
+        log.Printf("Unable to save gif: %v", err)
+        return
+    }
+
+    log.Printf("Saved %v frames to %v", recorder.Frames(), path)
+}
+
+// start dumping frames and audio, or finish the dump in progress
+func (engine *Engine) toggleVideoDump() {
+    if engine.videoDump == nil {
+        width, height := engine.sourceSize()
+        prefix := strings.TrimSuffix(engine.capturePath("y4m"), ".y4m")
+        dump, err := core.MakeVideoDump(prefix, engine.title, width, height, SampleRate)
+        if err != nil {
+            log.Printf("Unable to start video dump: %v", err)
+            return
+        }
+
+        dump.Attach(engine.Cpu.APU)
+        engine.videoDump = dump
+        log.Printf("Dumping video to %v.y4m and %v.wav", prefix, prefix)
+        return
+    }
+
+    engine.stopVideoDump()
+}
+
+func (engine *Engine) stopVideoDump() {
+    if engine.Cpu != nil {
+        engine.Cpu.APU.SetAudioWriter(nil)
+    }
+
+    err := engine.videoDump.Close()
+    if err != nil {
+        log.Printf("Unable to finish video dump: %v", err)
+    } else {
+        log.Printf("Finished video dump")
+    }
+
+    engine.videoDump = nil
+}
+
+// give a finished frame to the recordings in progress
+func (engine *Engine) captureFrame() {
+    if engine.gifRecorder == nil && engine.videoDump == nil {
+        return
+    }
+
+    frame := engine.sourceFrame()
+
+    if engine.gifRecorder != nil {
+        engine.gifRecorder.AddFrame(frame)
+    }
+
+    if engine.videoDump != nil {
+        err := engine.videoDump.AddFrame(frame)
+        if err != nil {
+            log.Printf("Stopping video dump: %v", err)
+            engine.stopVideoDump()
+        }
+    }
+}
+
+// save any recordings still in progress
+func (engine *Engine) stopCapture() {
+    if engine.gifRecorder != nil {
+        engine.toggleGIF()
+    }
+
+    if engine.videoDump != nil {
+        engine.stopVideoDump()
+    }
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+)
+
+// upscales the screen on the cpu before it is handed to ebiten
+type ScreenFilter interface {
+    // how many times larger the output is than the input
+    Scale() int
+    // filter the source into dest, which is Scale() times as large
+    Apply(dest *image.RGBA, source *image.RGBA)
+}
+
+// a filter that depends on earlier frames is given each frame the emulator finishes,
+// since Apply can be called any number of times per frame
+type FrameFilter interface {
+    AddFrame(source *image.RGBA)
+}
+
+var FilterNames = []string{"none", "scale2x", "scale3x", "hq2x", "xbr", "lcd"}
+
+// returns nil for "none"
+func MakeFilter(name string) (ScreenFilter, error) {
+    switch name {
+        case "", "none": return nil, nil
+        case "scale2x": return &Scale2xFilter{}, nil
+        case "scale3x": return &Scale3xFilter{}, nil
+        case "hq2x": return &HQ2xFilter{}, nil
+        case "xbr": return &XBRFilter{}, nil
+        case "lcd": return &LCDFilter{}, nil
+    }
+
+    return nil, fmt.Errorf("unknown filter '%v', choose one of %v", name, FilterNames)
+}
+
+// reads pixels of an image, clamping coordinates to the edges
+type pixelReader struct {
+    image *image.RGBA
+    width int
+    height int
+}
+
+func makePixelReader(source *image.RGBA) pixelReader {
+    return pixelReader{
+        image: source,
+        width: source.Bounds().Dx(),
+        height: source.Bounds().Dy(),
+    }
+}
+
+func (reader pixelReader) at(x int, y int) color.RGBA {
+    x = min(max(x, 0), reader.width - 1)
+    y = min(max(y, 0), reader.height - 1)
+    offset := y * reader.image.Stride + x * 4
+    pix := reader.image.Pix[offset:offset+4:offset+4]
+    return color.RGBA{R: pix[0], G: pix[1], B: pix[2], A: pix[3]}
+}
+
+func setPixel(dest *image.RGBA, x int, y int, pixel color.RGBA) {
+    offset := y * dest.Stride + x * 4
+    pix := dest.Pix[offset:offset+4:offset+4]
+    pix[0] = pixel.R
+    pix[1] = pixel.G
+    pix[2] = pixel.B
+    pix[3] = pixel.A
+}
+
+// mix two colors, with weight out of 'total' going to a
+func blend(a color.RGBA, b color.RGBA, weight int, total int) color.RGBA {
+    mix := func(x uint8, y uint8) uint8 {
+        return uint8((int(x) * weight + int(y) * (total - weight)) / total)
+    }
+    return color.RGBA{R: mix(a.R, b.R), G: mix(a.G, b.G), B: mix(a.B, b.B), A: 255}
+}
+
+// a pixel along with its yuv components, which hqx and xbr compare colors with
+type yuvPixel struct {
+    color color.RGBA
+    y, u, v int
+}
+
+// the source converted to yuv once, since each pixel is compared many times
+type yuvImage struct {
+    pixels []yuvPixel
+    width int
+    height int
+}
+
+func makeYUVImage(source *image.RGBA) yuvImage {
+    reader := makePixelReader(source)
+    out := yuvImage{
+        pixels: make([]yuvPixel, reader.width * reader.height),
+        width: reader.width,
+        height: reader.height,
+    }
+
+    for y := range reader.height {
+        for x := range reader.width {
+            c := reader.at(x, y)
+            r, g, b := int(c.R), int(c.G), int(c.B)
+            out.pixels[y * reader.width + x] = yuvPixel{
+                color: c,
+                y: (r * 299 + g * 587 + b * 114) / 1000,
+                u: (b - r) / 2 + 128,
+                v: (r * 2 - g - b) / 4 + 128,
+            }
+        }
+    }
+
+    return out
+}
+
+func (image *yuvImage) at(x int, y int) *yuvPixel {
+    x = min(max(x, 0), image.width - 1)
+    y = min(max(y, 0), image.height - 1)
+    return &image.pixels[y * image.width + x]
+}
+
+// the weighted yuv distance xbr uses to find edges
+func colorDistance(a *yuvPixel, b *yuvPixel) int {
+    abs := func(x int) int {
+        if x < 0 {
+            return -x
+        }
+        return x
+    }
+    return 48 * abs(a.y - b.y) + 7 * abs(a.u - b.u) + 6 * abs(a.v - b.v)
+}
+
+// the thresholds hq2x uses for similar colors
+func similar(a *yuvPixel, b *yuvPixel) bool {
+    abs := func(x int) int {
+        if x < 0 {
+            return -x
+        }
+        return x
+    }
+    return abs(a.y - b.y) <= 48 && abs(a.u - b.u) <= 7 && abs(a.v - b.v) <= 6
+}
+
+// the scale2x/epx filter, which fills in the corners of diagonal edges
+//   A B C
+//   D E F
+//   G H I
+type Scale2xFilter struct {
+}
+
+func (filter *Scale2xFilter) Scale() int {
+    return 2
+}
+
+func (filter *Scale2xFilter) Apply(dest *image.RGBA, source *image.RGBA) {
+    reader := makePixelReader(source)
+    for y := range reader.height {
+        for x := range reader.width {
+            b := reader.at(x, y - 1)
+            d := reader.at(x - 1, y)
+            e := reader.at(x, y)
+            f := reader.at(x + 1, y)
+            h := reader.at(x, y + 1)
+
+            e0, e1, e2, e3 := e, e, e, e
+            if b != h && d != f {
+                if d == b {
+                    e0 = d
+                }
+                if b == f {
+                    e1 = f
+                }
+                if d == h {
+                    e2 = d
+                }
+                if h == f {
+                    e3 = f
+                }
+            }
+
+            setPixel(dest, x * 2, y * 2, e0)
+            setPixel(dest, x * 2 + 1, y * 2, e1)
+            setPixel(dest, x * 2, y * 2 + 1, e2)
+            setPixel(dest, x * 2 + 1, y * 2 + 1, e3)
+        }
+    }
+}
+
+// scale3x, the 3x version of scale2x
+type Scale3xFilter struct {
+}
+
+func (filter *Scale3xFilter) Scale() int {
+    return 3
+}
+
+func (filter *Scale3xFilter) Apply(dest *image.RGBA, source *image.RGBA) {
+    reader := makePixelReader(source)
+    for y := range reader.height {
+        for x := range reader.width {
+            a := reader.at(x - 1, y - 1)
+            b := reader.at(x, y - 1)
+            c := reader.at(x + 1, y - 1)
+            d := reader.at(x - 1, y)
+            e := reader.at(x, y)
+            f := reader.at(x + 1, y)
+            g := reader.at(x - 1, y + 1)
+            h := reader.at(x, y + 1)
+            i := reader.at(x + 1, y + 1)
+
+            out := [9]color.RGBA{e, e, e, e, e, e, e, e, e}
+            if b != h && d != f {
+                if d == b {
+                    out[0] = d
+                }
+                if (d == b && e != c) || (b == f && e != a) {
+                    out[1] = b
+                }
+                if b == f {
+                    out[2] = f
+                }
+                if (d == b && e != g) || (d == h && e != a) {
+                    out[3] = d
+                }
+                if (b == f && e != i) || (h == f && e != c) {
+                    out[5] = f
+                }
+                if d == h {
+                    out[6] = d
+                }
+                if (d == h && e != i) || (h == f && e != g) {
+                    out[7] = h
+                }
+                if h == f {
+                    out[8] = f
+                }
+            }
+
+            for index, pixel := range out {
+                setPixel(dest, x * 3 + index % 3, y * 3 + index / 3, pixel)
+            }
+        }
+    }
+}
+
+// a small take on hq2x. each quarter of a pixel looks at the neighbors towards its
+// corner and blends across edges that run diagonally through it
+type HQ2xFilter struct {
+}
+
+func (filter *HQ2xFilter) Scale() int {
+    return 2
+}
+
+func (filter *HQ2xFilter) Apply(dest *image.RGBA, source *image.RGBA) {
+    reader := makeYUVImage(source)
+    for y := range reader.height {
+        for x := range reader.width {
+            e := reader.at(x, y)
+
+            for quarter := range 4 {
+                // direction of the corner this quarter is in
+                dx := quarter % 2 * 2 - 1
+                dy := quarter / 2 * 2 - 1
+
+                corner := reader.at(x + dx, y + dy)
+                vertical := reader.at(x, y + dy)
+                horizontal := reader.at(x + dx, y)
+
+                pixel := e.color
+                if similar(vertical, horizontal) && !similar(e, vertical) {
+                    across := blend(vertical.color, horizontal.color, 1, 2)
+                    if similar(e, corner) {
+                        // a thin line passes through the corner, only soften it
+                        pixel = blend(e.color, across, 3, 4)
+                    } else {
+                        pixel = blend(e.color, across, 1, 2)
+                    }
+                }
+
+                setPixel(dest, x * 2 + (dx + 1) / 2, y * 2 + (dy + 1) / 2, pixel)
+            }
+        }
+    }
+}
+
+// the first level of xbr at 2x. each corner compares how strongly the edges run in
+// the two diagonal directions and blends in the neighbor across the stronger edge
+type XBRFilter struct {
+}
+
+func (filter *XBRFilter) Scale() int {
+    return 2
+}
+
+func (filter *XBRFilter) Apply(dest *image.RGBA, source *image.RGBA) {
+    reader := makeYUVImage(source)
+    for y := range reader.height {
+        for x := range reader.width {
+            for quarter := range 4 {
+                dx := quarter % 2 * 2 - 1
+                dy := quarter / 2 * 2 - 1
+
+                // the neighborhood seen from the corner, as if it were the bottom right
+                //      B  C
+                //   D  E  F  F4
+                //   G  H  I  I4
+                //      H5 I5
+                b, c := reader.at(x, y - dy), reader.at(x + dx, y - dy)
+                d, e, f, f4 := reader.at(x - dx, y), reader.at(x, y), reader.at(x + dx, y), reader.at(x + 2 * dx, y)
+                g, h, i, i4 := reader.at(x - dx, y + dy), reader.at(x, y + dy), reader.at(x + dx, y + dy), reader.at(x + 2 * dx, y + dy)
+                h5, i5 := reader.at(x, y + 2 * dy), reader.at(x + dx, y + 2 * dy)
+
+                edge := colorDistance(e, c) + colorDistance(e, g) + colorDistance(i, f4) + colorDistance(i, h5) + 4 * colorDistance(h, f)
+                across := colorDistance(h, d) + colorDistance(h, i5) + colorDistance(f, i4) + colorDistance(f, b) + 4 * colorDistance(e, i)
+
+                pixel := e.color
+                if edge < across {
+                    neighbor := h
+                    if colorDistance(e, f) <= colorDistance(e, h) {
+                        neighbor = f
+                    }
+                    pixel = blend(e.color, neighbor.color, 1, 2)
+                }
+
+                setPixel(dest, x * 2 + (dx + 1) / 2, y * 2 + (dy + 1) / 2, pixel)
+            }
+        }
+    }
+}
+
+// looks like the dmg lcd. pixels are drawn 3x3 with a darker grid between them, and
+// each frame is blended with the previous one like the slow lcd does
+type LCDFilter struct {
+    // the blended frame from last time
+    previous *image.RGBA
+}
+
+func (filter *LCDFilter) Scale() int {
+    return 3
+}
+
+// blend the frame into the ones before it
+func (filter *LCDFilter) AddFrame(source *image.RGBA) {
+    if filter.previous == nil || filter.previous.Bounds() != source.Bounds() {
+        filter.previous = image.NewRGBA(source.Bounds())
+        copy(filter.previous.Pix, source.Pix)
+        return
+    }
+
+    reader := makePixelReader(source)
+    previous := makePixelReader(filter.previous)
+    for y := range reader.height {
+        for x := range reader.width {
+            setPixel(filter.previous, x, y, blend(reader.at(x, y), previous.at(x, y), 5, 8))
+        }
+    }
+}
+
+// draw the blended frame with the grid. the source is only used until there is a
+// blended frame of the same size
+func (filter *LCDFilter) Apply(dest *image.RGBA, source *image.RGBA) {
+    if filter.previous == nil || filter.previous.Bounds() != source.Bounds() {
+        filter.AddFrame(source)
+    }
+
+    reader := makePixelReader(filter.previous)
+    black := color.RGBA{A: 255}
+
+    for y := range reader.height {
+        for x := range reader.width {
+            pixel := reader.at(x, y)
+
+            grid := blend(pixel, black, 3, 4)
+            for v := range 3 {
+                for u := range 3 {
+                    if u == 2 || v == 2 {
+                        setPixel(dest, x * 3 + u, y * 3 + v, grid)
+                    } else {
+                        setPixel(dest, x * 3 + u, y * 3 + v, pixel)
+                    }
+                }
+            }
+        }
+    }
+}
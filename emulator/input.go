@@ -0,0 +1,297 @@
+package main
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "strings"
+    "strconv"
+    "path/filepath"
+
+    "github.com/kazzmir/gameboy/core"
+    "github.com/kazzmir/gameboy/emulator/toml"
+
+    "github.com/hajimehoshi/ebiten/v2"
+)
+
+// how far a stick has to be pushed before it counts as a press
+const axisThreshold = 0.5
+
+var gamepadButtonNames = map[string]ebiten.StandardGamepadButton{
+    "RightBottom": ebiten.StandardGamepadButtonRightBottom,
+    "RightRight": ebiten.StandardGamepadButtonRightRight,
+    "RightLeft": ebiten.StandardGamepadButtonRightLeft,
+    "RightTop": ebiten.StandardGamepadButtonRightTop,
+    "FrontTopLeft": ebiten.StandardGamepadButtonFrontTopLeft,
+    "FrontTopRight": ebiten.StandardGamepadButtonFrontTopRight,
+    "FrontBottomLeft": ebiten.StandardGamepadButtonFrontBottomLeft,
+    "FrontBottomRight": ebiten.StandardGamepadButtonFrontBottomRight,
+    "CenterLeft": ebiten.StandardGamepadButtonCenterLeft,
+    "CenterRight": ebiten.StandardGamepadButtonCenterRight,
+    "LeftStick": ebiten.StandardGamepadButtonLeftStick,
+    "RightStick": ebiten.StandardGamepadButtonRightStick,
+    "LeftTop": ebiten.StandardGamepadButtonLeftTop,
+    "LeftBottom": ebiten.StandardGamepadButtonLeftBottom,
+    "LeftLeft": ebiten.StandardGamepadButtonLeftLeft,
+    "LeftRight": ebiten.StandardGamepadButtonLeftRight,
+    "CenterCenter": ebiten.StandardGamepadButtonCenterCenter,
+}
+
+var gamepadAxisNames = map[string]ebiten.StandardGamepadAxis{
+    "LeftStickHorizontal": ebiten.StandardGamepadAxisLeftStickHorizontal,
+    "LeftStickVertical": ebiten.StandardGamepadAxisLeftStickVertical,
+    "RightStickHorizontal": ebiten.StandardGamepadAxisRightStickHorizontal,
+    "RightStickVertical": ebiten.StandardGamepadAxisRightStickVertical,
+}
+
+// a stick pushed in one direction
+type AxisBinding struct {
+    Axis ebiten.StandardGamepadAxis
+    // -1 or 1
+    Direction float64
+}
+
+// the inputs that press each gameboy button for one player
+type PlayerBindings struct {
+    // index into the list of connected gamepads, or -1 for no gamepad
+    Gamepad int
+    Keys map[core.Button][]ebiten.Key
+    GamepadButtons map[core.Button][]ebiten.StandardGamepadButton
+    GamepadAxes map[core.Button][]AxisBinding
+}
+
+// one entry per player. there is only player 1 until there is a second gameboy to
+// link to
+type InputBindings struct {
+    Players []PlayerBindings
+}
+
+func MakePlayerBindings(gamepad int) PlayerBindings {
+    return PlayerBindings{
+        Gamepad: gamepad,
+        Keys: make(map[core.Button][]ebiten.Key),
+        GamepadButtons: make(map[core.Button][]ebiten.StandardGamepadButton),
+        GamepadAxes: make(map[core.Button][]AxisBinding),
+    }
+}
+
+// the standard gamepad layout and the keys the emulator has always used
+func DefaultBindings() *InputBindings {
+    player := MakePlayerBindings(0)
+
+    player.Keys[core.ButtonA] = []ebiten.Key{ebiten.KeyA}
+    player.Keys[core.ButtonB] = []ebiten.Key{ebiten.KeyS}
+    player.Keys[core.ButtonStart] = []ebiten.Key{ebiten.KeyEnter}
+    player.Keys[core.ButtonSelect] = []ebiten.Key{ebiten.KeySpace}
+    player.Keys[core.ButtonUp] = []ebiten.Key{ebiten.KeyArrowUp}
+    player.Keys[core.ButtonDown] = []ebiten.Key{ebiten.KeyArrowDown}
+    player.Keys[core.ButtonLeft] = []ebiten.Key{ebiten.KeyArrowLeft}
+    player.Keys[core.ButtonRight] = []ebiten.Key{ebiten.KeyArrowRight}
+
+    player.GamepadButtons[core.ButtonA] = []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonRightRight}
+    player.GamepadButtons[core.ButtonB] = []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonRightBottom}
+    player.GamepadButtons[core.ButtonStart] = []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonCenterRight}
+    player.GamepadButtons[core.ButtonSelect] = []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonCenterLeft}
+    player.GamepadButtons[core.ButtonUp] = []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonLeftTop}
+    player.GamepadButtons[core.ButtonDown] = []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonLeftBottom}
+    player.GamepadButtons[core.ButtonLeft] = []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonLeftLeft}
+    player.GamepadButtons[core.ButtonRight] = []ebiten.StandardGamepadButton{ebiten.StandardGamepadButtonLeftRight}
+
+    player.GamepadAxes[core.ButtonUp] = []AxisBinding{{ebiten.StandardGamepadAxisLeftStickVertical, -1}}
+    player.GamepadAxes[core.ButtonDown] = []AxisBinding{{ebiten.StandardGamepadAxisLeftStickVertical, 1}}
+    player.GamepadAxes[core.ButtonLeft] = []AxisBinding{{ebiten.StandardGamepadAxisLeftStickHorizontal, -1}}
+    player.GamepadAxes[core.ButtonRight] = []AxisBinding{{ebiten.StandardGamepadAxisLeftStickHorizontal, 1}}
+
+    return &InputBindings{
+        Players: []PlayerBindings{player},
+    }
+}
+
+// returns which gameboy buttons are held down for this player
+func (player *PlayerBindings) Pressed(gamepads []ebiten.GamepadID) map[core.Button]bool {
+    pressed := make(map[core.Button]bool)
+
+    for button, keys := range player.Keys {
+        for _, key := range keys {
+            if ebiten.IsKeyPressed(key) {
+                pressed[button] = true
+            }
+        }
+    }
+
+    if player.Gamepad < 0 || player.Gamepad >= len(gamepads) {
+        return pressed
+    }
+
+    id := gamepads[player.Gamepad]
+    if !ebiten.IsStandardGamepadLayoutAvailable(id) {
+        return pressed
+    }
+
+    for button, gamepadButtons := range player.GamepadButtons {
+        for _, gamepadButton := range gamepadButtons {
+            if ebiten.IsStandardGamepadButtonPressed(id, gamepadButton) {
+                pressed[button] = true
+            }
+        }
+    }
+
+    for button, axes := range player.GamepadAxes {
+        for _, axis := range axes {
+            if ebiten.StandardGamepadAxisValue(id, axis.Axis) * axis.Direction > axisThreshold {
+                pressed[button] = true
+            }
+        }
+    }
+
+    return pressed
+}
+
+// ~/.config/gameboy/input.toml on linux
+func DefaultBindingsPath() (string, error) {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        return "", err
+    }
+
+    return filepath.Join(dir, "gameboy", "input.toml"), nil
+}
+
+// load bindings from the given file, or from the default path if it is empty.
+// the default bindings are used if no path was given and the default file does not exist
+func LoadBindingsFromPath(path string) (*InputBindings, error) {
+    if path == "" {
+        defaultPath, err := DefaultBindingsPath()
+        if err != nil {
+            return DefaultBindings(), nil
+        }
+
+        if _, err := os.Stat(defaultPath); err != nil {
+            return DefaultBindings(), nil
+        }
+
+        path = defaultPath
+    }
+
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    bindings, err := LoadBindings(file)
+    if err != nil {
+        return nil, fmt.Errorf("%v: %w", path, err)
+    }
+
+    return bindings, nil
+}
+
+// the file has a table for the player, each key is a gameboy button and the value is
+// a list of inputs. the player can also choose which connected gamepad they use
+//
+//   [player1]
+//   gamepad = 0
+//   a = ["key:A", "pad:RightRight"]
+//   up = ["key:ArrowUp", "pad:LeftTop", "axis:LeftStickVertical-"]
+//
+// buttons that are not mentioned keep their default binding. player2 and later are
+// rejected until there is a second gameboy for them to play
+func LoadBindings(reader io.Reader) (*InputBindings, error) {
+    tables, order, err := toml.Parse(reader)
+    if err != nil {
+        return nil, err
+    }
+
+    buttonNames := make(map[string]core.Button)
+    for _, button := range core.AllButtons {
+        buttonNames[button.String()] = button
+    }
+
+    bindings := DefaultBindings()
+
+    for _, name := range order {
+        if name != "player1" {
+            if strings.HasPrefix(name, "player") {
+                return nil, fmt.Errorf("only player1 can be bound, there is no second gameboy for %v", name)
+            }
+            return nil, fmt.Errorf("unknown table %v, expected player1", name)
+        }
+
+        player := &bindings.Players[0]
+
+        for key, values := range tables[name] {
+            if key == "gamepad" {
+                if len(values) != 1 {
+                    return nil, fmt.Errorf("%v: gamepad should be a single number", name)
+                }
+
+                gamepad, err := strconv.Atoi(values[0])
+                if err != nil {
+                    return nil, fmt.Errorf("%v: invalid gamepad %v: %w", name, values[0], err)
+                }
+
+                player.Gamepad = gamepad
+                continue
+            }
+
+            button, ok := buttonNames[key]
+            if !ok {
+                return nil, fmt.Errorf("%v: unknown gameboy button %v", name, key)
+            }
+
+            delete(player.Keys, button)
+            delete(player.GamepadButtons, button)
+            delete(player.GamepadAxes, button)
+
+            for _, value := range values {
+                err := player.bind(button, value)
+                if err != nil {
+                    return nil, fmt.Errorf("%v: %w", name, err)
+                }
+            }
+        }
+    }
+
+    return bindings, nil
+}
+
+// value is one of key:<ebiten key name>, pad:<standard gamepad button> or axis:<standard gamepad axis><+ or ->
+func (player *PlayerBindings) bind(button core.Button, value string) error {
+    kind, name, ok := strings.Cut(value, ":")
+    if !ok {
+        return fmt.Errorf("invalid binding %v for %v", value, button)
+    }
+
+    switch kind {
+        case "key":
+            var key ebiten.Key
+            err := key.UnmarshalText([]byte(name))
+            if err != nil {
+                return fmt.Errorf("invalid key %v for %v", name, button)
+            }
+            player.Keys[button] = append(player.Keys[button], key)
+        case "pad":
+            gamepadButton, ok := gamepadButtonNames[name]
+            if !ok {
+                return fmt.Errorf("invalid gamepad button %v for %v", name, button)
+            }
+            player.GamepadButtons[button] = append(player.GamepadButtons[button], gamepadButton)
+        case "axis":
+            direction := 1.0
+            if strings.HasSuffix(name, "-") {
+                direction = -1
+            }
+            name = strings.TrimRight(name, "+-")
+
+            axis, ok := gamepadAxisNames[name]
+            if !ok {
+                return fmt.Errorf("invalid gamepad axis %v for %v", name, button)
+            }
+            player.GamepadAxes[button] = append(player.GamepadAxes[button], AxisBinding{Axis: axis, Direction: direction})
+        default:
+            return fmt.Errorf("invalid binding type %v for %v", kind, button)
+    }
+
+    return nil
+}
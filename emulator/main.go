@@ -6,9 +6,13 @@ import (
     "io/fs"
     "fmt"
     "log"
+    "log/slog"
     "time"
     "flag"
     "errors"
+    "strings"
+    "image"
+    "image/draw"
     "image/color"
 
     "github.com/kazzmir/gameboy/core"
@@ -27,20 +31,56 @@ const SampleRate = 44100
 type Engine struct {
     MakeCpu func () (*core.CPU, error)
     Cpu *core.CPU
-    cpuBudget int64
+    // runs Cpu, replaced along with it by setCpu
+    machine *core.Machine
     ticker *time.Ticker
     rate int64
-    pixels []uint8
     needDraw bool
     maxCycle int64
     speed float64
     paused bool
+    showAudioStats bool
+    showScope bool
+    channelExport *ChannelExport
+    vgmRecorder *core.VGMRecorder
+    // plugged into the link port of every cpu
+    printer *core.Printer
+    // given to every cpu
+    logger *core.Logger
+
+    // the rom title, used to name screenshots and recordings
+    title string
+    captureDir string
+    gifRecorder *core.GIFRecorder
+    videoDump *core.VideoDump
+
+    viewer DebugViewer
+
+    // run games that support it as a super game boy, and show its border
+    sgb bool
+    showBorder bool
+    // the game boy screen drawn inside the border
+    bordered *image.RGBA
+
+    // upscales the frame before it is shown, nil to let ebiten scale it
+    filter ScreenFilter
+    filtered *image.RGBA
+    // only scale by whole numbers, leaving black bars around the frame
+    integerScale bool
+    outputImage *ebiten.Image
+
+    // the presets plus any palette loaded from a file
+    palettes []core.DisplayPalette
+    paletteIndex int
+
+    bindings *InputBindings
+    gamepads []ebiten.GamepadID
 
     audioContext *audio.Context
     audioPlayer *audio.Player
 }
 
-func MakeEngine(makeCpu func () (*core.CPU, error), maxCycle int64, rate int64, speed float64, audioContext *audio.Context) (*Engine, error) {
+func MakeEngine(makeCpu func () (*core.CPU, error), maxCycle int64, rate int64, speed float64, bindings *InputBindings, palettes []core.DisplayPalette, paletteIndex int, showAudioStats bool, channelExport *ChannelExport, vgmRecorder *core.VGMRecorder, audioContext *audio.Context) (*Engine, error) {
     ticker := time.NewTicker(time.Second / time.Duration(rate))
 
     cpu, err := makeCpu()
@@ -48,16 +88,41 @@ func MakeEngine(makeCpu func () (*core.CPU, error), maxCycle int64, rate int64,
         return nil, err
     }
 
-    return &Engine{
+    engine := &Engine{
         MakeCpu: makeCpu,
-        Cpu: cpu,
-        cpuBudget: 0,
         ticker: ticker,
         rate: rate,
         maxCycle: maxCycle,
         speed: speed,
+        bindings: bindings,
+        showAudioStats: showAudioStats,
+        channelExport: channelExport,
+        vgmRecorder: vgmRecorder,
+        palettes: palettes,
+        paletteIndex: paletteIndex,
         audioContext: audioContext,
-    }, nil
+    }
+
+    engine.setCpu(cpu)
+
+    return engine, nil
+}
+
+// run a new cpu, which can be nil until a rom is loaded
+func (engine *Engine) setCpu(cpu *core.CPU) {
+    engine.Cpu = cpu
+    engine.machine = nil
+    if cpu != nil {
+        engine.machine = core.MakeMachine(cpu)
+        engine.machine.OnFrame = func() {
+            engine.needDraw = true
+            if filter, ok := engine.filter.(FrameFilter); ok {
+                filter.AddFrame(engine.sourceFrame())
+            }
+            engine.captureFrame()
+            engine.viewer.Memory.ApplyFrozen(cpu)
+        }
+    }
 }
 
 // run the emulator for some number of cpu cycles
@@ -66,20 +131,19 @@ func (engine *Engine) runEmulator(cycles int64) error {
 
     // log.Printf("cpu budget: %v = %v/s. cpu speed = %v. diff = %v", engine.cpuBudget, engine.cpuBudget * engine.rate, core.CPUSpeed, engine.cpuBudget * engine.rate - core.CPUSpeed)
 
-    engine.Cpu.Joypad.Reset()
+    // the memory editor takes the keyboard while it is shown, except to switch pages
+    editingMemory := engine.viewer.Page == ViewerMemory
+    if editingMemory {
+        engine.viewer.Memory.Update(engine.Cpu)
+    }
 
     pressedKeys := inpututil.AppendJustPressedKeys(nil)
     for _, key := range pressedKeys {
-        switch key {
-            case ebiten.KeyA, ebiten.KeyS, ebiten.KeyEnter, ebiten.KeySpace:
-                if engine.Cpu.Joypad.ReadButtons {
-                    engine.Cpu.EnableJoypad()
-                }
-            case ebiten.KeyUp, ebiten.KeyDown, ebiten.KeyLeft, ebiten.KeyRight:
-                if engine.Cpu.Joypad.ReadDpad {
-                    engine.Cpu.EnableJoypad()
-                }
+        if editingMemory && key != ebiten.KeyV {
+            continue
+        }
 
+        switch key {
             case ebiten.KeyR:
                 return RestartError
             case ebiten.KeyP:
@@ -91,6 +155,30 @@ func (engine *Engine) runEmulator(cycles int64) error {
                         engine.audioPlayer.Play()
                     }
                 }
+            case ebiten.KeyC:
+                engine.paletteIndex = (engine.paletteIndex + 1) % len(engine.palettes)
+                engine.Cpu.PPU.DisplayPalette = engine.palettes[engine.paletteIndex]
+                log.Printf("Palette: %v", engine.Cpu.PPU.DisplayPalette.Name)
+            case ebiten.KeyO:
+                engine.showScope = !engine.showScope
+                engine.Cpu.APU.SetScopeEnabled(engine.showScope)
+            case ebiten.KeyV:
+                engine.viewer.NextPage()
+            case ebiten.KeyF5:
+                engine.saveScreenshot()
+            case ebiten.KeyF6:
+                engine.toggleGIF()
+            case ebiten.KeyF7:
+                engine.toggleVideoDump()
+            case ebiten.KeyF1, ebiten.KeyF2, ebiten.KeyF3, ebiten.KeyF4:
+                // f1-f4 mute a channel, with shift they solo it instead
+                channel := core.AllChannels[key - ebiten.KeyF1]
+                apu := engine.Cpu.APU
+                if ebiten.IsKeyPressed(ebiten.KeyShift) {
+                    apu.SetSolo(channel, !apu.IsSolo(channel))
+                } else {
+                    apu.SetMuted(channel, !apu.IsMuted(channel))
+                }
         }
     }
 
@@ -99,59 +187,36 @@ func (engine *Engine) runEmulator(cycles int64) error {
     pressedKeys = inpututil.AppendPressedKeys(nil)
     for _, key := range pressedKeys {
         switch key {
-            case ebiten.KeyA:
-                engine.Cpu.Joypad.A = true
-            case ebiten.KeyS:
-                engine.Cpu.Joypad.B = true
-            case ebiten.KeyEnter:
-                engine.Cpu.Joypad.Start = true
-            case ebiten.KeySpace:
-                engine.Cpu.Joypad.Select = true
-            case ebiten.KeyUp:
-                engine.Cpu.Joypad.Up = true
-            case ebiten.KeyDown:
-                engine.Cpu.Joypad.Down = true
-            case ebiten.KeyLeft:
-                engine.Cpu.Joypad.Left = true
-            case ebiten.KeyRight:
-                engine.Cpu.Joypad.Right = true
             case ebiten.KeyBackquote:
                 speedBoost = 1.5
         }
     }
 
-    if !engine.paused {
-        // divide by 4 because the cpu clock is 1/4th of the master clock
-        engine.cpuBudget += int64(float64(cycles) * (engine.speed + speedBoost)) / 4
+    // only player 1 is connected until there is a second gameboy to link to
+    engine.gamepads = ebiten.AppendGamepadIDs(engine.gamepads[:0])
+    pressed := engine.bindings.Players[0].Pressed(engine.gamepads)
+    if editingMemory {
+        clear(pressed)
     }
 
-    for engine.cpuBudget > 0 {
-        cpuCyclesTaken := engine.Cpu.HandleInterrupts()
+    // the joypad raises its own interrupt when a button goes down
+    engine.machine.SetInput(pressed)
 
-        next, _ := engine.Cpu.DecodeInstruction()
-        cpuCyclesTaken += engine.Cpu.Execute(next)
-        engine.Cpu.PPU.Run(cpuCyclesTaken * 4, engine.Cpu)
-        engine.Cpu.APU.Run(cpuCyclesTaken * 4)
+    if engine.paused {
+        return nil
+    }
 
-        engine.cpuBudget -= int64(cpuCyclesTaken)
+    startCycles := engine.Cpu.Cycles
 
-        select {
-            case <-engine.Cpu.PPU.Draw:
-                engine.needDraw = true
-                engine.Cpu.EnableVBlank()
-                // log.Printf("Draw screen")
-                // frames += 1
-            default:
-        }
+    // the machine runs in master clock cycles, each cpu machine cycle takes 4 of
+    // them normally or 2 in cgb double speed mode
+    engine.machine.RunCycles(int64(float64(cycles) * (engine.speed + speedBoost)))
 
-        if engine.maxCycle > 0 {
-            engine.maxCycle -= int64(cpuCyclesTaken)
-            if engine.maxCycle <= 0 {
-                return fmt.Errorf("Max cycles reached")
-            }
+    if engine.maxCycle > 0 {
+        engine.maxCycle -= int64(engine.Cpu.Cycles - startCycles)
+        if engine.maxCycle <= 0 {
+            return fmt.Errorf("Max cycles reached")
         }
-
-        engine.Cpu.RunTimer(cpuCyclesTaken)
     }
 
     return nil
@@ -176,12 +241,15 @@ func (engine *Engine) maybeLoadDropped() error {
 
                 cpuDebug := false
                 ppuDebug := false
+                cycleAccurate := false
+                sgb := engine.sgb
                 if engine.Cpu != nil {
                     cpuDebug = engine.Cpu.Debug
                     ppuDebug = engine.Cpu.PPU.Debug
+                    cycleAccurate = engine.Cpu.CycleAccurate()
                 }
 
-                makeCpu, err := loadGameboy(file, cpuDebug, ppuDebug)
+                makeCpu, title, err := loadGameboy(file, cpuDebug, ppuDebug, cycleAccurate, sgb, engine.logger)
                 if err != nil {
                     log.Printf("Error loading gameboy file: %v: %v", entry.Name(), err)
                 } else {
@@ -194,8 +262,9 @@ func (engine *Engine) maybeLoadDropped() error {
                         engine.audioPlayer.Close()
                     }
                     engine.audioPlayer = nil
-                    engine.Cpu = cpu
+                    engine.setCpu(cpu)
                     engine.MakeCpu = makeCpu
+                    engine.title = title
                 }
             }
         }
@@ -220,6 +289,9 @@ func (engine *Engine) Update() error {
     if engine.Cpu != nil {
         err = engine.runEmulator(core.CPUSpeed / engine.rate)
 
+        // keep about 50ms of audio queued beyond what the player buffers itself
+        engine.Cpu.APU.UpdateRateControl(SampleRate / 20)
+
         if errors.Is(err, RestartError) {
             cpu, err := engine.MakeCpu()
             if err != nil {
@@ -229,12 +301,28 @@ func (engine *Engine) Update() error {
                 engine.audioPlayer.Close()
             }
             engine.audioPlayer = nil
-            engine.Cpu = cpu
+            engine.setCpu(cpu)
 
             return nil
         }
 
         if engine.audioPlayer == nil {
+            // a new cpu was made, so carry the palette and audio debug state over to it
+            engine.Cpu.PPU.DisplayPalette = engine.palettes[engine.paletteIndex]
+            engine.Cpu.APU.SetScopeEnabled(engine.showScope)
+            if engine.channelExport != nil {
+                engine.channelExport.Attach(engine.Cpu.APU)
+            }
+            if engine.vgmRecorder != nil {
+                engine.Cpu.APU.SetRecorder(engine.vgmRecorder)
+            }
+            if engine.printer != nil {
+                engine.Cpu.AttachSerial(engine.printer)
+            }
+            if engine.videoDump != nil {
+                engine.videoDump.Attach(engine.Cpu.APU)
+            }
+
             player, err := engine.audioContext.NewPlayerF32(engine.Cpu.APU.GetAudioStream())
             if err != nil {
                 log.Printf("Error creating audio player: %v", err)
@@ -261,24 +349,27 @@ func (engine *Engine) Draw(screen *ebiten.Image) {
         return
     }
 
-    if len(engine.pixels) != screen.Bounds().Dx() * screen.Bounds().Dy() * 4 {
-        engine.pixels = make([]uint8, screen.Bounds().Dx() * screen.Bounds().Dy() * 4)
+    if engine.viewer.Active() {
+        engine.viewer.Draw(screen, engine.Cpu)
+        return
     }
 
-    virtualScreen := engine.Cpu.PPU.Screen
+    output := engine.filterFrame(engine.sourceFrame())
+    if engine.integerScale {
+        engine.drawLetterboxed(screen, output)
+    } else {
+        // the layout is the size of the output so the frame can be copied directly
+        screen.WritePixels(output.Pix)
+    }
 
-    for y := range len(virtualScreen) {
-        for x := range len(virtualScreen[y]) {
-            r, g, b, a := virtualScreen[y][x].RGBA()
-            index := (y*core.ScreenWidth + x) * 4
-            engine.pixels[index+0] = uint8(r >> 8)
-            engine.pixels[index+1] = uint8(g >> 8)
-            engine.pixels[index+2] = uint8(b >> 8)
-            engine.pixels[index+3] = uint8(a >> 8)
-        }
+    if engine.showScope {
+        drawScope(screen, engine.Cpu.APU)
     }
 
-    screen.WritePixels(engine.pixels)
+    if engine.showAudioStats {
+        stats := engine.Cpu.APU.GetAudioStream().Stats()
+        ebitenutil.DebugPrint(screen, fmt.Sprintf("buf %v\nunder %v\nover %v\nrate %.4f", stats.Buffered, stats.Underruns, stats.Overruns, engine.Cpu.APU.GetRateAdjust()))
+    }
 
     if engine.paused {
         vector.DrawFilledRect(screen, 0, 0, float32(screen.Bounds().Dx()), float32(screen.Bounds().Dy()), color.RGBA{R: 0, G: 0, B: 0, A: 128}, true)
@@ -286,14 +377,107 @@ func (engine *Engine) Draw(screen *ebiten.Image) {
     }
 }
 
-func (engine *Engine) Layout(outsideWidth, outsideHeight int) (int, int) {
+// true if the sgb border is drawn around the screen
+func (engine *Engine) borderShown() bool {
+    return engine.showBorder && engine.Cpu != nil && engine.Cpu.SGB != nil
+}
+
+// the game boy screen, or the sgb border with the screen in the middle of it
+func (engine *Engine) sourceFrame() *image.RGBA {
+    frame := engine.Cpu.PPU.Frame()
+    if !engine.borderShown() {
+        return frame
+    }
+
+    if engine.bordered == nil {
+        engine.bordered = image.NewRGBA(image.Rect(0, 0, core.SGBBorderWidth, core.SGBBorderHeight))
+    }
+
+    draw.Draw(engine.bordered, engine.bordered.Bounds(), engine.Cpu.SGB.Border(), image.Point{}, draw.Src)
+    screenArea := image.Rect(core.SGBScreenX, core.SGBScreenY, core.SGBScreenX + core.ScreenWidth, core.SGBScreenY + core.ScreenHeight)
+    draw.Draw(engine.bordered, screenArea, frame, image.Point{}, draw.Src)
+
+    return engine.bordered
+}
+
+// size of the source frame before it is filtered
+func (engine *Engine) sourceSize() (int, int) {
+    if engine.borderShown() {
+        return core.SGBBorderWidth, core.SGBBorderHeight
+    }
+
     return core.ScreenWidth, core.ScreenHeight
 }
 
-func loadGameboy(file io.Reader, cpuDebug bool, ppuDebug bool) (func() (*core.CPU, error), error) {
+func (engine *Engine) filterScale() int {
+    if engine.filter == nil {
+        return 1
+    }
+
+    return engine.filter.Scale()
+}
+
+// run the filter on a frame, or return it as is if there is no filter
+func (engine *Engine) filterFrame(source *image.RGBA) *image.RGBA {
+    if engine.filter == nil {
+        return source
+    }
+
+    scale := engine.filter.Scale()
+    bounds := image.Rect(0, 0, source.Bounds().Dx() * scale, source.Bounds().Dy() * scale)
+    if engine.filtered == nil || engine.filtered.Bounds() != bounds {
+        engine.filtered = image.NewRGBA(bounds)
+    }
+
+    engine.filter.Apply(engine.filtered, source)
+    return engine.filtered
+}
+
+// draw the frame at the largest whole number scale that fits, centered with black bars
+func (engine *Engine) drawLetterboxed(screen *ebiten.Image, frame *image.RGBA) {
+    width := frame.Bounds().Dx()
+    height := frame.Bounds().Dy()
+
+    if engine.outputImage == nil || engine.outputImage.Bounds().Dx() != width || engine.outputImage.Bounds().Dy() != height {
+        if engine.outputImage != nil {
+            engine.outputImage.Deallocate()
+        }
+        engine.outputImage = ebiten.NewImage(width, height)
+    }
+    engine.outputImage.WritePixels(frame.Pix)
+
+    screenWidth := screen.Bounds().Dx()
+    screenHeight := screen.Bounds().Dy()
+    scale := max(1, min(screenWidth / width, screenHeight / height))
+
+    screen.Fill(color.Black)
+
+    var options ebiten.DrawImageOptions
+    options.GeoM.Scale(float64(scale), float64(scale))
+    options.GeoM.Translate(float64((screenWidth - width * scale) / 2), float64((screenHeight - height * scale) / 2))
+    screen.DrawImage(engine.outputImage, &options)
+}
+
+func (engine *Engine) Layout(outsideWidth, outsideHeight int) (int, int) {
+    if engine.viewer.Active() {
+        return ViewerWidth, ViewerHeight
+    }
+
+    if engine.integerScale {
+        // the frame is scaled up by hand so use every pixel of the window
+        scale := ebiten.Monitor().DeviceScaleFactor()
+        return int(float64(outsideWidth) * scale), int(float64(outsideHeight) * scale)
+    }
+
+    width, height := engine.sourceSize()
+    return width * engine.filterScale(), height * engine.filterScale()
+}
+
+// returns a function that makes a cpu running the game, and the title of the game
+func loadGameboy(file io.Reader, cpuDebug bool, ppuDebug bool, cycleAccurate bool, sgb bool, logger *core.Logger) (func() (*core.CPU, error), string, error) {
     gameboyFile, err := core.LoadGameboy(file)
     if err != nil {
-        return nil, err
+        return nil, "", err
     }
 
     log.Printf("Loaded %d bytes", len(gameboyFile.Data))
@@ -311,25 +495,69 @@ func loadGameboy(file io.Reader, cpuDebug bool, ppuDebug bool) (func() (*core.CP
         }
 
         cpu := core.MakeCPU(mbc, SampleRate)
+        cpu.SetLogger(logger)
         cpu.InitializeDMG()
+        cpu.CGB = gameboyFile.GetCGBFlag() & 0x80 != 0
         cpu.Debug = cpuDebug
         cpu.Error = true
         cpu.PPU.Debug = ppuDebug
+        cpu.SetCycleAccurate(cycleAccurate)
+        // the game has to ask for sgb features in its header
+        if sgb && gameboyFile.GetSGBFlag() == 0x03 {
+            cpu.EnableSGB()
+        }
         return cpu, nil
     }
 
-    return makeCpu, nil
+    return makeCpu, gameboyFile.GetTitle(), nil
 }
 
-func loadGameboyFromPath(path string, cpuDebug bool, ppuDebug bool) (func() (*core.CPU, error), error) {
+func loadGameboyFromPath(path string, cpuDebug bool, ppuDebug bool, cycleAccurate bool, sgb bool, logger *core.Logger) (func() (*core.CPU, error), string, error) {
     file, err := os.Open(path)
     if err != nil {
-        return nil, err
+        return nil, "", err
     }
 
     defer file.Close()
 
-    return loadGameboy(file, cpuDebug, ppuDebug)
+    return loadGameboy(file, cpuDebug, ppuDebug, cycleAccurate, sgb, logger)
+}
+
+// the palettes to cycle through and the index of the one to start with, which is either
+// a preset or a palette file that gets added after the presets
+func loadPalettes(name string) ([]core.DisplayPalette, int, error) {
+    palettes := append([]core.DisplayPalette(nil), core.PalettePresets...)
+
+    for i, palette := range palettes {
+        if strings.EqualFold(palette.Name, name) {
+            return palettes, i, nil
+        }
+    }
+
+    palette, err := core.LoadPalette(name)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    palettes = append(palettes, palette)
+    return palettes, len(palettes) - 1, nil
+}
+
+func saveVGM(path string, recorder *core.VGMRecorder) {
+    file, err := os.Create(path)
+    if err != nil {
+        log.Printf("Unable to save vgm: %v", err)
+        return
+    }
+    defer file.Close()
+
+    err = recorder.Save(file)
+    if err != nil {
+        log.Printf("Unable to save vgm: %v", err)
+        return
+    }
+
+    log.Printf("Saved vgm to %v", path)
 }
 
 func main(){
@@ -338,10 +566,40 @@ func main(){
     ppuDebug := flag.Bool("ppu-debug", false, "Enable PPU debug")
     fps := flag.Int("fps", 60, "FPS")
     speed := flag.Float64("speed", 1.0, "Speed multiplier")
+    cycleAccurate := flag.Bool("cycle-accurate", false, "Run the ppu, apu and timer on every cpu memory access")
+    audioStats := flag.Bool("audio-stats", false, "Show audio buffer underruns and overruns")
+    exportChannels := flag.String("export-channels", "", "Write each audio channel to <prefix>-<channel>.wav")
+    recordVGM := flag.String("record-vgm", "", "Record the sound register writes to a vgm file")
+    vgmPath := flag.String("vgm", "", "Play a vgm file instead of running a rom")
+    loop := flag.Bool("loop", false, "Loop vgm playback")
+    paletteName := flag.String("palette", "green", "Palette preset (green, pocket, light, contrast) or a .json/.gpl palette file")
+    sgb := flag.Bool("sgb", false, "Run games that support it as a super game boy, with sgb colors")
+    sgbBorder := flag.Bool("sgb-border", false, "Show the super game boy border around the screen, implies -sgb")
+    printerPath := flag.String("printer", "", "Connect a game boy printer that saves printouts as png files in this directory")
+    filterName := flag.String("filter", "none", fmt.Sprintf("Screen filter, one of %v", strings.Join(FilterNames, ", ")))
+    integerScale := flag.Bool("integer-scale", false, "Only scale the screen by whole numbers, with black bars around it")
+    captureDir := flag.String("capture-dir", ".", "Directory screenshots and recordings are saved in")
+    bindingsPath := flag.String("bindings", "", "Input bindings file (default ~/.config/gameboy/input.toml)")
+    logLevels := flag.String("log", "", "Log levels for all of the emulator or per category (cpu, ppu, apu, mbc, io), e.g. warn,mbc=off,cpu=debug")
     flag.Parse()
 
     log.SetFlags(log.Ldate | log.Lshortfile | log.Lmicroseconds)
 
+    // the levels are filtered per category by the logger, so let everything through here
+    logger := core.MakeLogger(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+    if *cpuDebug {
+        logger.SetLevel(core.LogCPU, slog.LevelDebug)
+    }
+    if *ppuDebug {
+        logger.SetLevel(core.LogPPU, slog.LevelDebug)
+    }
+    err := logger.Configure(*logLevels)
+    if err != nil {
+        log.Printf("Error: %v", err)
+        return
+    }
+    defer logger.Flush()
+
     var path string
     for i := len(os.Args) - flag.NArg(); i < len(os.Args); i++ {
         path = os.Args[i]
@@ -350,10 +608,10 @@ func main(){
     makeCpu := func() (*core.CPU, error) {
         return nil, nil
     }
+    var title string
 
     if path != "" {
-        var err error
-        makeCpu, err = loadGameboyFromPath(path, *cpuDebug, *ppuDebug)
+        makeCpu, title, err = loadGameboyFromPath(path, *cpuDebug, *ppuDebug, *cycleAccurate, *sgb || *sgbBorder, logger)
         if err != nil {
             log.Printf("Error: %v", err)
             return
@@ -365,16 +623,85 @@ func main(){
         log.Printf("Max cycles: %v, %0.3f seconds", *maxCycle, float64(*maxCycle) / (float64(core.CPUSpeed) * (*speed)))
     }
 
+    bindings, err := LoadBindingsFromPath(*bindingsPath)
+    if err != nil {
+        log.Printf("Error loading input bindings: %v", err)
+        return
+    }
+
     audioContext := audio.NewContext(SampleRate)
 
-    engine, err := MakeEngine(makeCpu, *maxCycle, int64(*fps), *speed, audioContext)
+    if *vgmPath != "" {
+        vgmEngine, err := MakeVGMEngine(*vgmPath, *loop, int64(*fps), audioContext)
+        if err != nil {
+            log.Printf("Error: %v", err)
+            return
+        }
+
+        ebiten.SetTPS(*fps)
+        ebiten.SetWindowSize(core.ScreenWidth*4, core.ScreenHeight*4)
+        ebiten.SetWindowTitle("Gameboy VGM Player")
+        ebiten.SetWindowResizingMode(ebiten.WindowResizingModeEnabled)
+
+        err = ebiten.RunGame(vgmEngine)
+        if err != nil {
+            log.Printf("Error: %v", err)
+        }
+        return
+    }
+
+    var channelExport *ChannelExport
+    if *exportChannels != "" {
+        channelExport, err = MakeChannelExport(*exportChannels, SampleRate)
+        if err != nil {
+            log.Printf("Error creating channel export: %v", err)
+            return
+        }
+        defer channelExport.Close()
+    }
+
+    filter, err := MakeFilter(*filterName)
     if err != nil {
         log.Printf("Error: %v", err)
         return
     }
 
+    palettes, paletteIndex, err := loadPalettes(*paletteName)
+    if err != nil {
+        log.Printf("Error loading palette: %v", err)
+        return
+    }
+
+    var vgmRecorder *core.VGMRecorder
+    if *recordVGM != "" {
+        vgmRecorder = core.MakeVGMRecorder()
+        defer saveVGM(*recordVGM, vgmRecorder)
+    }
+
+    engine, err := MakeEngine(makeCpu, *maxCycle, int64(*fps), *speed, bindings, palettes, paletteIndex, *audioStats, channelExport, vgmRecorder, audioContext)
+    if err != nil {
+        log.Printf("Error: %v", err)
+        return
+    }
+    engine.sgb = *sgb || *sgbBorder
+    engine.logger = logger
+    engine.title = title
+    engine.captureDir = *captureDir
+    engine.filter = filter
+    engine.integerScale = *integerScale
+    engine.showBorder = *sgbBorder
+    if *printerPath != "" {
+        engine.printer = core.MakePrinter(*printerPath)
+        // a printout that was never fed out is saved anyway
+        defer engine.printer.Flush()
+    }
+
     ebiten.SetTPS(*fps)
-    ebiten.SetWindowSize(core.ScreenWidth*4, core.ScreenHeight*4)
+    if *sgbBorder {
+        ebiten.SetWindowSize(core.SGBBorderWidth*3, core.SGBBorderHeight*3)
+    } else {
+        ebiten.SetWindowSize(core.ScreenWidth*4, core.ScreenHeight*4)
+    }
     ebiten.SetWindowTitle("Gameboy Emulator")
     ebiten.SetWindowResizingMode(ebiten.WindowResizingModeEnabled)
 
@@ -383,5 +710,11 @@ func main(){
         log.Printf("Error: %v", err)
     }
 
+    if engine.Cpu != nil {
+        // finish the recording at the current time
+        engine.Cpu.APU.SetRecorder(nil)
+    }
+    engine.stopCapture()
+
     log.Printf("Bye!")
 }
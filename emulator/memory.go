@@ -0,0 +1,297 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "image/color"
+
+    "github.com/kazzmir/gameboy/core"
+
+    "github.com/hajimehoshi/ebiten/v2"
+    "github.com/hajimehoshi/ebiten/v2/vector"
+    "github.com/hajimehoshi/ebiten/v2/inpututil"
+    "github.com/hajimehoshi/ebiten/v2/ebitenutil"
+)
+
+// size of a character of the debug font
+const charWidth = 6
+const charHeight = 16
+
+var cursorColor = color.RGBA{R: 0xa0, G: 0x30, B: 0x30, A: 0xff}
+var frozenColor = color.RGBA{R: 0x30, G: 0x50, B: 0xa0, A: 0xff}
+var candidateColor = color.RGBA{R: 0x30, G: 0x70, B: 0x30, A: 0xff}
+
+// a hex view of the address space that can edit bytes, freeze them to a value, and
+// search for the ones that changed between looks
+type MemoryEditor struct {
+    Cursor uint16
+    // the high nibble of a byte being typed
+    nibble uint8
+    typing bool
+
+    // typing an address to go to
+    goTo bool
+    goToDigits string
+
+    // written back every frame
+    Frozen map[uint16]uint8
+    // write with Poke instead of StoreMemory, which patches rom instead of switching
+    // banks and doesn't start dma, serial transfers or sounds
+    Poke bool
+
+    search *core.MemorySearch
+    lastFilter string
+}
+
+func hexDigit(char rune) (uint8, bool) {
+    switch {
+        case char >= '0' && char <= '9': return uint8(char - '0'), true
+        case char >= 'a' && char <= 'f': return uint8(char - 'a' + 10), true
+        case char >= 'A' && char <= 'F': return uint8(char - 'A' + 10), true
+    }
+
+    return 0, false
+}
+
+func (editor *MemoryEditor) write(cpu *core.CPU, address uint16, value uint8) {
+    if editor.Poke {
+        cpu.Poke(address, value)
+    } else {
+        cpu.StoreMemory(address, value)
+    }
+}
+
+// write the frozen values back, undoing whatever the game did to them
+func (editor *MemoryEditor) ApplyFrozen(cpu *core.CPU) {
+    for address, value := range editor.Frozen {
+        editor.write(cpu, address, value)
+    }
+}
+
+func (editor *MemoryEditor) store(cpu *core.CPU, value uint8) {
+    editor.write(cpu, editor.Cursor, value)
+    if _, ok := editor.Frozen[editor.Cursor]; ok {
+        editor.Frozen[editor.Cursor] = value
+    }
+}
+
+func (editor *MemoryEditor) toggleFrozen(cpu *core.CPU) {
+    if editor.Frozen == nil {
+        editor.Frozen = make(map[uint16]uint8)
+    }
+
+    if _, ok := editor.Frozen[editor.Cursor]; ok {
+        delete(editor.Frozen, editor.Cursor)
+    } else {
+        editor.Frozen[editor.Cursor] = cpu.Peek(editor.Cursor)
+    }
+}
+
+func (editor *MemoryEditor) filter(cpu *core.CPU, filter core.SearchFilter) {
+    // without a search there is nothing to compare against yet, so the first press
+    // only takes the snapshot like N does
+    if editor.search == nil {
+        editor.search = core.MakeMemorySearch(cpu)
+        editor.lastFilter = ""
+        return
+    }
+
+    editor.search.Filter(cpu, filter)
+    editor.lastFilter = filter.String()
+}
+
+// move the cursor to the first candidate after it
+func (editor *MemoryEditor) nextCandidate() {
+    if editor.search == nil || len(editor.search.Candidates) == 0 {
+        return
+    }
+
+    for _, address := range editor.search.Candidates {
+        if address > editor.Cursor {
+            editor.Cursor = address
+            return
+        }
+    }
+
+    editor.Cursor = editor.search.Candidates[0]
+}
+
+func (editor *MemoryEditor) typeChar(cpu *core.CPU, char rune) {
+    if editor.goTo {
+        if _, ok := hexDigit(char); ok && len(editor.goToDigits) < 4 {
+            editor.goToDigits += string(char)
+        }
+        return
+    }
+
+    switch char {
+        case '=': editor.filter(cpu, core.SearchUnchanged)
+        case '!': editor.filter(cpu, core.SearchChanged)
+        case '<': editor.filter(cpu, core.SearchDecreased)
+        case '>': editor.filter(cpu, core.SearchIncreased)
+        case 'n', 'N':
+            editor.search = core.MakeMemorySearch(cpu)
+            editor.lastFilter = ""
+        case 'z', 'Z': editor.toggleFrozen(cpu)
+        case 'p', 'P': editor.Poke = !editor.Poke
+        case 'g', 'G':
+            editor.goTo = true
+            editor.goToDigits = ""
+            editor.typing = false
+        default:
+            digit, ok := hexDigit(char)
+            if !ok {
+                return
+            }
+
+            if !editor.typing {
+                editor.nibble = digit
+                editor.typing = true
+            } else {
+                editor.store(cpu, editor.nibble << 4 | digit)
+                editor.typing = false
+                editor.Cursor += 1
+            }
+    }
+}
+
+func (editor *MemoryEditor) move(offset int) {
+    editor.Cursor = uint16(int(editor.Cursor) + offset)
+    editor.typing = false
+}
+
+// handle the keys for this frame. the game gets no input while the editor is shown
+func (editor *MemoryEditor) Update(cpu *core.CPU) {
+    for _, key := range inpututil.AppendJustPressedKeys(nil) {
+        switch key {
+            case ebiten.KeyArrowLeft: editor.move(-1)
+            case ebiten.KeyArrowRight: editor.move(1)
+            case ebiten.KeyArrowUp: editor.move(-16)
+            case ebiten.KeyArrowDown: editor.move(16)
+            case ebiten.KeyPageUp: editor.move(-256)
+            case ebiten.KeyPageDown: editor.move(256)
+            case ebiten.KeyTab: editor.nextCandidate()
+            case ebiten.KeyBackspace:
+                if editor.goTo && len(editor.goToDigits) > 0 {
+                    editor.goToDigits = editor.goToDigits[:len(editor.goToDigits) - 1]
+                } else {
+                    editor.goTo = false
+                    editor.typing = false
+                }
+            case ebiten.KeyEnter:
+                if editor.goTo {
+                    var address uint16
+                    fmt.Sscanf(editor.goToDigits, "%x", &address)
+                    editor.Cursor = address
+                    editor.goTo = false
+                }
+        }
+    }
+
+    for _, char := range ebiten.AppendInputChars(nil) {
+        editor.typeChar(cpu, char)
+    }
+}
+
+func (editor *MemoryEditor) Draw(screen *ebiten.Image, cpu *core.CPU) {
+    const left = 8
+    const top = 8
+    // the column of the first byte in a row
+    const bytesLeft = left + 6 * charWidth
+
+    page := editor.Cursor & 0xff00
+
+    candidates := make(map[uint16]bool)
+    if editor.search != nil && len(editor.search.Candidates) <= 4096 {
+        for _, address := range editor.search.Candidates {
+            candidates[address] = true
+        }
+    }
+
+    var text strings.Builder
+    text.WriteString("      ")
+    for column := range 16 {
+        fmt.Fprintf(&text, " %x ", column)
+    }
+    text.WriteString("\n")
+
+    for row := range 16 {
+        fmt.Fprintf(&text, "%04x  ", page + uint16(row * 16))
+        for column := range 16 {
+            address := page + uint16(row * 16 + column)
+            value := cpu.Peek(address)
+
+            x := float32(bytesLeft + column * 3 * charWidth - 1)
+            y := float32(top + (row + 1) * charHeight)
+            highlight := color.RGBA{}
+            switch {
+                case address == editor.Cursor: highlight = cursorColor
+                case editor.isFrozen(address): highlight = frozenColor
+                case candidates[address]: highlight = candidateColor
+            }
+            if highlight.A != 0 {
+                vector.DrawFilledRect(screen, x, y, 2 * charWidth + 2, charHeight, highlight, false)
+            }
+
+            if address == editor.Cursor && editor.typing {
+                fmt.Fprintf(&text, "%x_ ", editor.nibble)
+            } else {
+                fmt.Fprintf(&text, "%02x ", value)
+            }
+        }
+        text.WriteString("\n")
+    }
+
+    ebitenutil.DebugPrintAt(screen, text.String(), left, top)
+
+    const infoLeft = bytesLeft + 16 * 3 * charWidth + 8
+    info := fmt.Sprintf("Memory\n\nAddress 0x%04x\nValue   0x%02x %3v", editor.Cursor, cpu.Peek(editor.Cursor), cpu.Peek(editor.Cursor))
+    if editor.Poke {
+        info += "\nWrite   poke"
+    } else {
+        info += "\nWrite   store"
+    }
+    if editor.goTo {
+        info += fmt.Sprintf("\n\nGo to 0x%s_", editor.goToDigits)
+    }
+
+    info += "\n\nFrozen"
+    frozen := make([]uint16, 0, len(editor.Frozen))
+    for address := range editor.Frozen {
+        frozen = append(frozen, address)
+    }
+    sort.Slice(frozen, func(i, j int) bool { return frozen[i] < frozen[j] })
+    for i, address := range frozen {
+        if i == 5 {
+            info += fmt.Sprintf("\n ... %v more", len(frozen) - i)
+            break
+        }
+        info += fmt.Sprintf("\n 0x%04x = 0x%02x", address, editor.Frozen[address])
+    }
+
+    if editor.search != nil {
+        info += fmt.Sprintf("\n\nSearch: %v left", len(editor.search.Candidates))
+        if editor.lastFilter != "" {
+            info += fmt.Sprintf("\nlast: %v", editor.lastFilter)
+        }
+        for i, address := range editor.search.Candidates {
+            if i == 5 {
+                info += "\n ..."
+                break
+            }
+            info += fmt.Sprintf("\n 0x%04x %02x -> %02x", address, editor.search.Previous(address), cpu.Peek(address))
+        }
+    }
+
+    ebitenutil.DebugPrintAt(screen, info, infoLeft, top)
+
+    help := "0-f edit  arrows/pgup/pgdn move  g go to  z freeze  p poke\n" +
+            "n new search  = unchanged  ! changed  < less  > more  tab next"
+    ebitenutil.DebugPrintAt(screen, help, left, ViewerHeight - 2 * charHeight - 4)
+}
+
+func (editor *MemoryEditor) isFrozen(address uint16) bool {
+    _, ok := editor.Frozen[address]
+    return ok
+}
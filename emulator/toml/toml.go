@@ -0,0 +1,100 @@
+package toml
+
+// just enough toml for the emulator's config files, without pulling in a library
+
+import (
+    "io"
+    "fmt"
+    "bufio"
+    "strings"
+    "strconv"
+)
+
+// parse the small subset of toml used by the bindings file: [table] headers and
+// key = value lines where the value is a string, a number or an array of strings.
+// returns the tables and the order they appeared in
+func Parse(reader io.Reader) (map[string]map[string][]string, []string, error) {
+    tables := make(map[string]map[string][]string)
+    var order []string
+    current := ""
+
+    scanner := bufio.NewScanner(reader)
+    lineNumber := 0
+    for scanner.Scan() {
+        lineNumber += 1
+        line := strings.TrimSpace(stripComment(scanner.Text()))
+        if line == "" {
+            continue
+        }
+
+        if strings.HasPrefix(line, "[") {
+            if !strings.HasSuffix(line, "]") {
+                return nil, nil, fmt.Errorf("line %v: invalid table header", lineNumber)
+            }
+            current = strings.TrimSpace(line[1:len(line)-1])
+            if _, ok := tables[current]; !ok {
+                tables[current] = make(map[string][]string)
+                order = append(order, current)
+            }
+            continue
+        }
+
+        if current == "" {
+            return nil, nil, fmt.Errorf("line %v: key outside of a table", lineNumber)
+        }
+
+        key, value, ok := strings.Cut(line, "=")
+        if !ok {
+            return nil, nil, fmt.Errorf("line %v: expected key = value", lineNumber)
+        }
+
+        key = strings.TrimSpace(key)
+        value = strings.TrimSpace(value)
+
+        var values []string
+        if strings.HasPrefix(value, "[") {
+            if !strings.HasSuffix(value, "]") {
+                return nil, nil, fmt.Errorf("line %v: unterminated array", lineNumber)
+            }
+            for _, item := range strings.Split(value[1:len(value)-1], ",") {
+                item = strings.TrimSpace(item)
+                if item == "" {
+                    continue
+                }
+                unquoted, err := strconv.Unquote(item)
+                if err != nil {
+                    return nil, nil, fmt.Errorf("line %v: invalid string %v", lineNumber, item)
+                }
+                values = append(values, unquoted)
+            }
+        } else if strings.HasPrefix(value, "\"") {
+            unquoted, err := strconv.Unquote(value)
+            if err != nil {
+                return nil, nil, fmt.Errorf("line %v: invalid string %v", lineNumber, value)
+            }
+            values = append(values, unquoted)
+        } else {
+            values = append(values, value)
+        }
+
+        tables[current][key] = values
+    }
+
+    return tables, order, scanner.Err()
+}
+
+// remove a # comment that is not inside a string
+func stripComment(line string) string {
+    quoted := false
+    escaped := false
+    for i, c := range line {
+        switch {
+            case escaped: escaped = false
+            case quoted && c == '\\': escaped = true
+            case c == '"': quoted = !quoted
+            case c == '#' && !quoted: return line[:i]
+        }
+    }
+
+    return line
+}
@@ -0,0 +1,79 @@
+package toml
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParse(test *testing.T) {
+    input := `
+# bindings
+[player1]
+gamepad = 0
+a = ["key:A", "pad:RightRight"]  # both
+start = "key:Enter"
+empty = []
+
+[ other ]
+up = ["key:#", "a \"quoted # mark\""]
+`
+
+    tables, order, err := Parse(strings.NewReader(input))
+    if err != nil {
+        test.Fatalf("unable to parse: %v", err)
+    }
+
+    if !reflect.DeepEqual(order, []string{"player1", "other"}) {
+        test.Errorf("tables in order %v", order)
+    }
+
+    expected := map[string]map[string][]string{
+        "player1": {
+            "gamepad": {"0"},
+            "a": {"key:A", "pad:RightRight"},
+            "start": {"key:Enter"},
+            "empty": nil,
+        },
+        "other": {
+            "up": {"key:#", "a \"quoted # mark\""},
+        },
+    }
+    if !reflect.DeepEqual(tables, expected) {
+        test.Errorf("parsed %v, expected %v", tables, expected)
+    }
+}
+
+func TestParseErrors(test *testing.T) {
+    inputs := map[string]string{
+        "header": "[player1",
+        "outside": "a = 1",
+        "no value": "[player1]\na",
+        "array": "[player1]\na = [\"key:A\"",
+        "string": "[player1]\na = \"key:A",
+        "array string": "[player1]\na = [key:A]",
+    }
+
+    for name, input := range inputs {
+        _, _, err := Parse(strings.NewReader(input))
+        if err == nil {
+            test.Errorf("%v: no error for %q", name, input)
+        }
+    }
+}
+
+func TestStripComment(test *testing.T) {
+    lines := map[string]string{
+        "a = 1 # one": "a = 1 ",
+        "# all": "",
+        "a = \"#\" # x": "a = \"#\" ",
+        "a = \"\\\"#\" # x": "a = \"\\\"#\" ",
+        "a = 1": "a = 1",
+    }
+
+    for line, expected := range lines {
+        if stripped := stripComment(line); stripped != expected {
+            test.Errorf("stripComment(%q) is %q, expected %q", line, stripped, expected)
+        }
+    }
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "path/filepath"
+
+    "github.com/kazzmir/gameboy/core"
+
+    "github.com/hajimehoshi/ebiten/v2"
+    "github.com/hajimehoshi/ebiten/v2/inpututil"
+    "github.com/hajimehoshi/ebiten/v2/ebitenutil"
+    "github.com/hajimehoshi/ebiten/v2/audio"
+)
+
+// plays a vgm register log through the apu, no rom needed
+type VGMEngine struct {
+    name string
+    apu *core.APU
+    player *core.VGMPlayer
+    rate int64
+    paused bool
+
+    audioPlayer *audio.Player
+}
+
+func loadVGMFromPath(path string) (*core.VGMFile, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    return core.LoadVGM(file)
+}
+
+func MakeVGMEngine(path string, loop bool, rate int64, audioContext *audio.Context) (*VGMEngine, error) {
+    vgm, err := loadVGMFromPath(path)
+    if err != nil {
+        return nil, err
+    }
+
+    apu := core.MakeAPU(SampleRate)
+    apu.SetScopeEnabled(true)
+
+    player := core.MakeVGMPlayer(vgm, apu)
+    player.Loop = loop
+
+    audioPlayer, err := audioContext.NewPlayerF32(apu.GetAudioStream())
+    if err != nil {
+        return nil, err
+    }
+    audioPlayer.SetBufferSize(time.Second / 10)
+    audioPlayer.Play()
+
+    return &VGMEngine{
+        name: filepath.Base(path),
+        apu: apu,
+        player: player,
+        rate: rate,
+        audioPlayer: audioPlayer,
+    }, nil
+}
+
+func (engine *VGMEngine) Update() error {
+    for _, key := range inpututil.AppendJustPressedKeys(nil) {
+        switch key {
+            case ebiten.KeyEscape, ebiten.KeyCapsLock:
+                return ebiten.Termination
+            case ebiten.KeyP:
+                engine.paused = !engine.paused
+                if engine.paused {
+                    engine.audioPlayer.Pause()
+                } else {
+                    engine.audioPlayer.Play()
+                }
+            case ebiten.KeyF1, ebiten.KeyF2, ebiten.KeyF3, ebiten.KeyF4:
+                channel := core.AllChannels[key - ebiten.KeyF1]
+                if ebiten.IsKeyPressed(ebiten.KeyShift) {
+                    engine.apu.SetSolo(channel, !engine.apu.IsSolo(channel))
+                } else {
+                    engine.apu.SetMuted(channel, !engine.apu.IsMuted(channel))
+                }
+        }
+    }
+
+    if engine.paused || engine.player.Done {
+        return nil
+    }
+
+    err := engine.player.Run(uint64(core.CPUSpeed / engine.rate))
+    engine.apu.UpdateRateControl(SampleRate / 20)
+    return err
+}
+
+func (engine *VGMEngine) Draw(screen *ebiten.Image) {
+    drawScope(screen, engine.apu)
+
+    status := ""
+    if engine.paused {
+        status = " paused"
+    } else if engine.player.Done {
+        status = " done"
+    }
+
+    elapsed := time.Duration(engine.player.Elapsed() * float64(time.Second))
+    ebitenutil.DebugPrintAt(screen, fmt.Sprintf("%v\n%v%v", engine.name, elapsed.Truncate(time.Second), status), 1, screen.Bounds().Dy() - 32)
+}
+
+func (engine *VGMEngine) Layout(outsideWidth, outsideHeight int) (int, int) {
+    return core.ScreenWidth, core.ScreenHeight
+}
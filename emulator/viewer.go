@@ -0,0 +1,210 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+
+    "github.com/kazzmir/gameboy/core"
+
+    "github.com/hajimehoshi/ebiten/v2"
+    "github.com/hajimehoshi/ebiten/v2/vector"
+    "github.com/hajimehoshi/ebiten/v2/ebitenutil"
+)
+
+// pages of the debug viewer, shown instead of the game while it keeps running
+type ViewerPage int
+
+const (
+    ViewerOff ViewerPage = iota
+    ViewerTiles
+    ViewerMaps
+    ViewerSprites
+    ViewerMemory
+    viewerPageCount
+)
+
+// size of the viewer, which fits both tile maps side by side
+const ViewerWidth = 528
+const ViewerHeight = 400
+
+var viewportColor = color.RGBA{R: 0xff, G: 0x40, B: 0x40, A: 0xff}
+var windowColor = color.RGBA{R: 0x40, G: 0x80, B: 0xff, A: 0xff}
+
+type DebugViewer struct {
+    Page ViewerPage
+
+    tiles *ebiten.Image
+    maps [2]*ebiten.Image
+    sprites *ebiten.Image
+
+    Memory MemoryEditor
+}
+
+func (viewer *DebugViewer) NextPage() {
+    viewer.Page = (viewer.Page + 1) % viewerPageCount
+}
+
+func (viewer *DebugViewer) Active() bool {
+    return viewer.Page != ViewerOff
+}
+
+// copy an image into an ebiten image, making it the first time
+func updateImage(target **ebiten.Image, source *image.RGBA) *ebiten.Image {
+    if *target == nil {
+        *target = ebiten.NewImage(source.Bounds().Dx(), source.Bounds().Dy())
+    }
+    (*target).WritePixels(source.Pix)
+    return *target
+}
+
+func (viewer *DebugViewer) Draw(screen *ebiten.Image, cpu *core.CPU) {
+    screen.Fill(color.RGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xff})
+
+    switch viewer.Page {
+        case ViewerTiles: viewer.drawTiles(screen, cpu.PPU)
+        case ViewerMaps: viewer.drawMaps(screen, cpu.PPU)
+        case ViewerSprites: viewer.drawSprites(screen, cpu.PPU)
+        case ViewerMemory: viewer.Memory.Draw(screen, cpu)
+    }
+}
+
+// the tiles at 2x, with the address of the one under the mouse
+func (viewer *DebugViewer) drawTiles(screen *ebiten.Image, ppu *core.PPU) {
+    const scale = 2
+    const left = 8
+    const top = 8
+
+    tiles := updateImage(&viewer.tiles, ppu.RenderTiles())
+
+    var options ebiten.DrawImageOptions
+    options.GeoM.Scale(scale, scale)
+    options.GeoM.Translate(left, top)
+    screen.DrawImage(tiles, &options)
+
+    // a line between each block of 128 tiles
+    for block := 1; block < 3; block++ {
+        y := float32(top + block * 128 / core.TileViewColumns * 8 * scale)
+        vector.StrokeLine(screen, left, y, left + core.TileViewColumns * 8 * scale, y, 1, viewportColor, false)
+    }
+
+    info := "Tiles\n\n0x8000-0x87ff\n0x8800-0x8fff\n0x9000-0x97ff"
+
+    mouseX, mouseY := ebiten.CursorPosition()
+    column := (mouseX - left) / (8 * scale)
+    row := (mouseY - top) / (8 * scale)
+    if mouseX >= left && mouseY >= top && column < core.TileViewColumns && row < core.TileViewRows {
+        tile := row * core.TileViewColumns + column
+        info += fmt.Sprintf("\n\nTile %v\nAddress 0x%04x\nIndex 0x%02x", tile, 0x8000 + tile * 16, tile % 256)
+
+        var zoom ebiten.DrawImageOptions
+        zoom.GeoM.Scale(8, 8)
+        zoom.GeoM.Translate(300, 200)
+        bounds := image.Rect(column * 8, row * 8, column * 8 + 8, row * 8 + 8)
+        screen.DrawImage(tiles.SubImage(bounds).(*ebiten.Image), &zoom)
+    }
+
+    ebitenutil.DebugPrintAt(screen, info, 300, 8)
+}
+
+// draw a rectangle on a 256x256 map, wrapping around the edges like the ppu does
+func drawWrappedRect(screen *ebiten.Image, left float32, top float32, x int, y int, width int, height int, clr color.RGBA) {
+    for _, offsetX := range []int{0, -256} {
+        for _, offsetY := range []int{0, -256} {
+            rectX := x + offsetX
+            rectY := y + offsetY
+            if rectX + width <= 0 || rectY + height <= 0 || rectX >= 256 || rectY >= 256 {
+                continue
+            }
+
+            // clip to the map
+            x1 := max(rectX, 0)
+            y1 := max(rectY, 0)
+            x2 := min(rectX + width, 256)
+            y2 := min(rectY + height, 256)
+            vector.StrokeRect(screen, left + float32(x1), top + float32(y1), float32(x2 - x1), float32(y2 - y1), 1, clr, false)
+        }
+    }
+}
+
+// both tile maps with the part shown by the background and the window outlined
+func (viewer *DebugViewer) drawMaps(screen *ebiten.Image, ppu *core.PPU) {
+    const top = 24
+    lefts := [2]float32{8, 264}
+    addresses := [2]uint16{0x9800 - 0x8000, 0x9c00 - 0x8000}
+
+    for i, address := range addresses {
+        tileMap := updateImage(&viewer.maps[i], ppu.RenderTileMap(address))
+
+        var options ebiten.DrawImageOptions
+        options.GeoM.Translate(float64(lefts[i]), top)
+        screen.DrawImage(tileMap, &options)
+
+        label := fmt.Sprintf("0x%04x", 0x8000 + int(address))
+        if ppu.BackgroundTileMapAddress() == address {
+            label += " background"
+        }
+        if ppu.WindowTileMap() == address {
+            label += " window"
+        }
+        ebitenutil.DebugPrintAt(screen, label, int(lefts[i]), 4)
+
+        if ppu.BackgroundTileMapAddress() == address && ppu.GetBackgroundEnabled() {
+            drawWrappedRect(screen, lefts[i], top, int(ppu.ViewPortX), int(ppu.ViewPortY), core.ScreenWidth, core.ScreenHeight, viewportColor)
+        }
+
+        // the window is drawn from the top left of its map
+        if ppu.WindowTileMap() == address && ppu.ShowWindow() {
+            width := core.ScreenWidth - (int(ppu.WindowX) - 7)
+            height := core.ScreenHeight - int(ppu.WindowY)
+            if width > 0 && height > 0 {
+                vector.StrokeRect(screen, lefts[i], top, float32(min(width, 256)), float32(min(height, 256)), 1, windowColor, false)
+            }
+        }
+    }
+
+    ebitenutil.DebugPrintAt(screen, fmt.Sprintf("SCX %3v SCY %3v   WX %3v WY %3v   LCDC %08b", ppu.ViewPortX, ppu.ViewPortY, ppu.WindowX, ppu.WindowY, ppu.LCDControl), 8, top + 256 + 8)
+}
+
+// each oam entry with its tile, position, flags and palette
+func (viewer *DebugViewer) drawSprites(screen *ebiten.Image, ppu *core.PPU) {
+    const rowHeight = 19
+    const columnWidth = 264
+
+    sprites := updateImage(&viewer.sprites, ppu.RenderSprites())
+
+    height := 8
+    if ppu.LargeSpriteMode() {
+        height = 16
+    }
+
+    for index, sprite := range ppu.ReadSprites() {
+        left := 8 + index / 20 * columnWidth
+        top := 4 + index % 20 * rowHeight
+
+        var options ebiten.DrawImageOptions
+        if height == 16 {
+            options.GeoM.Translate(float64(left), float64(top + 1))
+        } else {
+            options.GeoM.Scale(2, 2)
+            options.GeoM.Translate(float64(left - 4), float64(top + 1))
+        }
+        screen.DrawImage(sprites.SubImage(image.Rect(index * 8, 0, index * 8 + 8, height)).(*ebiten.Image), &options)
+
+        flags := []byte("--")
+        if sprite.XFlipped() {
+            flags[0] = 'X'
+        }
+        if sprite.YFlipped() {
+            flags[1] = 'Y'
+        }
+
+        priority := ""
+        if sprite.Attributes & 0x80 != 0 {
+            priority = " behind"
+        }
+
+        text := fmt.Sprintf("%02v x%3v y%3v t%02x %s p%v%v", index, sprite.X, sprite.Y, sprite.TileIndex, flags, sprite.Palette(), priority)
+        ebitenutil.DebugPrintAt(screen, text, left + 16, top)
+    }
+}
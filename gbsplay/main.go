@@ -0,0 +1,206 @@
+package main
+
+// play the songs in a gbs file, or render them to wav files
+//
+//   gbsplay [-time 150] [-wav prefix] file.gbs [start [stop]]
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "flag"
+    "time"
+    "strconv"
+    "os/signal"
+
+    "github.com/kazzmir/gameboy/core"
+
+    "github.com/hajimehoshi/ebiten/v2/audio"
+)
+
+const SampleRate = 44100
+
+// the player is run in steps of this many master clocks
+const stepClocks = core.CPUSpeed / 60
+
+func loadGBSFromPath(path string) (*core.GBSFile, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    return core.LoadGBS(file)
+}
+
+// render a song to a wav file as fast as possible
+func renderSong(player *core.GBSPlayer, song int, seconds int, path string) error {
+    err := player.StartSong(song)
+    if err != nil {
+        return err
+    }
+
+    file, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    wav, err := core.MakeWavWriter(file, SampleRate)
+    if err != nil {
+        return err
+    }
+
+    samples := make([]float32, 4096)
+    drain := func() error {
+        stream := player.Cpu.APU.GetAudioStream()
+        for {
+            count := stream.ReadSamples(samples)
+            if count == 0 {
+                return nil
+            }
+
+            for i := 0; i < count; i += 2 {
+                err := wav.AddSample(samples[i], samples[i+1])
+                if err != nil {
+                    return err
+                }
+            }
+        }
+    }
+
+    for player.Elapsed() < float64(seconds) {
+        player.Run(stepClocks)
+        err := drain()
+        if err != nil {
+            return err
+        }
+    }
+
+    return wav.Close()
+}
+
+// play a song in real time through the audio device
+func playSong(player *core.GBSPlayer, song int, seconds int, quit chan os.Signal) (bool, error) {
+    err := player.StartSong(song)
+    if err != nil {
+        return false, err
+    }
+
+    ticker := time.NewTicker(time.Second / 60)
+    defer ticker.Stop()
+
+    lastSecond := -1
+    for player.Elapsed() < float64(seconds) {
+        select {
+            case <-quit:
+                return true, nil
+            case <-ticker.C:
+        }
+
+        player.Run(stepClocks)
+        player.Cpu.APU.UpdateRateControl(SampleRate / 20)
+
+        second := int(player.Elapsed())
+        if second != lastSecond {
+            lastSecond = second
+            fmt.Printf("\r%02d:%02d / %02d:%02d", second / 60, second % 60, seconds / 60, seconds % 60)
+        }
+    }
+
+    fmt.Println()
+
+    return false, nil
+}
+
+func main() {
+    seconds := flag.Int("time", 150, "Seconds to play each song for")
+    wavPrefix := flag.String("wav", "", "Render each song to <prefix>-<song>.wav instead of playing it")
+    flag.Usage = func() {
+        fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [options] file.gbs [start [stop]]\n", os.Args[0])
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+
+    if flag.NArg() < 1 {
+        flag.Usage()
+        os.Exit(1)
+    }
+
+    gbs, err := loadGBSFromPath(flag.Arg(0))
+    if err != nil {
+        log.Printf("Error: %v", err)
+        os.Exit(1)
+    }
+
+    // songs on the command line are numbered from 1
+    start := int(gbs.FirstSong)
+    stop := int(gbs.Songs)
+    if flag.NArg() > 1 {
+        start, err = strconv.Atoi(flag.Arg(1))
+        if err != nil {
+            log.Printf("Invalid start song: %v", flag.Arg(1))
+            os.Exit(1)
+        }
+    }
+    if flag.NArg() > 2 {
+        stop, err = strconv.Atoi(flag.Arg(2))
+        if err != nil {
+            log.Printf("Invalid stop song: %v", flag.Arg(2))
+            os.Exit(1)
+        }
+    }
+
+    fmt.Printf("Title:     %v\n", gbs.Title)
+    fmt.Printf("Author:    %v\n", gbs.Author)
+    fmt.Printf("Copyright: %v\n", gbs.Copyright)
+    fmt.Printf("Songs:     %v\n", gbs.Songs)
+
+    player, err := core.MakeGBSPlayer(gbs, SampleRate)
+    if err != nil {
+        log.Printf("Error: %v", err)
+        os.Exit(1)
+    }
+
+    if *wavPrefix != "" {
+        for song := start; song <= stop; song++ {
+            path := fmt.Sprintf("%v-%02d.wav", *wavPrefix, song)
+            fmt.Printf("Song %v/%v -> %v\n", song, gbs.Songs, path)
+            err := renderSong(player, song - 1, *seconds, path)
+            if err != nil {
+                log.Printf("Error: %v", err)
+                os.Exit(1)
+            }
+        }
+
+        return
+    }
+
+    audioContext := audio.NewContext(SampleRate)
+    // every song shares the stream of the first cpu
+    audioPlayer, err := audioContext.NewPlayerF32(player.Cpu.APU.GetAudioStream())
+    if err != nil {
+        log.Printf("Error: %v", err)
+        os.Exit(1)
+    }
+    audioPlayer.SetBufferSize(time.Second / 10)
+    audioPlayer.Play()
+
+    quit := make(chan os.Signal, 1)
+    signal.Notify(quit, os.Interrupt)
+
+    for song := start; song <= stop; song++ {
+        fmt.Printf("Song %v/%v\n", song, gbs.Songs)
+        done, err := playSong(player, song - 1, *seconds, quit)
+        if err != nil {
+            log.Printf("Error: %v", err)
+            os.Exit(1)
+        }
+        if done {
+            fmt.Println()
+            break
+        }
+    }
+
+    audioPlayer.Close()
+}
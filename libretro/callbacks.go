@@ -0,0 +1,88 @@
+package main
+
+/*
+#include "libretro.h"
+
+// the frontend hands over its callbacks before loading a game. these are plain c
+// because go can't call a c function pointer
+
+static retro_environment_t environment;
+static retro_video_refresh_t video_refresh;
+static retro_audio_sample_t audio_sample;
+static retro_audio_sample_batch_t audio_sample_batch;
+static retro_input_poll_t input_poll;
+static retro_input_state_t input_state;
+static retro_log_printf_t log_printf;
+
+void retro_set_environment(retro_environment_t callback) {
+    environment = callback;
+
+    struct retro_log_callback logging;
+    if (environment(RETRO_ENVIRONMENT_GET_LOG_INTERFACE, &logging)) {
+        log_printf = logging.log;
+    } else {
+        log_printf = NULL;
+    }
+}
+
+void retro_set_video_refresh(retro_video_refresh_t callback) {
+    video_refresh = callback;
+}
+
+void retro_set_audio_sample(retro_audio_sample_t callback) {
+    audio_sample = callback;
+}
+
+void retro_set_audio_sample_batch(retro_audio_sample_batch_t callback) {
+    audio_sample_batch = callback;
+}
+
+void retro_set_input_poll(retro_input_poll_t callback) {
+    input_poll = callback;
+}
+
+void retro_set_input_state(retro_input_state_t callback) {
+    input_state = callback;
+}
+
+bool call_environment(unsigned cmd, void *data) {
+    return environment != NULL && environment(cmd, data);
+}
+
+void call_video_refresh(const void *data, unsigned width, unsigned height, size_t pitch) {
+    if (video_refresh != NULL) {
+        video_refresh(data, width, height, pitch);
+    }
+}
+
+size_t call_audio_sample_batch(const int16_t *data, size_t frames) {
+    if (audio_sample_batch == NULL) {
+        return frames;
+    }
+    return audio_sample_batch(data, frames);
+}
+
+void call_input_poll(void) {
+    if (input_poll != NULL) {
+        input_poll();
+    }
+}
+
+int16_t call_input_state(unsigned port, unsigned device, unsigned index, unsigned id) {
+    if (input_state == NULL) {
+        return 0;
+    }
+    return input_state(port, device, index, id);
+}
+
+bool have_log(void) {
+    return log_printf != NULL;
+}
+
+void call_log(enum retro_log_level level, const char *message) {
+    if (log_printf != NULL) {
+        log_printf(level, "%s\n", message);
+    }
+}
+*/
+import "C"
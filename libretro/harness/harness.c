@@ -0,0 +1,299 @@
+/* loads a libretro core the way a frontend would and checks that it runs, for testing
+ * the core without installing retroarch
+ *
+ *   make libretro libretro-harness
+ *   ./libretro-harness ./gameboy_libretro.so game.gb [frames] [out.ppm]
+ *
+ * runs the game for some frames while holding start, then saves a state, runs on,
+ * loads the state and runs again to check the frames come out the same. exits with
+ * 1 if anything fails
+ */
+
+#include <dlfcn.h>
+#include <stdarg.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "../libretro.h"
+
+struct core {
+    void (*init)(void);
+    void (*deinit)(void);
+    unsigned (*api_version)(void);
+    void (*get_system_info)(struct retro_system_info *info);
+    void (*get_system_av_info)(struct retro_system_av_info *info);
+    void (*set_environment)(retro_environment_t);
+    void (*set_video_refresh)(retro_video_refresh_t);
+    void (*set_audio_sample)(retro_audio_sample_t);
+    void (*set_audio_sample_batch)(retro_audio_sample_batch_t);
+    void (*set_input_poll)(retro_input_poll_t);
+    void (*set_input_state)(retro_input_state_t);
+    bool (*load_game)(const struct retro_game_info *game);
+    void (*unload_game)(void);
+    void (*run)(void);
+    size_t (*serialize_size)(void);
+    bool (*serialize)(void *data, size_t size);
+    bool (*unserialize)(const void *data, size_t size);
+    void *(*get_memory_data)(unsigned id);
+    size_t (*get_memory_size)(unsigned id);
+};
+
+static uint32_t frame[160 * 144];
+static unsigned frame_width;
+static unsigned frame_height;
+static unsigned long frames_drawn;
+static unsigned long audio_frames;
+static int pixel_format = -1;
+
+static void core_log(enum retro_log_level level, const char *fmt, ...) {
+    static const char *levels[] = {"debug", "info", "warn", "error"};
+    va_list args;
+
+    fprintf(stderr, "[core %s] ", level <= RETRO_LOG_ERROR ? levels[level] : "?");
+    va_start(args, fmt);
+    vfprintf(stderr, fmt, args);
+    va_end(args);
+}
+
+static bool environment(unsigned cmd, void *data) {
+    switch (cmd) {
+        case RETRO_ENVIRONMENT_SET_PIXEL_FORMAT:
+            pixel_format = *(enum retro_pixel_format *) data;
+            return pixel_format == RETRO_PIXEL_FORMAT_XRGB8888;
+        case RETRO_ENVIRONMENT_GET_LOG_INTERFACE:
+            ((struct retro_log_callback *) data)->log = core_log;
+            return true;
+    }
+    return false;
+}
+
+static void video_refresh(const void *data, unsigned width, unsigned height, size_t pitch) {
+    unsigned y;
+
+    frames_drawn += 1;
+    if (data == NULL || width > 160 || height > 144) {
+        return;
+    }
+
+    frame_width = width;
+    frame_height = height;
+    for (y = 0; y < height; y++) {
+        memcpy(&frame[y * width], (const uint8_t *) data + y * pitch, width * 4);
+    }
+}
+
+static void audio_sample(int16_t left, int16_t right) {
+    audio_frames += 1;
+}
+
+static size_t audio_sample_batch(const int16_t *data, size_t frames) {
+    audio_frames += frames;
+    return frames;
+}
+
+static void input_poll(void) {
+}
+
+static int16_t input_state(unsigned port, unsigned device, unsigned index, unsigned id) {
+    return port == 0 && device == RETRO_DEVICE_JOYPAD && id == RETRO_DEVICE_ID_JOYPAD_START;
+}
+
+static void *load_symbol(void *library, const char *name) {
+    void *symbol = dlsym(library, name);
+    if (symbol == NULL) {
+        fprintf(stderr, "core is missing %s\n", name);
+        exit(1);
+    }
+    return symbol;
+}
+
+static void *read_file(const char *path, size_t *size) {
+    FILE *file = fopen(path, "rb");
+    void *data;
+    long length;
+
+    if (file == NULL) {
+        perror(path);
+        exit(1);
+    }
+
+    fseek(file, 0, SEEK_END);
+    length = ftell(file);
+    fseek(file, 0, SEEK_SET);
+
+    data = malloc(length);
+    if (fread(data, 1, length, file) != (size_t) length) {
+        fprintf(stderr, "unable to read %s\n", path);
+        exit(1);
+    }
+    fclose(file);
+
+    *size = length;
+    return data;
+}
+
+static uint32_t checksum(void) {
+    uint32_t sum = 2166136261u;
+    size_t i;
+
+    for (i = 0; i < sizeof(frame) / sizeof(frame[0]); i++) {
+        sum = (sum ^ frame[i]) * 16777619u;
+    }
+    return sum;
+}
+
+/* run some frames and return the checksum of the last one */
+static uint32_t run_frames(struct core *core, int count) {
+    int i;
+    for (i = 0; i < count; i++) {
+        core->run();
+    }
+    return checksum();
+}
+
+static void write_ppm(const char *path) {
+    FILE *file = fopen(path, "wb");
+    unsigned i;
+
+    if (file == NULL) {
+        perror(path);
+        return;
+    }
+
+    fprintf(file, "P6\n%u %u\n255\n", frame_width, frame_height);
+    for (i = 0; i < frame_width * frame_height; i++) {
+        uint8_t rgb[3] = {frame[i] >> 16, frame[i] >> 8, frame[i]};
+        fwrite(rgb, 1, 3, file);
+    }
+    fclose(file);
+}
+
+int main(int argc, char **argv) {
+    struct core core;
+    struct retro_system_info system;
+    struct retro_system_av_info av;
+    struct retro_game_info game = {0};
+    void *library;
+    void *state;
+    size_t state_size;
+    uint32_t first, second;
+    int frames = 300;
+    int failed = 0;
+
+    if (argc < 3) {
+        fprintf(stderr, "usage: %s core.so rom [frames] [out.ppm]\n", argv[0]);
+        return 1;
+    }
+
+    if (argc > 3) {
+        frames = atoi(argv[3]);
+    }
+
+    library = dlopen(argv[1], RTLD_NOW | RTLD_LOCAL);
+    if (library == NULL) {
+        fprintf(stderr, "%s\n", dlerror());
+        return 1;
+    }
+
+    core.init = load_symbol(library, "retro_init");
+    core.deinit = load_symbol(library, "retro_deinit");
+    core.api_version = load_symbol(library, "retro_api_version");
+    core.get_system_info = load_symbol(library, "retro_get_system_info");
+    core.get_system_av_info = load_symbol(library, "retro_get_system_av_info");
+    core.set_environment = load_symbol(library, "retro_set_environment");
+    core.set_video_refresh = load_symbol(library, "retro_set_video_refresh");
+    core.set_audio_sample = load_symbol(library, "retro_set_audio_sample");
+    core.set_audio_sample_batch = load_symbol(library, "retro_set_audio_sample_batch");
+    core.set_input_poll = load_symbol(library, "retro_set_input_poll");
+    core.set_input_state = load_symbol(library, "retro_set_input_state");
+    core.load_game = load_symbol(library, "retro_load_game");
+    core.unload_game = load_symbol(library, "retro_unload_game");
+    core.run = load_symbol(library, "retro_run");
+    core.serialize_size = load_symbol(library, "retro_serialize_size");
+    core.serialize = load_symbol(library, "retro_serialize");
+    core.unserialize = load_symbol(library, "retro_unserialize");
+    core.get_memory_data = load_symbol(library, "retro_get_memory_data");
+    core.get_memory_size = load_symbol(library, "retro_get_memory_size");
+
+    if (core.api_version() != RETRO_API_VERSION) {
+        fprintf(stderr, "core has api version %u\n", core.api_version());
+        return 1;
+    }
+
+    core.get_system_info(&system);
+    printf("core: %s %s (%s)\n", system.library_name, system.library_version, system.valid_extensions);
+
+    core.set_environment(environment);
+    core.set_video_refresh(video_refresh);
+    core.set_audio_sample(audio_sample);
+    core.set_audio_sample_batch(audio_sample_batch);
+    core.set_input_poll(input_poll);
+    core.set_input_state(input_state);
+    core.init();
+
+    game.path = argv[2];
+    game.data = read_file(argv[2], &game.size);
+    if (!core.load_game(&game)) {
+        fprintf(stderr, "core could not load %s\n", argv[2]);
+        return 1;
+    }
+
+    if (pixel_format != RETRO_PIXEL_FORMAT_XRGB8888) {
+        fprintf(stderr, "core did not ask for xrgb8888\n");
+        failed = 1;
+    }
+
+    core.get_system_av_info(&av);
+    printf("video: %ux%u at %.3f fps, audio: %.0f hz\n", av.geometry.base_width, av.geometry.base_height, av.timing.fps, av.timing.sample_rate);
+
+    run_frames(&core, frames);
+    printf("ran %d frames: %lu drawn, %lu audio frames (%.1f per frame)\n", frames, frames_drawn, audio_frames, (double) audio_frames / frames);
+
+    if (frames_drawn != (unsigned long) frames) {
+        fprintf(stderr, "expected a video refresh for every frame\n");
+        failed = 1;
+    }
+
+    printf("save ram: %zu bytes, rtc: %zu bytes\n", core.get_memory_size(RETRO_MEMORY_SAVE_RAM), core.get_memory_size(RETRO_MEMORY_RTC));
+
+    /* a state loaded after running on has to give the same frames again */
+    state_size = core.serialize_size();
+    state = malloc(state_size);
+    if (!core.serialize(state, state_size)) {
+        fprintf(stderr, "serialize failed\n");
+        return 1;
+    }
+
+    first = run_frames(&core, 60);
+
+    if (!core.unserialize(state, state_size)) {
+        fprintf(stderr, "unserialize failed\n");
+        return 1;
+    }
+
+    second = run_frames(&core, 60);
+
+    printf("save state: %zu bytes, frame %08x after saving, %08x after loading\n", state_size, first, second);
+    if (first != second) {
+        fprintf(stderr, "frames differ after loading the state\n");
+        failed = 1;
+    }
+
+    if (argc > 4) {
+        write_ppm(argv[4]);
+    }
+
+    core.unload_game();
+    core.deinit();
+    free(state);
+    free((void *) game.data);
+
+    if (failed) {
+        printf("FAIL\n");
+        return 1;
+    }
+
+    printf("OK\n");
+    return 0;
+}
@@ -0,0 +1,403 @@
+package main
+
+// a libretro core, build it with
+//   go build -buildmode=c-shared -o gameboy_libretro.so ./libretro
+
+/*
+#include <stdlib.h>
+#include "libretro.h"
+*/
+import "C"
+
+import (
+    "bytes"
+    "context"
+    "log/slog"
+    "math"
+    "os"
+    "runtime"
+    "strings"
+    "sync"
+    "unsafe"
+
+    "github.com/kazzmir/gameboy/core"
+)
+
+const SampleRate = 44100
+
+// the libretro joypad id of each gameboy button
+var buttonIds = map[core.Button]C.unsigned{
+    core.ButtonA: C.RETRO_DEVICE_ID_JOYPAD_A,
+    core.ButtonB: C.RETRO_DEVICE_ID_JOYPAD_B,
+    core.ButtonSelect: C.RETRO_DEVICE_ID_JOYPAD_SELECT,
+    core.ButtonStart: C.RETRO_DEVICE_ID_JOYPAD_START,
+    core.ButtonUp: C.RETRO_DEVICE_ID_JOYPAD_UP,
+    core.ButtonDown: C.RETRO_DEVICE_ID_JOYPAD_DOWN,
+    core.ButtonLeft: C.RETRO_DEVICE_ID_JOYPAD_LEFT,
+    core.ButtonRight: C.RETRO_DEVICE_ID_JOYPAD_RIGHT,
+}
+
+// everything about the loaded game, nil when there is none
+type Game struct {
+    File *core.GameboyFile
+    MBC core.MBC
+    Machine *core.Machine
+
+    // the size of a save state, which stays the same for a rom
+    stateSize int
+    // keeps the save ram and clock in place while the frontend holds pointers to them
+    pinner runtime.Pinner
+
+    video []uint32
+    audio []int16
+    pressed map[core.Button]bool
+}
+
+var game *Game
+
+// the memory the frontend can save next to the rom
+type saveRAM interface {
+    SaveRAM() []uint8
+}
+
+type clock interface {
+    RTC() []uint8
+}
+
+// sends each log message to the frontend at the matching level, or to stderr if the
+// frontend has no log interface
+type frontendWriter struct {
+    level C.enum_retro_log_level
+}
+
+func (writer *frontendWriter) Write(data []byte) (int, error) {
+    // frontends without a log interface leave logging to the core
+    if !C.have_log() {
+        return os.Stderr.Write(data)
+    }
+
+    message := C.CString(strings.TrimRight(string(data), "\n"))
+    C.call_log(writer.level, message)
+    C.free(unsafe.Pointer(message))
+    return len(data), nil
+}
+
+// formats records as text and passes them to the frontend's log interface
+type frontendHandler struct {
+    slog.Handler
+    writer *frontendWriter
+    lock *sync.Mutex
+}
+
+func makeFrontendHandler() *frontendHandler {
+    writer := &frontendWriter{}
+    options := slog.HandlerOptions{
+        Level: slog.LevelDebug,
+        // the frontend shows the time and level itself
+        ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+            if len(groups) == 0 && (attr.Key == slog.TimeKey || attr.Key == slog.LevelKey) {
+                return slog.Attr{}
+            }
+            return attr
+        },
+    }
+
+    return &frontendHandler{
+        Handler: slog.NewTextHandler(writer, &options),
+        writer: writer,
+        lock: &sync.Mutex{},
+    }
+}
+
+func (handler *frontendHandler) Handle(context context.Context, record slog.Record) error {
+    handler.lock.Lock()
+    defer handler.lock.Unlock()
+
+    switch {
+        case record.Level >= slog.LevelError: handler.writer.level = C.RETRO_LOG_ERROR
+        case record.Level >= slog.LevelWarn: handler.writer.level = C.RETRO_LOG_WARN
+        case record.Level >= slog.LevelInfo: handler.writer.level = C.RETRO_LOG_INFO
+        default: handler.writer.level = C.RETRO_LOG_DEBUG
+    }
+
+    return handler.Handler.Handle(context, record)
+}
+
+func (handler *frontendHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return &frontendHandler{Handler: handler.Handler.WithAttrs(attrs), writer: handler.writer, lock: handler.lock}
+}
+
+func (handler *frontendHandler) WithGroup(name string) slog.Handler {
+    return &frontendHandler{Handler: handler.Handler.WithGroup(name), writer: handler.writer, lock: handler.lock}
+}
+
+// shared by every cpu so that they have the same rate limit
+var frontendLogger = core.MakeLogger(makeFrontendHandler())
+
+func logger() *core.Logger {
+    return frontendLogger
+}
+
+func logError(message string) {
+    logger().Error(core.LogIO, message)
+}
+
+// a cpu that starts from power on with the game's mbc, so the save ram stays where it
+// is. the mbc has to be reset first if it was used before
+func makeCpu(file *core.GameboyFile, mbc core.MBC) *core.CPU {
+    cpu := core.MakeCPU(mbc, SampleRate)
+    cpu.SetLogger(logger())
+    cpu.InitializeDMG()
+    cpu.CGB = file.GetCGBFlag() & 0x80 != 0
+    cpu.Error = true
+    return cpu
+}
+
+func main() {
+}
+
+//export retro_init
+func retro_init() {
+}
+
+//export retro_deinit
+func retro_deinit() {
+    retro_unload_game()
+}
+
+//export retro_api_version
+func retro_api_version() C.unsigned {
+    return C.RETRO_API_VERSION
+}
+
+var libraryName = C.CString("gameboy")
+var libraryVersion = C.CString("1.0")
+var extensions = C.CString("gb|gbc")
+
+//export retro_get_system_info
+func retro_get_system_info(info *C.struct_retro_system_info) {
+    *info = C.struct_retro_system_info{
+        library_name: libraryName,
+        library_version: libraryVersion,
+        valid_extensions: extensions,
+        need_fullpath: false,
+        block_extract: false,
+    }
+}
+
+//export retro_get_system_av_info
+func retro_get_system_av_info(info *C.struct_retro_system_av_info) {
+    *info = C.struct_retro_system_av_info{
+        geometry: C.struct_retro_game_geometry{
+            base_width: core.ScreenWidth,
+            base_height: core.ScreenHeight,
+            max_width: core.ScreenWidth,
+            max_height: core.ScreenHeight,
+            aspect_ratio: C.float(core.ScreenWidth) / C.float(core.ScreenHeight),
+        },
+        timing: C.struct_retro_system_timing{
+            fps: C.double(core.CPUSpeed) / C.double(core.FrameClocks),
+            sample_rate: SampleRate,
+        },
+    }
+}
+
+//export retro_set_controller_port_device
+func retro_set_controller_port_device(port C.unsigned, device C.unsigned) {
+}
+
+//export retro_reset
+func retro_reset() {
+    if game != nil {
+        game.MBC.Reset()
+        game.Machine = core.MakeMachine(makeCpu(game.File, game.MBC))
+    }
+}
+
+//export retro_run
+func retro_run() {
+    if game == nil {
+        return
+    }
+
+    C.call_input_poll()
+    for button, id := range buttonIds {
+        game.pressed[button] = C.call_input_state(0, C.RETRO_DEVICE_JOYPAD, 0, id) != 0
+    }
+    game.Machine.SetInput(game.pressed)
+
+    game.Machine.RunFrame()
+
+    frame := game.Machine.Framebuffer()
+    for y := 0; y < core.ScreenHeight; y++ {
+        for x := 0; x < core.ScreenWidth; x++ {
+            offset := y * frame.Stride + x * 4
+            red := uint32(frame.Pix[offset])
+            green := uint32(frame.Pix[offset + 1])
+            blue := uint32(frame.Pix[offset + 2])
+            game.video[y * core.ScreenWidth + x] = red << 16 | green << 8 | blue
+        }
+    }
+    C.call_video_refresh(unsafe.Pointer(&game.video[0]), core.ScreenWidth, core.ScreenHeight, core.ScreenWidth * 4)
+
+    samples := game.Machine.DrainAudio()
+    game.audio = game.audio[:0]
+    for _, sample := range samples {
+        game.audio = append(game.audio, int16(math.Round(float64(max(-1, min(1, sample))) * math.MaxInt16)))
+    }
+
+    // the frontend can take fewer frames than it was given
+    audio := game.audio
+    for len(audio) >= 2 {
+        taken := int(C.call_audio_sample_batch((*C.int16_t)(unsafe.Pointer(&audio[0])), C.size_t(len(audio) / 2)))
+        if taken == 0 {
+            break
+        }
+        audio = audio[taken * 2:]
+    }
+}
+
+//export retro_serialize_size
+func retro_serialize_size() C.size_t {
+    if game == nil {
+        return 0
+    }
+    return C.size_t(game.stateSize)
+}
+
+//export retro_serialize
+func retro_serialize(data unsafe.Pointer, size C.size_t) C.bool {
+    if game == nil {
+        return false
+    }
+
+    state := game.Machine.Cpu.SaveState()
+    if len(state) > int(size) {
+        return false
+    }
+
+    copy(unsafe.Slice((*byte)(data), size), state)
+    return true
+}
+
+//export retro_unserialize
+func retro_unserialize(data unsafe.Pointer, size C.size_t) C.bool {
+    if game == nil {
+        return false
+    }
+
+    err := game.Machine.Cpu.LoadState(C.GoBytes(data, C.int(size)))
+    if err != nil {
+        logError("unable to load state: " + err.Error())
+        return false
+    }
+
+    return true
+}
+
+//export retro_cheat_reset
+func retro_cheat_reset() {
+}
+
+//export retro_cheat_set
+func retro_cheat_set(index C.unsigned, enabled C.bool, code *C.char) {
+}
+
+//export retro_load_game
+func retro_load_game(info *C.struct_retro_game_info) C.bool {
+    retro_unload_game()
+
+    if info == nil || info.data == nil {
+        logError("the rom has to be passed in memory")
+        return false
+    }
+
+    file, err := core.LoadGameboy(bytes.NewReader(C.GoBytes(info.data, C.int(info.size))))
+    if err != nil {
+        logError("unable to load rom: " + err.Error())
+        return false
+    }
+
+    mbc, err := core.MakeMBC(file.GetCartridgeType(), file.GetRom())
+    if err != nil {
+        logError("unhandled cartridge type: " + err.Error())
+        return false
+    }
+
+    format := C.enum_retro_pixel_format(C.RETRO_PIXEL_FORMAT_XRGB8888)
+    if !C.call_environment(C.RETRO_ENVIRONMENT_SET_PIXEL_FORMAT, unsafe.Pointer(&format)) {
+        logError("the frontend does not support xrgb8888")
+        return false
+    }
+
+    game = &Game{
+        File: file,
+        MBC: mbc,
+        Machine: core.MakeMachine(makeCpu(file, mbc)),
+        video: make([]uint32, core.ScreenWidth * core.ScreenHeight),
+        pressed: make(map[core.Button]bool),
+    }
+    game.stateSize = len(game.Machine.Cpu.SaveState())
+
+    if memory := saveMemory(C.RETRO_MEMORY_SAVE_RAM); len(memory) > 0 {
+        game.pinner.Pin(&memory[0])
+    }
+    if memory := saveMemory(C.RETRO_MEMORY_RTC); len(memory) > 0 {
+        game.pinner.Pin(&memory[0])
+    }
+
+    return true
+}
+
+//export retro_load_game_special
+func retro_load_game_special(gameType C.unsigned, info *C.struct_retro_game_info, count C.size_t) C.bool {
+    return false
+}
+
+//export retro_unload_game
+func retro_unload_game() {
+    if game != nil {
+        game.pinner.Unpin()
+        game = nil
+    }
+    logger().Flush()
+}
+
+//export retro_get_region
+func retro_get_region() C.unsigned {
+    return C.RETRO_REGION_NTSC
+}
+
+// the save ram or clock of the game, or nil if the cartridge doesn't have one
+func saveMemory(id C.unsigned) []uint8 {
+    if game == nil {
+        return nil
+    }
+
+    switch id {
+        case C.RETRO_MEMORY_SAVE_RAM:
+            if ram, ok := game.MBC.(saveRAM); ok {
+                return ram.SaveRAM()
+            }
+        case C.RETRO_MEMORY_RTC:
+            if rtc, ok := game.MBC.(clock); ok {
+                return rtc.RTC()
+            }
+    }
+
+    return nil
+}
+
+//export retro_get_memory_data
+func retro_get_memory_data(id C.unsigned) unsafe.Pointer {
+    memory := saveMemory(id)
+    if len(memory) == 0 {
+        return nil
+    }
+    return unsafe.Pointer(&memory[0])
+}
+
+//export retro_get_memory_size
+func retro_get_memory_size(id C.unsigned) C.size_t {
+    return C.size_t(len(saveMemory(id)))
+}
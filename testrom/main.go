@@ -0,0 +1,157 @@
+package main
+
+// run blargg's test roms, such as mem_timing, without a window and report whether
+// each one passed
+//
+//   testrom [-seconds 60] [-cycle-accurate=false] [-log warn] rom.gb...
+//
+// it is also an example of running core.Machine on its own
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "flag"
+    "strings"
+    "log/slog"
+
+    "github.com/kazzmir/gameboy/core"
+)
+
+// the tests print their result to the link port, and the newer ones also to cartridge
+// ram at 0xa004 once 0xa001-0xa003 hold this signature
+var ramSignature = []uint8{0xde, 0xb0, 0x61}
+
+// collects the text a test prints through the link port
+type serialOutput struct {
+    text strings.Builder
+}
+
+func (output *serialOutput) Exchange(value uint8) uint8 {
+    output.text.WriteByte(value)
+    return 0xff
+}
+
+// the result a test wrote to cartridge ram, if it has finished
+func ramResult(cpu *core.CPU) (string, bool, bool) {
+    for i, value := range ramSignature {
+        if cpu.Peek(0xa001 + uint16(i)) != value {
+            return "", false, false
+        }
+    }
+
+    // 0x80 while the test is still running, otherwise the result code
+    status := cpu.Peek(0xa000)
+    if status == 0x80 {
+        return "", false, false
+    }
+
+    var text strings.Builder
+    for address := uint16(0xa004); address < 0xc000; address++ {
+        value := cpu.Peek(address)
+        if value == 0 {
+            break
+        }
+        text.WriteByte(value)
+    }
+
+    return text.String(), status == 0, true
+}
+
+// run a rom until it reports a result or the time runs out
+func runTest(path string, seconds int, cycleAccurate bool, logger *core.Logger) (bool, string, error) {
+    gameboyFile, err := core.LoadGameboyFromFile(path)
+    if err != nil {
+        return false, "", err
+    }
+
+    mbc, err := core.MakeMBC(gameboyFile.GetCartridgeType(), gameboyFile.GetRom())
+    if err != nil {
+        return false, "", fmt.Errorf("unhandled cartridge type 0x%x: %v", gameboyFile.GetCartridgeType(), err)
+    }
+
+    cpu := core.MakeCPU(mbc, 44100)
+    cpu.SetLogger(logger)
+    cpu.InitializeDMG()
+    cpu.CGB = gameboyFile.GetCGBFlag() & 0x80 != 0
+    cpu.Error = true
+    cpu.SetCycleAccurate(cycleAccurate)
+
+    output := &serialOutput{}
+    cpu.AttachSerial(output)
+
+    machine := core.MakeMachine(cpu)
+
+    frames := int(int64(seconds) * core.CPUSpeed / core.FrameClocks)
+    for range frames {
+        machine.RunFrame()
+        // nothing plays the audio, so don't let it pile up
+        machine.DrainAudio()
+
+        text, passed, done := ramResult(cpu)
+        if done {
+            return passed, text, nil
+        }
+
+        serial := output.text.String()
+        if strings.Contains(serial, "Passed") {
+            return true, serial, nil
+        }
+        if strings.Contains(serial, "Failed") {
+            return false, serial, nil
+        }
+    }
+
+    return false, output.text.String(), fmt.Errorf("no result after %v seconds", seconds)
+}
+
+func main() {
+    seconds := flag.Int("seconds", 60, "Emulated seconds to wait for each test to finish")
+    cycleAccurate := flag.Bool("cycle-accurate", true, "Tick the system on each memory access")
+    // the tests poke at unmapped memory on purpose, so only errors are shown by default
+    logLevels := flag.String("log", "error", "Log levels for all of the emulator or per category (cpu, ppu, apu, mbc, io), e.g. warn,mbc=off")
+    flag.Usage = func() {
+        fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [options] rom.gb...\n", os.Args[0])
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+
+    if flag.NArg() < 1 {
+        flag.Usage()
+        os.Exit(1)
+    }
+
+    logger := core.MakeLogger(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+    err := logger.Configure(*logLevels)
+    if err != nil {
+        log.Printf("Invalid -log: %v", err)
+        os.Exit(1)
+    }
+
+    failed := 0
+    for _, path := range flag.Args() {
+        passed, text, err := runTest(path, *seconds, *cycleAccurate, logger)
+        if err != nil {
+            log.Printf("%v: %v", path, err)
+        }
+
+        result := "FAIL"
+        if passed {
+            result = "PASS"
+        } else {
+            failed += 1
+        }
+
+        fmt.Printf("%v %v\n", result, path)
+        if !passed && strings.TrimSpace(text) != "" {
+            fmt.Println(strings.TrimSpace(text))
+        }
+    }
+
+    logger.Flush()
+
+    fmt.Printf("%v of %v passed\n", len(flag.Args()) - failed, len(flag.Args()))
+    if failed > 0 {
+        os.Exit(1)
+    }
+}